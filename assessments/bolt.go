@@ -0,0 +1,312 @@
+package assessments
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Assessment ID to record
+	recordsBucket = []byte("records")
+	// Event time followed by assessment ID, ordering assessments for queries
+	timelineBucket = []byte("timeline")
+	// IDs of labelled assessments
+	labelledBucket = []byte("labelled")
+	// A bucket per tenant by name, each holding the tenant's own records, timeline and labelled buckets. Assessments
+	// stored without a tenant are in the top level buckets.
+	tenantsBucket = []byte("tenants")
+)
+
+// How often expired assessments are removed from the bolt store
+const pruneInterval = time.Hour
+
+// boltStore keeps assessments in a single file for deployments without redis. Only one process can open the file.
+type boltStore struct {
+	db        *bolt.DB
+	retention time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// OpenBoltStore opens, or creates, a bolt store at path and removes any assessments past retention
+func OpenBoltStore(path string, retention time.Duration) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordsBucket, timelineBucket, labelledBucket, tenantsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &boltStore{db: db, retention: retention}
+	if err := store.prune(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// timelineKey sorts by event time, the ID keeps events at the same time apart
+func timelineKey(timestamp time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(timestamp.UnixNano()))
+	return append(key, id...)
+}
+
+func timelineTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
+
+// boltBuckets hold one tenant's assessments
+type boltBuckets struct {
+	records, timeline, labelled *bolt.Bucket
+}
+
+// tenantBuckets returns the buckets of the tenant's assessments. In a read-only transaction a tenant that has never
+// stored an assessment has no buckets, and ok is false.
+func tenantBuckets(tx *bolt.Tx, tenant string) (buckets boltBuckets, ok bool, err error) {
+	if tenant == "" {
+		return boltBuckets{tx.Bucket(recordsBucket), tx.Bucket(timelineBucket), tx.Bucket(labelledBucket)}, true, nil
+	}
+
+	tenants := tx.Bucket(tenantsBucket)
+	parent := tenants.Bucket([]byte(tenant))
+	if parent == nil {
+		if !tx.Writable() {
+			return boltBuckets{}, false, nil
+		}
+		if parent, err = tenants.CreateBucket([]byte(tenant)); err != nil {
+			return boltBuckets{}, false, err
+		}
+		for _, bucket := range [][]byte{recordsBucket, timelineBucket, labelledBucket} {
+			if _, err := parent.CreateBucket(bucket); err != nil {
+				return boltBuckets{}, false, err
+			}
+		}
+	}
+	return boltBuckets{parent.Bucket(recordsBucket), parent.Bucket(timelineBucket), parent.Bucket(labelledBucket)}, true, nil
+}
+
+func (s *boltStore) Save(ctx context.Context, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		buckets, _, err := tenantBuckets(tx, record.Tenant)
+		if err != nil {
+			return err
+		}
+		if err := buckets.records.Put([]byte(record.ID), data); err != nil {
+			return err
+		}
+		return buckets.timeline.Put(timelineKey(record.Timestamp, record.ID), nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	due := time.Since(s.lastPrune) > pruneInterval
+	s.mu.Unlock()
+	if due {
+		return s.prune(time.Now())
+	}
+	return nil
+}
+
+// prune removes assessments whose events happened before the retention period
+func (s *boltStore) prune(now time.Time) error {
+	s.mu.Lock()
+	s.lastPrune = now
+	s.mu.Unlock()
+
+	cutoff := now.Add(-s.retention)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		tenants := []string{""}
+		err := tx.Bucket(tenantsBucket).ForEach(func(name, _ []byte) error {
+			tenants = append(tenants, string(name))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, tenant := range tenants {
+			buckets, _, err := tenantBuckets(tx, tenant)
+			if err != nil {
+				return err
+			}
+			if err := buckets.prune(cutoff); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// prune removes the tenant's assessments whose events happened before cutoff
+func (b boltBuckets) prune(cutoff time.Time) error {
+	timeline := b.timeline.Cursor()
+	for key, _ := timeline.First(); key != nil && timelineTime(key).Before(cutoff); key, _ = timeline.First() {
+		id := key[8:]
+		if err := b.records.Delete(id); err != nil {
+			return err
+		}
+		if err := b.labelled.Delete(id); err != nil {
+			return err
+		}
+		if err := timeline.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRecord reads one of the tenant's records within a transaction
+func (b boltBuckets) getRecord(id []byte) (Record, error) {
+	data := b.records.Get(id)
+	if data == nil {
+		return Record{}, ErrNotFound
+	}
+	var record Record
+	err := json.Unmarshal(data, &record)
+	return record, err
+}
+
+func (s *boltStore) Get(ctx context.Context, tenant string, id string) (Record, error) {
+	var record Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buckets, ok, err := tenantBuckets(tx, tenant)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNotFound
+		}
+		record, err = buckets.getRecord([]byte(id))
+		return err
+	})
+	return record, err
+}
+
+func (s *boltStore) SetFeedback(ctx context.Context, tenant string, id string, feedback Feedback) (Record, error) {
+	var record Record
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		buckets, _, err := tenantBuckets(tx, tenant)
+		if err != nil {
+			return err
+		}
+		record, err = buckets.getRecord([]byte(id))
+		if err != nil {
+			return err
+		}
+		record.Feedback = &feedback
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := buckets.records.Put([]byte(id), data); err != nil {
+			return err
+		}
+		return buckets.labelled.Put([]byte(id), nil)
+	})
+	return record, err
+}
+
+func (s *boltStore) Labelled(ctx context.Context, tenant string) ([]Record, error) {
+	var records []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buckets, ok, err := tenantBuckets(tx, tenant)
+		if err != nil || !ok {
+			return err
+		}
+		return buckets.labelled.ForEach(func(id, _ []byte) error {
+			record, err := buckets.getRecord(id)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Query walks the timeline backwards from the cursor, or from the end of the time range
+func (s *boltStore) Query(ctx context.Context, query Query) (Page, error) {
+	var upper []byte
+	switch {
+	case query.Cursor != "":
+		cursor, err := hex.DecodeString(query.Cursor)
+		if err != nil || len(cursor) < 8 {
+			return Page{}, ErrBadCursor
+		}
+		upper = cursor
+	case !query.To.IsZero():
+		upper = timelineKey(query.To.Add(time.Nanosecond), "")
+	}
+
+	page := Page{Events: []Record{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buckets, ok, err := tenantBuckets(tx, query.Tenant)
+		if err != nil || !ok {
+			return err
+		}
+		timeline := buckets.timeline.Cursor()
+
+		// Start from the last key before upper, which is excluded
+		var key []byte
+		if upper == nil {
+			key, _ = timeline.Last()
+		} else if key, _ = timeline.Seek(upper); key == nil {
+			key, _ = timeline.Last()
+		} else {
+			key, _ = timeline.Prev()
+		}
+
+		for scanned := 1; key != nil; key, _ = timeline.Prev() {
+			if !query.From.IsZero() && timelineTime(key).Before(query.From) {
+				return nil
+			}
+
+			record, err := buckets.getRecord(key[8:])
+			if err != nil {
+				return err
+			}
+			if query.matches(record) {
+				page.Events = append(page.Events, record)
+			}
+			if len(page.Events) == query.limit() || scanned == maxQueryScan {
+				page.NextCursor = hex.EncodeToString(key)
+				return nil
+			}
+			scanned++
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,115 @@
+package assessments
+
+import (
+	"context"
+	"errors"
+	"rba/util"
+	"time"
+)
+
+// Feedback is an analyst's label for an assessed event
+type Feedback struct {
+	Label   string    `json:"label"`
+	Comment string    `json:"comment,omitempty"`
+	KeyID   string    `json:"keyId"`
+	At      time.Time `json:"at"`
+}
+
+// SetFeedback checks the label and gives it to one of the tenant's stored assessments, replacing any earlier label
+func SetFeedback(ctx context.Context, store Store, tenant string, id string, feedback Feedback) (Record, error) {
+	if !util.IsValidLabel(feedback.Label) {
+		return Record{}, errors.New("label must be one of confirmed_fraud, false_positive or legitimate")
+	}
+	if store == nil {
+		return Record{}, ErrUnavailable
+	}
+	return store.SetFeedback(ctx, tenant, id, feedback)
+}
+
+// Performance compares when a rule fired with the labels given by analysts, counting confirmed fraud as positive
+type Performance struct {
+	TruePositives  int     `json:"truePositives"`
+	FalsePositives int     `json:"falsePositives"`
+	TrueNegatives  int     `json:"trueNegatives"`
+	FalseNegatives int     `json:"falseNegatives"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+}
+
+func (p *Performance) add(fired bool, fraud bool) {
+	switch {
+	case fired && fraud:
+		p.TruePositives++
+	case fired:
+		p.FalsePositives++
+	case fraud:
+		p.FalseNegatives++
+	default:
+		p.TrueNegatives++
+	}
+}
+
+func (p *Performance) finish() {
+	if predicted := p.TruePositives + p.FalsePositives; predicted > 0 {
+		p.Precision = float64(p.TruePositives) / float64(predicted)
+	}
+	if actual := p.TruePositives + p.FalseNegatives; actual > 0 {
+		p.Recall = float64(p.TruePositives) / float64(actual)
+	}
+}
+
+// Report is the precision and recall of the overall decision and of each rule over the labelled assessments
+type Report struct {
+	Labelled int                    `json:"labelled"`
+	Decision Performance            `json:"decision"`
+	Rules    map[string]Performance `json:"rules"`
+}
+
+// addRule counts a rule's result under name, leaving out results that errored
+func (r *Report) addRule(name string, result util.RiskResult, fraud bool) {
+	if result.Err != nil {
+		return
+	}
+	performance := r.Rules[name]
+	performance.add(result.Score > 0, fraud)
+	r.Rules[name] = performance
+}
+
+// BuildReport scores every labelled assessment of the tenant still held. A rule fired when it scored above 0 without an
+// error, rules that errored are left out for that event. Shadow rules are reported as shadow:<rule>, apart from an
+// enforced copy of the same rule.
+func BuildReport(ctx context.Context, store Store, tenant string) (Report, error) {
+	report := Report{Rules: map[string]Performance{}}
+	if store == nil {
+		return report, ErrUnavailable
+	}
+
+	records, err := store.Labelled(ctx, tenant)
+	if err != nil {
+		return report, err
+	}
+
+	for _, record := range records {
+		if record.Feedback == nil {
+			continue
+		}
+
+		fraud := record.Feedback.Label == util.Labels.ConfirmedFraud
+		report.Labelled++
+		report.Decision.add(record.Decision == util.Decisions.Alert, fraud)
+
+		for _, result := range record.RuleResults {
+			report.addRule(result.Name, result, fraud)
+		}
+		for _, result := range record.ShadowResults {
+			report.addRule(util.ShadowName(result.Name), result, fraud)
+		}
+	}
+
+	report.Decision.finish()
+	for name, performance := range report.Rules {
+		performance.finish()
+		report.Rules[name] = performance
+	}
+	return report, nil
+}
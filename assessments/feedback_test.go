@@ -0,0 +1,134 @@
+package assessments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var testStore Store
+
+// TestMain connects to redis on database 1, leaving database 0 to the rules tests which may run at the same time
+func TestMain(m *testing.M) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	services.RedisClient = redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   1,
+	})
+
+	ctx := context.Background()
+	if err := services.RedisClient.Ping(ctx).Err(); err != nil {
+		panic(fmt.Sprintf("failed to connect to redis at %s: %v", addr, err))
+	}
+	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
+		panic(fmt.Sprintf("failed to flush redis before tests: %v", err))
+	}
+
+	testStore = NewRedisStore(services.RedisClient, "", defaultRetention)
+
+	code := m.Run()
+	services.RedisClient.Close()
+	os.Exit(code)
+}
+
+func saveLabelled(t *testing.T, ctx context.Context, store Store, decision string, velocityScore float64, label string) {
+	record := Record{
+		ID:       NewID(),
+		Event:    util.Events.Login,
+		Decision: decision,
+		RuleResults: []util.RiskResult{
+			{Name: util.Rules.Velocity, Strategy: util.Strategies.Average, Score: velocityScore},
+		},
+	}
+	if err := store.Save(ctx, record); err != nil {
+		t.Fatalf("unexpected error saving assessment: %v", err)
+	}
+	if _, err := SetFeedback(ctx, store, "", record.ID, Feedback{Label: label, At: time.Now()}); err != nil {
+		t.Fatalf("unexpected error giving feedback: %v", err)
+	}
+}
+
+func TestFeedbackReport(t *testing.T) {
+	ctx := context.Background()
+	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+
+	saveLabelled(t, ctx, testStore, util.Decisions.Alert, 1, util.Labels.ConfirmedFraud)
+	saveLabelled(t, ctx, testStore, util.Decisions.Alert, 1, util.Labels.FalsePositive)
+	saveLabelled(t, ctx, testStore, util.Decisions.Pass, 0, util.Labels.ConfirmedFraud)
+	saveLabelled(t, ctx, testStore, util.Decisions.Pass, 0, util.Labels.Legitimate)
+
+	report, err := BuildReport(ctx, testStore, "")
+	if err != nil {
+		t.Fatalf("unexpected error building report: %v", err)
+	}
+	if report.Labelled != 4 {
+		t.Errorf("expected 4 labelled events, got %d", report.Labelled)
+	}
+	velocity := report.Rules[util.Rules.Velocity]
+	if velocity.TruePositives != 1 || velocity.FalsePositives != 1 || velocity.FalseNegatives != 1 || velocity.TrueNegatives != 1 {
+		t.Errorf("expected one of each outcome for velocity, got %+v", velocity)
+	}
+	if velocity.Precision != 0.5 || velocity.Recall != 0.5 {
+		t.Errorf("expected precision and recall of 0.5, got %v and %v", velocity.Precision, velocity.Recall)
+	}
+}
+
+func TestSetFeedbackErrors(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := SetFeedback(ctx, testStore, "", "missing", Feedback{Label: util.Labels.Legitimate}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown event, got %v", err)
+	}
+	if _, err := SetFeedback(ctx, testStore, "", "missing", Feedback{Label: "fraud"}); err == nil {
+		t.Errorf("expected an invalid label to fail")
+	}
+}
+
+func TestFeedbackReportShadow(t *testing.T) {
+	ctx := context.Background()
+	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+
+	// The enforced velocity rule fires on the fraud, its shadow copy with a higher limit doesn't
+	record := Record{
+		ID:          NewID(),
+		Event:       util.Events.Login,
+		Decision:    util.Decisions.Alert,
+		RuleResults: []util.RiskResult{{Name: util.Rules.Velocity, Strategy: util.Strategies.Average, Score: 1}},
+		ShadowResults: []util.RiskResult{
+			{Name: util.Rules.Velocity, Strategy: util.Strategies.Average, Score: 0},
+		},
+	}
+	if err := testStore.Save(ctx, record); err != nil {
+		t.Fatalf("unexpected error saving assessment: %v", err)
+	}
+	if _, err := SetFeedback(ctx, testStore, "", record.ID, Feedback{Label: util.Labels.ConfirmedFraud, At: time.Now()}); err != nil {
+		t.Fatalf("unexpected error giving feedback: %v", err)
+	}
+
+	report, err := BuildReport(ctx, testStore, "")
+	if err != nil {
+		t.Fatalf("unexpected error building report: %v", err)
+	}
+	if enforced := report.Rules[util.Rules.Velocity]; enforced.TruePositives != 1 || enforced.FalseNegatives != 0 {
+		t.Errorf("expected the enforced rule to have caught the fraud once, got %+v", enforced)
+	}
+	if shadow := report.Rules[util.ShadowName(util.Rules.Velocity)]; shadow.FalseNegatives != 1 || shadow.TruePositives != 0 {
+		t.Errorf("expected the shadow copy to have missed the fraud once, got %+v", shadow)
+	}
+}
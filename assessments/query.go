@@ -0,0 +1,95 @@
+package assessments
+
+import (
+	"rba/util"
+	"time"
+)
+
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 500
+	// Upper bound on the records looked at for one page, so a narrow filter over a long retention can't tie up the
+	// store. A page that hits it is returned short with a cursor to carry on from.
+	maxQueryScan = 10000
+)
+
+// Query filters stored assessments. Empty fields match everything.
+type Query struct {
+	// Whose assessments are queried, see Store
+	Tenant   string
+	Account  string
+	IP       string
+	Decision string
+	// Matches events where the rule scored above 0, shadow:<rule> for a shadow rule
+	Rule string
+	// Inclusive bounds on when the event happened
+	From time.Time
+	To   time.Time
+	// Defaults to DefaultQueryLimit, at most MaxQueryLimit
+	Limit int
+	// NextCursor of the previous page
+	Cursor string
+}
+
+// Page is one page of query results. NextCursor is empty when there are no more results.
+type Page struct {
+	Events     []Record `json:"events"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+func (q Query) limit() int {
+	if q.Limit <= 0 {
+		return DefaultQueryLimit
+	}
+	return min(q.Limit, MaxQueryLimit)
+}
+
+// inRange checks the event time against the query bounds
+func (q Query) inRange(timestamp time.Time) bool {
+	if !q.From.IsZero() && timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && timestamp.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// matches applies every filter to a record
+func (q Query) matches(record Record) bool {
+	if !q.inRange(record.Timestamp) {
+		return false
+	}
+	if q.Decision != "" && record.Decision != q.Decision {
+		return false
+	}
+	if q.Account != "" {
+		if account, err := util.GetStringField(record.Data, util.Entities.Account); err != nil || account != q.Account {
+			return false
+		}
+	}
+	if q.IP != "" {
+		if ip, err := util.GetStringField(record.Data, util.Entities.IP); err != nil || ip != q.IP {
+			return false
+		}
+	}
+	if q.Rule != "" && !fired(record, q.Rule) {
+		return false
+	}
+	return true
+}
+
+// fired reports whether the named rule scored above 0 without an error. Shadow rules are named with util.ShadowName.
+func fired(record Record, rule string) bool {
+	for _, result := range record.RuleResults {
+		if result.Name == rule && result.Err == nil && result.Score > 0 {
+			return true
+		}
+	}
+	for _, result := range record.ShadowResults {
+		if util.ShadowName(result.Name) == rule && result.Err == nil && result.Score > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package assessments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Stream of every assessment in the order they were received
+	streamKey = "assessments:stream"
+	// Sorted set of the IDs of labelled assessments, scored by when they were labelled
+	labelledKey = "assessments:labelled"
+	// Stream entries read per round trip when querying
+	queryBatch = 200
+)
+
+// redisStore appends assessments to a redis stream trimmed to the retention period. Each assessment also has a hash,
+// expiring with it, holding its stream entry ID and any feedback, since stream entries can't be changed. Every tenant
+// has its own stream, hashes and labelled set under tenant:<name>:, so a tenant's queries only read its own events.
+type redisStore struct {
+	client    redis.UniversalClient
+	prefix    string
+	retention time.Duration
+}
+
+// NewRedisStore returns a store that keeps assessments in redis, with every key under prefix when it is set
+func NewRedisStore(client redis.UniversalClient, prefix string, retention time.Duration) Store {
+	return &redisStore{client: client, prefix: prefix, retention: retention}
+}
+
+func (s *redisStore) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + ":" + key
+}
+
+// tenantKey is a key of the tenant's assessments, those stored without a tenant keep the unscoped keys
+func (s *redisStore) tenantKey(tenant string, key string) string {
+	if tenant == "" {
+		return s.key(key)
+	}
+	return s.key(fmt.Sprintf("tenant:%s:%s", tenant, key))
+}
+
+func (s *redisStore) indexKey(tenant string, id string) string {
+	return s.tenantKey(tenant, fmt.Sprintf("assessment:%s", id))
+}
+
+func (s *redisStore) Save(ctx context.Context, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	entry, err := s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.tenantKey(record.Tenant, streamKey),
+		MinID:  strconv.FormatInt(time.Now().Add(-s.retention).UnixMilli(), 10),
+		Approx: true,
+		Values: map[string]interface{}{"record": data},
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.indexKey(record.Tenant, record.ID), "entry", entry)
+		pipe.Expire(ctx, s.indexKey(record.Tenant, record.ID), s.retention)
+		return nil
+	})
+	return err
+}
+
+// decodeEntry reads the record from a stream entry
+func decodeEntry(message redis.XMessage) (Record, error) {
+	data, ok := message.Values["record"].(string)
+	if !ok {
+		return Record{}, fmt.Errorf("stream entry %s has no record", message.ID)
+	}
+	var record Record
+	err := json.Unmarshal([]byte(data), &record)
+	return record, err
+}
+
+// decodeFeedback attaches feedback stored in a record's hash
+func decodeFeedback(record *Record, data string) error {
+	if data == "" {
+		return nil
+	}
+	var feedback Feedback
+	if err := json.Unmarshal([]byte(data), &feedback); err != nil {
+		return err
+	}
+	record.Feedback = &feedback
+	return nil
+}
+
+func (s *redisStore) Get(ctx context.Context, tenant string, id string) (Record, error) {
+	index, err := s.client.HGetAll(ctx, s.indexKey(tenant, id)).Result()
+	if err != nil {
+		return Record{}, err
+	}
+	entry, ok := index["entry"]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+
+	messages, err := s.client.XRange(ctx, s.tenantKey(tenant, streamKey), entry, entry).Result()
+	if err != nil {
+		return Record{}, err
+	}
+	if len(messages) == 0 {
+		// Trimmed from the stream before the hash expired
+		return Record{}, ErrNotFound
+	}
+
+	record, err := decodeEntry(messages[0])
+	if err != nil {
+		return Record{}, err
+	}
+	return record, decodeFeedback(&record, index["feedback"])
+}
+
+func (s *redisStore) SetFeedback(ctx context.Context, tenant string, id string, feedback Feedback) (Record, error) {
+	record, err := s.Get(ctx, tenant, id)
+	if err != nil {
+		return Record{}, err
+	}
+	record.Feedback = &feedback
+
+	data, err := json.Marshal(feedback)
+	if err != nil {
+		return Record{}, err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.indexKey(tenant, id), "feedback", data)
+		pipe.ZAdd(ctx, s.tenantKey(tenant, labelledKey), redis.Z{Score: float64(feedback.At.UnixMilli()), Member: id})
+		return nil
+	})
+	return record, err
+}
+
+func (s *redisStore) Labelled(ctx context.Context, tenant string) ([]Record, error) {
+	ids, err := s.client.ZRange(ctx, s.tenantKey(tenant, labelledKey), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, id := range ids {
+		record, err := s.Get(ctx, tenant, id)
+		if errors.Is(err, ErrNotFound) {
+			// Expired, no longer labelled
+			s.client.ZRem(ctx, s.tenantKey(tenant, labelledKey), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// validEntryID checks a cursor is a stream entry ID, <ms>-<seq>
+func validEntryID(id string) bool {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return false
+	}
+	_, msErr := strconv.ParseUint(ms, 10, 64)
+	_, seqErr := strconv.ParseUint(seq, 10, 64)
+	return msErr == nil && seqErr == nil
+}
+
+// Query walks the stream backwards from the cursor. Stream entries are ordered by when the event was received, which
+// is never earlier than when it happened, so the walk can stop at the start of the time range.
+func (s *redisStore) Query(ctx context.Context, query Query) (Page, error) {
+	end := "+"
+	if query.Cursor != "" {
+		if !validEntryID(query.Cursor) {
+			return Page{}, ErrBadCursor
+		}
+		end = "(" + query.Cursor
+	}
+	start := "-"
+	if !query.From.IsZero() {
+		start = strconv.FormatInt(query.From.UnixMilli(), 10)
+	}
+
+	page := Page{Events: []Record{}}
+	scanned := 0
+	for {
+		messages, err := s.client.XRevRangeN(ctx, s.tenantKey(query.Tenant, streamKey), end, start, queryBatch).Result()
+		if err != nil {
+			return Page{}, err
+		}
+
+		for _, message := range messages {
+			scanned++
+			record, err := decodeEntry(message)
+			if err != nil {
+				return Page{}, err
+			}
+			if query.matches(record) {
+				page.Events = append(page.Events, record)
+			}
+			if len(page.Events) == query.limit() || scanned == maxQueryScan {
+				page.NextCursor = message.ID
+				return page, s.attachFeedback(ctx, query.Tenant, page.Events)
+			}
+		}
+
+		if len(messages) < queryBatch {
+			return page, s.attachFeedback(ctx, query.Tenant, page.Events)
+		}
+		end = "(" + messages[len(messages)-1].ID
+	}
+}
+
+// attachFeedback reads the feedback for a page of records in one round trip
+func (s *redisStore) attachFeedback(ctx context.Context, tenant string, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(records))
+	for i, record := range records {
+		cmds[i] = pipe.HGet(ctx, s.indexKey(tenant, record.ID), "feedback")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	for i, cmd := range cmds {
+		if err := decodeFeedback(&records[i], cmd.Val()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close leaves the shared redis connection open
+func (s *redisStore) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package assessments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"rba/services"
+	"rba/util"
+	"time"
+)
+
+// How long assessments are kept for feedback, reports and queries when the config doesn't say
+const defaultRetention = 30 * 24 * time.Hour
+
+var (
+	ErrNotFound    = errors.New("assessment not found")
+	ErrUnavailable = errors.New("assessments are not stored, set services.assessments.store in rules.yaml")
+	ErrBadCursor   = errors.New("invalid cursor")
+)
+
+// Record is an assessed event as it was scored, along with any feedback given on it since
+type Record struct {
+	ID            string                 `json:"id"`
+	Event         string                 `json:"event"`
+	Timestamp     time.Time              `json:"timestamp"`
+	Data          map[string]interface{} `json:"data"`
+	Risk          float64                `json:"risk"`
+	Decision      string                 `json:"decision"`
+	RuleResults   []util.RiskResult      `json:"ruleResults"`
+	ShadowResults []util.RiskResult      `json:"shadowResults,omitempty"`
+	// Set when a rule errored or timed out, so the risk was assessed without it
+	Degraded bool      `json:"degraded,omitempty"`
+	Feedback *Feedback `json:"feedback,omitempty"`
+	// Set when tenants are isolated, the record is stored with the tenant's other assessments
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// NewID returns a random ID for an event, returned from /event so feedback can refer to it
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Store persists assessments. Records expire after the configured retention. Each tenant's assessments are kept apart
+// from every other tenant's, the empty tenant holds those stored while tenants weren't isolated.
+type Store interface {
+	// Save stores a newly assessed event with the other assessments of its tenant
+	Save(ctx context.Context, record Record) error
+	// Get returns one of the tenant's stored assessments, or ErrNotFound if it doesn't exist or has expired
+	Get(ctx context.Context, tenant string, id string) (Record, error)
+	// SetFeedback labels one of the tenant's stored assessments, replacing any earlier label, and returns the updated
+	// record
+	SetFeedback(ctx context.Context, tenant string, id string, feedback Feedback) (Record, error)
+	// Labelled returns every stored assessment of the tenant that has feedback
+	Labelled(ctx context.Context, tenant string) ([]Record, error)
+	// Query returns a page of the query tenant's assessments matching the filters, newest first
+	Query(ctx context.Context, query Query) (Page, error)
+	Close() error
+}
+
+// Store backends, set with services.assessments.store in rules.yaml
+var Backends = struct {
+	Redis string
+	Bolt  string
+	None  string
+}{
+	Redis: "redis",
+	Bolt:  "bolt",
+	None:  "none",
+}
+
+// Config is the services.assessments section of rules.yaml
+type Config struct {
+	// redis, bolt or none. Defaults to redis when redis is enabled and none otherwise.
+	Store string `yaml:"store"`
+	// File the bolt store keeps assessments in
+	Path          string `yaml:"path"`
+	RetentionDays int    `yaml:"retentionDays"`
+}
+
+// Backend returns the configured backend, applying the default
+func (c Config) Backend(redisEnabled bool) string {
+	if c.Store != "" {
+		return c.Store
+	}
+	if redisEnabled {
+		return Backends.Redis
+	}
+	return Backends.None
+}
+
+func (c Config) retention() time.Duration {
+	if c.RetentionDays > 0 {
+		return time.Duration(c.RetentionDays) * 24 * time.Hour
+	}
+	return defaultRetention
+}
+
+// Validate checks the config without opening the store
+func (c Config) Validate(redisEnabled bool) error {
+	if c.RetentionDays < 0 {
+		return errors.New("assessments retentionDays must be 0 or more")
+	}
+
+	switch c.Backend(redisEnabled) {
+	case Backends.Redis:
+		if !redisEnabled {
+			return errors.New("the redis assessment store requires redis to be enabled")
+		}
+	case Backends.Bolt:
+		if c.Path == "" {
+			return errors.New("the bolt assessment store requires a path")
+		}
+	case Backends.None:
+	default:
+		return fmt.Errorf("unknown assessment store %q, must be one of redis, bolt or none", c.Store)
+	}
+	return nil
+}
+
+// Open returns the configured store, or nil when assessments are not stored. The redis store uses the connection
+// made by rules.LoadConfig.
+func Open(c Config, redisEnabled bool) (Store, error) {
+	if err := c.Validate(redisEnabled); err != nil {
+		return nil, err
+	}
+
+	switch c.Backend(redisEnabled) {
+	case Backends.Redis:
+		if services.RedisClient == nil {
+			return nil, errors.New("the redis assessment store requires a redis connection")
+		}
+		return NewRedisStore(services.RedisClient, services.RedisKeyPrefix, c.retention()), nil
+	case Backends.Bolt:
+		return OpenBoltStore(c.Path, c.retention())
+	default:
+		return nil, nil
+	}
+}
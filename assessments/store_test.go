@@ -0,0 +1,242 @@
+package assessments
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+)
+
+// eachStore runs a test against a fresh redis store and a fresh bolt store
+func eachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("redis", func(t *testing.T) {
+		if err := services.RedisClient.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatalf("failed to flush redis: %v", err)
+		}
+		test(t, testStore)
+	})
+	t.Run("bolt", func(t *testing.T) {
+		store, err := OpenBoltStore(filepath.Join(t.TempDir(), "assessments.db"), defaultRetention)
+		if err != nil {
+			t.Fatalf("unexpected error opening bolt store: %v", err)
+		}
+		defer store.Close()
+		test(t, store)
+	})
+}
+
+func saveEvent(t *testing.T, store Store, timestamp time.Time, account string, decision string, velocityScore float64) Record {
+	return saveTenantEvent(t, store, "", timestamp, account, decision, velocityScore)
+}
+
+func saveTenantEvent(t *testing.T, store Store, tenant string, timestamp time.Time, account string, decision string, velocityScore float64) Record {
+	record := Record{
+		ID:        NewID(),
+		Tenant:    tenant,
+		Event:     util.Events.Login,
+		Timestamp: timestamp,
+		Data:      map[string]interface{}{"account": account, "ip": "1.2.3.4"},
+		Decision:  decision,
+		RuleResults: []util.RiskResult{
+			{Name: util.Rules.Velocity, Strategy: util.Strategies.Average, Score: velocityScore},
+		},
+	}
+	if err := store.Save(context.Background(), record); err != nil {
+		t.Fatalf("unexpected error saving assessment: %v", err)
+	}
+	return record
+}
+
+func TestStoreGet(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		saved := saveEvent(t, store, time.Now(), "alice", util.Decisions.Pass, 0)
+
+		record, err := store.Get(ctx, "", saved.ID)
+		if err != nil {
+			t.Fatalf("unexpected error getting assessment: %v", err)
+		}
+		if record.ID != saved.ID || record.Data["account"] != "alice" || record.Feedback != nil {
+			t.Errorf("expected the saved assessment without feedback, got %+v", record)
+		}
+
+		if _, err := store.SetFeedback(ctx, "", saved.ID, Feedback{Label: util.Labels.Legitimate, At: time.Now()}); err != nil {
+			t.Fatalf("unexpected error giving feedback: %v", err)
+		}
+		record, err = store.Get(ctx, "", saved.ID)
+		if err != nil || record.Feedback == nil || record.Feedback.Label != util.Labels.Legitimate {
+			t.Errorf("expected feedback to be stored with the assessment, got %+v (err %v)", record.Feedback, err)
+		}
+
+		if _, err := store.Get(ctx, "", "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for an unknown event, got %v", err)
+		}
+	})
+}
+
+func TestStoreQuery(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		old := saveEvent(t, store, now.Add(-3*time.Second), "alice", util.Decisions.Alert, 1)
+		saveEvent(t, store, now.Add(-2*time.Second), "bob", util.Decisions.Pass, 0)
+		recent := saveEvent(t, store, now.Add(-time.Second), "alice", util.Decisions.Pass, 0)
+
+		page, err := store.Query(ctx, Query{Account: "alice"})
+		if err != nil {
+			t.Fatalf("unexpected error querying: %v", err)
+		}
+		if len(page.Events) != 2 || page.Events[0].ID != recent.ID || page.Events[1].ID != old.ID {
+			t.Errorf("expected alice's two events newest first, got %+v", page.Events)
+		}
+
+		page, err = store.Query(ctx, Query{Rule: util.Rules.Velocity, Decision: util.Decisions.Alert})
+		if err != nil || len(page.Events) != 1 || page.Events[0].ID != old.ID {
+			t.Errorf("expected only the event velocity fired on, got %+v (err %v)", page.Events, err)
+		}
+
+		// A shadow copy of velocity is queried by its own name
+		shadow := Record{
+			ID:            NewID(),
+			Event:         util.Events.Login,
+			Timestamp:     now.Add(-500 * time.Millisecond),
+			Data:          map[string]interface{}{"account": "carol"},
+			Decision:      util.Decisions.Pass,
+			ShadowResults: []util.RiskResult{{Name: util.Rules.Velocity, Strategy: util.Strategies.Average, Score: 1}},
+		}
+		if err := store.Save(ctx, shadow); err != nil {
+			t.Fatalf("unexpected error saving assessment: %v", err)
+		}
+		page, err = store.Query(ctx, Query{Rule: util.ShadowName(util.Rules.Velocity)})
+		if err != nil || len(page.Events) != 1 || page.Events[0].ID != shadow.ID {
+			t.Errorf("expected only the event the shadow copy fired on, got %+v (err %v)", page.Events, err)
+		}
+		page, err = store.Query(ctx, Query{Rule: util.Rules.Velocity})
+		if err != nil || len(page.Events) != 1 || page.Events[0].ID != old.ID {
+			t.Errorf("expected the shadow copy to be left out of the enforced rule's events, got %+v (err %v)", page.Events, err)
+		}
+
+		page, err = store.Query(ctx, Query{From: now.Add(-2500 * time.Millisecond), To: now.Add(-1500 * time.Millisecond)})
+		if err != nil || len(page.Events) != 1 || page.Events[0].Data["account"] != "bob" {
+			t.Errorf("expected only bob's event in the time range, got %+v (err %v)", page.Events, err)
+		}
+	})
+}
+
+func TestStoreQueryPagination(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		for i := 5; i > 0; i-- {
+			saveEvent(t, store, now.Add(-time.Duration(i)*time.Second), "alice", util.Decisions.Pass, 0)
+		}
+
+		seen := map[string]bool{}
+		query := Query{Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatalf("expected pagination to finish within 3 pages")
+			}
+			page, err := store.Query(ctx, query)
+			if err != nil {
+				t.Fatalf("unexpected error querying: %v", err)
+			}
+			for _, record := range page.Events {
+				if seen[record.ID] {
+					t.Errorf("event %s returned on more than one page", record.ID)
+				}
+				seen[record.ID] = true
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		if len(seen) != 5 {
+			t.Errorf("expected all 5 events across the pages, got %d", len(seen))
+		}
+
+		if _, err := store.Query(ctx, Query{Cursor: "not a cursor"}); !errors.Is(err, ErrBadCursor) {
+			t.Errorf("expected ErrBadCursor, got %v", err)
+		}
+	})
+}
+
+func TestStoreTenants(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		portal := saveTenantEvent(t, store, "portal", now.Add(-time.Hour), "alice", util.Decisions.Pass, 0)
+		// More of another tenant's events than are read per round trip, all newer than the portal's
+		for i := 0; i < queryBatch+10; i++ {
+			saveTenantEvent(t, store, "mobile", now, "bob", util.Decisions.Pass, 0)
+		}
+		unscoped := saveEvent(t, store, now, "carol", util.Decisions.Pass, 0)
+
+		page, err := store.Query(ctx, Query{Tenant: "portal"})
+		if err != nil || len(page.Events) != 1 || page.Events[0].ID != portal.ID || page.NextCursor != "" {
+			t.Errorf("expected the portal's only event without a cursor, got %+v (cursor %q, err %v)", page.Events, page.NextCursor, err)
+		}
+		page, err = store.Query(ctx, Query{})
+		if err != nil || len(page.Events) != 1 || page.Events[0].ID != unscoped.ID {
+			t.Errorf("expected only the event stored without a tenant, got %d events (err %v)", len(page.Events), err)
+		}
+		page, err = store.Query(ctx, Query{Tenant: "unknown"})
+		if err != nil || len(page.Events) != 0 {
+			t.Errorf("expected no events for a tenant that has stored none, got %d (err %v)", len(page.Events), err)
+		}
+
+		for _, tenant := range []string{"", "mobile"} {
+			if _, err := store.Get(ctx, tenant, portal.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected another tenant's event to be not found for %q, got %v", tenant, err)
+			}
+			if _, err := store.SetFeedback(ctx, tenant, portal.ID, Feedback{Label: util.Labels.Legitimate, At: now}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected feedback on another tenant's event to be not found for %q, got %v", tenant, err)
+			}
+		}
+
+		if _, err := store.SetFeedback(ctx, "portal", portal.ID, Feedback{Label: util.Labels.Legitimate, At: now}); err != nil {
+			t.Fatalf("unexpected error giving feedback: %v", err)
+		}
+		if labelled, err := store.Labelled(ctx, "portal"); err != nil || len(labelled) != 1 || labelled[0].ID != portal.ID {
+			t.Errorf("expected the portal's labelled event, got %+v (err %v)", labelled, err)
+		}
+		if labelled, err := store.Labelled(ctx, "mobile"); err != nil || len(labelled) != 0 {
+			t.Errorf("expected no labelled events for another tenant, got %+v (err %v)", labelled, err)
+		}
+	})
+}
+
+func TestBoltStorePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "assessments.db")
+	store, err := OpenBoltStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error opening bolt store: %v", err)
+	}
+	expired := saveEvent(t, store, time.Now().Add(-2*time.Hour), "alice", util.Decisions.Pass, 0)
+	kept := saveEvent(t, store, time.Now(), "alice", util.Decisions.Pass, 0)
+	tenantExpired := saveTenantEvent(t, store, "portal", time.Now().Add(-2*time.Hour), "alice", util.Decisions.Pass, 0)
+	store.Close()
+
+	// Reopening prunes anything past retention
+	store, err = OpenBoltStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error reopening bolt store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if _, err := store.Get(ctx, "", expired.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the expired assessment to be pruned, got %v", err)
+	}
+	if _, err := store.Get(ctx, "", kept.ID); err != nil {
+		t.Errorf("expected the recent assessment to be kept, got %v", err)
+	}
+	if _, err := store.Get(ctx, "portal", tenantExpired.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a tenant's expired assessment to be pruned, got %v", err)
+	}
+}
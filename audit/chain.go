@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// KeyEnv is the environment variable holding the secret entries are signed with. Without it anyone who can write to
+// redis could rewrite the log and recompute every hash.
+const KeyEnv = "AUDIT_HMAC_KEY"
+
+// Shortest signing key accepted, the size of the HMAC-SHA256 output
+const minKeyLength = 32
+
+var ErrNoKey = fmt.Errorf("%s must be set to a secret of at least %d bytes to sign the audit log", KeyEnv, minKeyLength)
+
+// SigningKey reads the key entries are signed with from the environment
+func SigningKey() ([]byte, error) {
+	key := os.Getenv(KeyEnv)
+	if len(key) < minKeyLength {
+		return nil, ErrNoKey
+	}
+	return []byte(key), nil
+}
+
+// hashEntry signs an entry's JSON without its own hash
+func hashEntry(entry Entry, key []byte) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Link chains entry onto head, the last entry in the log or an empty Entry for the first, setting its sequence number
+// and hashes
+func Link(entry Entry, head Entry, key []byte) Entry {
+	entry.Seq = head.Seq + 1
+	entry.PrevHash = head.Hash
+	entry.Hash = hashEntry(entry, key)
+	return entry
+}
+
+// ChainError is the first entry that doesn't follow from the ones before it
+type ChainError struct {
+	Seq int64
+	Msg string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit entry %d: %s", e.Seq, e.Msg)
+}
+
+// ErrEmpty is returned by Chain.Verified for a log without entries, which is what a wiped log looks like
+var ErrEmpty = errors.New("the audit log has no entries")
+
+// Chain verifies entries one at a time, oldest first, so a long log can be checked a page at a time
+type Chain struct {
+	// The key the entries were signed with
+	Key []byte
+	// Number of entries verified
+	Length int64
+	// Hash of the last entry verified
+	Head string
+}
+
+// Add checks that an entry follows the last one added and that its hash matches its contents
+func (c *Chain) Add(entry Entry) error {
+	expected := c.Length + 1
+	switch {
+	case entry.Seq != expected:
+		return &ChainError{Seq: expected, Msg: fmt.Sprintf("expected sequence number %d, got %d", expected, entry.Seq)}
+	case entry.PrevHash != c.Head:
+		return &ChainError{Seq: entry.Seq, Msg: "previous hash does not match the entry before it"}
+	case !hmac.Equal([]byte(entry.Hash), []byte(hashEntry(entry, c.Key))):
+		return &ChainError{Seq: entry.Seq, Msg: "hash does not match the entry's contents"}
+	}
+
+	c.Length = entry.Seq
+	c.Head = entry.Hash
+	return nil
+}
+
+// Verified reports whether the chain holds any entries once they have all been added. An empty log verifies trivially,
+// so it is an error unless allowEmpty is set.
+func (c *Chain) Verified(allowEmpty bool) error {
+	if c.Length == 0 && !allowEmpty {
+		return ErrEmpty
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"rba/services"
+	"rba/util"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The log and the lists managed through the configuration API share a hash tag, so on a redis cluster they are in
+// one slot and a change can be written in the same transaction as its entry
+const keyTag = "{config}:"
+
+// Redis list the log is appended to. An entry's position in the list is its sequence number minus one.
+const logKey = keyTag + "audit:log"
+
+// Attempts to append before giving up when other writers keep moving the head of the log
+const appendAttempts = 10
+
+var ErrUnavailable = errors.New("the audit log requires redis to be enabled")
+
+// Entry records one admin action. Hash covers every other field, including the previous entry's hash, so changing,
+// removing or reordering entries breaks the chain from that point on.
+type Entry struct {
+	Seq      int64           `json:"seq"`
+	Time     time.Time       `json:"time"`
+	KeyID    string          `json:"keyId"`
+	SourceIP string          `json:"sourceIp"`
+	Action   string          `json:"action"`
+	Target   string          `json:"target"`
+	Before   json.RawMessage `json:"before"`
+	After    json.RawMessage `json:"after"`
+	PrevHash string          `json:"prevHash"`
+	Hash     string          `json:"hash"`
+}
+
+// sourceIP is the address the request came from. Forwarding headers are ignored as the client controls them.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewEntry describes an action taken by an authenticated request. before and after are the state of the target
+// around the change and are stored as JSON.
+func NewEntry(r *http.Request, action string, target string, before interface{}, after interface{}) (Entry, error) {
+	beforeJSON, err := json.Marshal(before)
+	if err != nil {
+		return Entry{}, err
+	}
+	afterJSON, err := json.Marshal(after)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return Entry{
+		Time:     time.Now().UTC(),
+		KeyID:    util.KeyIDFromContext(r.Context()),
+		SourceIP: sourceIP(r),
+		Action:   action,
+		Target:   target,
+		Before:   beforeJSON,
+		After:    afterJSON,
+	}, nil
+}
+
+// ListState is the before or after of a change to a list entry
+type ListState struct {
+	Listed bool `json:"listed"`
+}
+
+// ConfigKey returns the key of a list managed through the configuration API, in the same cluster slot as the log
+func ConfigKey(key string) string {
+	return keyTag + key
+}
+
+// SetChange adds a member to, or removes it from, a redis set holding one of the lists managed through the
+// configuration API. Key is the set's key from ConfigKey, without the services.redis.keyPrefix.
+type SetChange struct {
+	Key    string
+	Member string
+	Remove bool
+}
+
+// Append chains an entry onto the end of the log and returns it with its sequence number and hashes set
+func Append(ctx context.Context, entry Entry) (Entry, error) {
+	return commit(ctx, entry, nil, nil, nil)
+}
+
+// Apply makes a change and appends its entry in one transaction, so a change is never made without being recorded or
+// recorded without being made. The entry's before and after are read in the same transaction, so no other change can
+// come between them.
+func Apply(ctx context.Context, entry Entry, change SetChange) (Entry, error) {
+	if !strings.HasPrefix(change.Key, keyTag) {
+		return Entry{}, fmt.Errorf("%s can't be changed with the audit log, it isn't a ConfigKey", change.Key)
+	}
+	key := services.RedisKey(change.Key)
+	read := func(tx *redis.Tx, entry *Entry) error {
+		listed, err := tx.SIsMember(ctx, key, change.Member).Result()
+		if err != nil {
+			return err
+		}
+		if entry.Before, err = json.Marshal(ListState{Listed: listed}); err != nil {
+			return err
+		}
+		entry.After, err = json.Marshal(ListState{Listed: !change.Remove})
+		return err
+	}
+	write := func(pipe redis.Pipeliner) {
+		if change.Remove {
+			pipe.SRem(ctx, key, change.Member)
+		} else {
+			pipe.SAdd(ctx, key, change.Member)
+		}
+	}
+	return commit(ctx, entry, []string{key}, read, write)
+}
+
+// commit links entry onto the head of the log and appends it in a transaction watching the log and keys. read, when
+// set, fills in the entry from the watched keys first, and write queues the change the entry records.
+func commit(ctx context.Context, entry Entry, keys []string, read func(tx *redis.Tx, entry *Entry) error, write func(pipe redis.Pipeliner)) (Entry, error) {
+	if services.RedisClient == nil {
+		return Entry{}, ErrUnavailable
+	}
+	signingKey, err := SigningKey()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	for attempt := 0; attempt < appendAttempts; attempt++ {
+		linked := entry
+		err := services.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+			var head Entry
+			last, err := tx.LIndex(ctx, services.RedisKey(logKey), -1).Bytes()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			if err == nil {
+				if err := json.Unmarshal(last, &head); err != nil {
+					return err
+				}
+			}
+			if read != nil {
+				if err := read(tx, &linked); err != nil {
+					return err
+				}
+			}
+
+			linked = Link(linked, head, signingKey)
+			data, err := json.Marshal(linked)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if write != nil {
+					write(pipe)
+				}
+				pipe.RPush(ctx, services.RedisKey(logKey), data)
+				return nil
+			})
+			return err
+		}, append([]string{services.RedisKey(logKey)}, keys...)...)
+
+		if !errors.Is(err, redis.TxFailedErr) {
+			return linked, err
+		}
+	}
+	return Entry{}, fmt.Errorf("could not append to the audit log after %d attempts", appendAttempts)
+}
+
+// List returns up to limit entries after the given sequence number, oldest first
+func List(ctx context.Context, after int64, limit int) ([]Entry, error) {
+	if services.RedisClient == nil {
+		return nil, ErrUnavailable
+	}
+
+	values, err := services.RedisClient.LRange(ctx, services.RedisKey(logKey), after, after+int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(values))
+	for _, value := range values {
+		var entry Entry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, fmt.Errorf("audit entry %d: %w", after+int64(len(entries))+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,226 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"rba/services"
+	"rba/util"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Key the tests sign entries with
+const testKey = "0123456789abcdef0123456789abcdef"
+
+// TestMain connects to redis on database 2, apart from the other packages' tests which may run at the same time
+func TestMain(m *testing.M) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	os.Setenv(KeyEnv, testKey)
+	services.RedisClient = redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   2,
+	})
+
+	ctx := context.Background()
+	if err := services.RedisClient.Ping(ctx).Err(); err != nil {
+		panic(fmt.Sprintf("failed to connect to redis at %s: %v", addr, err))
+	}
+
+	code := m.Run()
+	services.RedisClient.Close()
+	os.Exit(code)
+}
+
+func appendEntries(t *testing.T, ctx context.Context, count int) {
+	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+
+	for i := 0; i < count; i++ {
+		r := httptest.NewRequest("PUT", "/configuration/rules/denylist", nil)
+		r = r.WithContext(util.WithKeyID(r.Context(), "client-1"))
+		entry, err := NewEntry(r, "denylist.add", fmt.Sprintf("ip 10.0.0.%d", i), map[string]bool{"listed": false}, map[string]bool{"listed": true})
+		if err != nil {
+			t.Fatalf("unexpected error creating entry: %v", err)
+		}
+		if _, err := Append(ctx, entry); err != nil {
+			t.Fatalf("unexpected error appending entry: %v", err)
+		}
+	}
+}
+
+func verify(ctx context.Context) error {
+	entries, err := List(ctx, 0, 100)
+	if err != nil {
+		return err
+	}
+	chain := Chain{Key: []byte(testKey)}
+	for _, entry := range entries {
+		if err := chain.Add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAppendAndVerify(t *testing.T) {
+	ctx := context.Background()
+	appendEntries(t, ctx, 3)
+
+	entries, err := List(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("unexpected error listing entries: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Seq != 2 || entries[1].Seq != 3 {
+		t.Fatalf("expected entries 2 and 3 after sequence number 1, got %+v", entries)
+	}
+	if entries[0].KeyID != "client-1" || entries[0].SourceIP != "192.0.2.1" {
+		t.Errorf("expected the key ID and source IP of the request, got %q and %q", entries[0].KeyID, entries[0].SourceIP)
+	}
+	if entries[1].PrevHash != entries[0].Hash {
+		t.Errorf("expected entry 3 to chain onto entry 2")
+	}
+
+	if err := verify(ctx); err != nil {
+		t.Errorf("expected an untouched log to verify, got %v", err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		tamper func() error
+		seq    int64
+	}{
+		{"edited", func() error {
+			entries, _ := List(ctx, 1, 1)
+			entries[0].KeyID = "someone-else"
+			data, _ := json.Marshal(entries[0])
+			return services.RedisClient.LSet(ctx, logKey, 1, data).Err()
+		}, 2},
+		{"re-signed without the key", func() error {
+			entries, _ := List(ctx, 0, 3)
+			head := entries[0]
+			for i, entry := range entries[1:] {
+				entry.KeyID = "someone-else"
+				head = Link(entry, head, []byte("not the key"))
+				data, _ := json.Marshal(head)
+				if err := services.RedisClient.LSet(ctx, logKey, int64(i+1), data).Err(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, 2},
+		{"removed", func() error {
+			return services.RedisClient.LRem(ctx, logKey, 1, services.RedisClient.LIndex(ctx, logKey, 1).Val()).Err()
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appendEntries(t, ctx, 3)
+			if err := tt.tamper(); err != nil {
+				t.Fatalf("failed to tamper with the log: %v", err)
+			}
+
+			var chainErr *ChainError
+			if err := verify(ctx); !errors.As(err, &chainErr) || chainErr.Seq != tt.seq {
+				t.Errorf("expected verification to fail at entry %d, got %v", tt.seq, err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+
+	r := httptest.NewRequest("PUT", "/configuration/rules/denylist", nil)
+	entry, err := NewEntry(r, "denylist.add", "ip 10.0.0.1", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating entry: %v", err)
+	}
+	change := SetChange{Key: ConfigKey("denylist:ips"), Member: "10.0.0.1"}
+
+	// The change and its entry are written together, with the before and after read in the transaction
+	applied, err := Apply(ctx, entry, change)
+	if err != nil {
+		t.Fatalf("unexpected error applying change: %v", err)
+	}
+	if string(applied.Before) != `{"listed":false}` || string(applied.After) != `{"listed":true}` {
+		t.Errorf("expected the entry to go from unlisted to listed, got %s and %s", applied.Before, applied.After)
+	}
+	if !services.RedisClient.SIsMember(ctx, change.Key, "10.0.0.1").Val() {
+		t.Errorf("expected the change to be made")
+	}
+	if err := verify(ctx); err != nil {
+		t.Errorf("expected the log to verify, got %v", err)
+	}
+
+	// Without the signing key nothing is recorded, so nothing is changed either
+	t.Setenv(KeyEnv, "")
+	change.Remove = true
+	if _, err := Apply(ctx, entry, change); !errors.Is(err, ErrNoKey) {
+		t.Errorf("expected ErrNoKey without a signing key, got %v", err)
+	}
+	if !services.RedisClient.SIsMember(ctx, change.Key, "10.0.0.1").Val() {
+		t.Errorf("expected the change not to be made when it can't be recorded")
+	}
+	if length := services.RedisClient.LLen(ctx, logKey).Val(); length != 1 {
+		t.Errorf("expected only the first change in the log, got %d entries", length)
+	}
+}
+
+// TestApplyCluster makes changes through a cluster client, which refuses transactions over keys in different slots
+func TestApplyCluster(t *testing.T) {
+	ctx := context.Background()
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{services.RedisClient.(*redis.Client).Options().Addr}})
+	defer cluster.Close()
+	if err := cluster.ClusterSlots(ctx).Err(); err != nil {
+		t.Skipf("redis is not a cluster: %v", err)
+	}
+
+	defer func(client redis.UniversalClient, prefix string) {
+		services.RedisClient, services.RedisKeyPrefix = client, prefix
+	}(services.RedisClient, services.RedisKeyPrefix)
+	services.RedisClient, services.RedisKeyPrefix = cluster, "cluster-test"
+
+	// A cluster has only database 0, so clean up rather than flush
+	keys := []string{logKey, ConfigKey("denylist:ips"), ConfigKey("denylist:cidrs"), ConfigKey("identifierReputation:denylist")}
+	for i, key := range keys {
+		keys[i] = services.RedisKey(key)
+	}
+	cluster.Del(ctx, keys...)
+	defer cluster.Del(ctx, keys...)
+
+	r := httptest.NewRequest("PUT", "/configuration/rules/denylist", nil)
+	entry, err := NewEntry(r, "denylist.add", "list entry", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating entry: %v", err)
+	}
+	for _, key := range []string{"denylist:ips", "denylist:cidrs", "identifierReputation:denylist"} {
+		if _, err := Apply(ctx, entry, SetChange{Key: ConfigKey(key), Member: "member"}); err != nil {
+			t.Errorf("unexpected error applying a change to %s on a cluster: %v", key, err)
+		}
+	}
+	if _, err := Apply(ctx, entry, SetChange{Key: "denylist:ips", Member: "member"}); err == nil {
+		t.Errorf("expected a change to a key outside the log's hash tag to be rejected")
+	}
+	if length := cluster.LLen(ctx, services.RedisKey(logKey)).Val(); length != 3 {
+		t.Errorf("expected the 3 changes in the log, got %d entries", length)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"syscall"
 	"time"
 
+	"rba/assessments"
+	"rba/audit"
 	"rba/internal/server"
 	"rba/rules"
 
@@ -79,12 +81,33 @@ func main() {
 		panic(err)
 	}
 
+	// Optionally compare a second ruleset with the primary one for every event
+	var challenger *rules.Challenger
+	if challengerPath := os.Getenv("CHALLENGER_RULES"); challengerPath != "" {
+		challenger, err = rules.LoadChallengerConfig(challengerPath, serviceConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err := audit.SigningKey(); err != nil {
+		log.Printf("changes through the configuration API will be refused: %v", err)
+	}
+
+	store, err := assessments.Open(serviceConfig.Assessments, serviceConfig.Redis.Enabled)
+	if err != nil {
+		panic(err)
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
 	authKeys, err := loadSecrets()
 	if err != nil {
 		log.Fatalf("failed to load secrets")
 	}
 
-	server := server.NewServer(handlers, serviceConfig, authKeys)
+	server := server.NewServer(handlers, serviceConfig, authKeys, challenger, store, rules.TenantRulesets())
 
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"rba/audit"
+	"rba/rules"
+	"rba/services"
+)
+
+// Entries read from redis per round trip
+const auditPageSize = 1000
+
+func auditUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: rba audit verify [flags] [audit.jsonl]")
+}
+
+// runAudit dispatches the audit subcommands
+func runAudit(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" {
+		auditUsage(stderr)
+		return 2
+	}
+	return runAuditVerify(args[1:], stdout, stderr)
+}
+
+// runAuditVerify checks the signed hash chain of the audit log, read from redis or from a file of JSON lines such as
+// the entries returned by GET /audit. The signing key is read from the environment, as it is by the server.
+func runAuditVerify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	redisHost := flags.String("redis", "", "redis server holding the audit log, when no file is given. Defaults to localhost:6379")
+	keyPrefix := flags.String("key-prefix", "", "services.redis.keyPrefix of the server that wrote the audit log")
+	rulesPath := flags.String("rules", "", "the server's rules file, whose services.redis settings and keyPrefix are used to reach the audit log. Used instead of -redis and -key-prefix")
+	head := flags.String("head", "", "a head hash printed by an earlier verify, checks the log still contains it")
+	allowEmpty := flags.Bool("allow-empty", false, "succeed on a log without entries, which otherwise fails as it is what a wiped log looks like")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		auditUsage(stderr)
+		flags.PrintDefaults()
+		return 2
+	}
+	if *rulesPath != "" && *keyPrefix != "" {
+		fmt.Fprintln(stderr, "pass either -key-prefix or a rules file to read services.redis.keyPrefix from, not both")
+		return 2
+	}
+	redisConfig, err := redisFlags(*redisHost, *rulesPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if redisConfig.Host == "" && len(redisConfig.Addrs) == 0 {
+		redisConfig.Host = "localhost:6379"
+	}
+	if *rulesPath == "" {
+		redisConfig.KeyPrefix = *keyPrefix
+	}
+	services.RedisKeyPrefix = redisConfig.KeyPrefix
+
+	key, err := audit.SigningKey()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	chain := audit.Chain{Key: key}
+	headFound := *head == ""
+	add := func(entry audit.Entry) error {
+		if err := chain.Add(entry); err != nil {
+			return err
+		}
+		headFound = headFound || entry.Hash == *head
+		return nil
+	}
+
+	if flags.NArg() == 1 {
+		err = verifyAuditFile(flags.Arg(0), add)
+	} else {
+		err = verifyAuditRedis(redisConfig, add)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "verification failed after %d entries: %v\n", chain.Length, err)
+		return 1
+	}
+	if err := chain.Verified(*allowEmpty); err != nil {
+		fmt.Fprintf(stderr, "verification failed: %v, pass -allow-empty if it has never been written to\n", err)
+		return 1
+	}
+	if !headFound {
+		fmt.Fprintf(stderr, "verification failed: the log no longer contains head %s, it may have been truncated or rewritten\n", *head)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "verified %d entries, head %s\n", chain.Length, chain.Head)
+	return 0
+}
+
+func verifyAuditFile(path string, add func(audit.Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry audit.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := add(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func verifyAuditRedis(config rules.RedisConfig, add func(audit.Entry) error) error {
+	options, err := config.Options()
+	if err != nil {
+		return err
+	}
+	if _, err := services.ConnectRedis(options); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var after int64
+	for {
+		entries, err := audit.List(ctx, after, auditPageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := add(entry); err != nil {
+				return err
+			}
+		}
+		if len(entries) < auditPageSize {
+			return nil
+		}
+		after += int64(len(entries))
+	}
+}
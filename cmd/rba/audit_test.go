@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rba/audit"
+	"rba/services"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Key the tests sign audit entries with
+const testAuditKey = "0123456789abcdef0123456789abcdef"
+
+// chainEntries returns a chained log of count entries, letting edit change an entry after it is linked
+func chainEntries(count int, edit func(i int, entry *audit.Entry)) []audit.Entry {
+	var entries []audit.Entry
+	var head audit.Entry
+	for i := 0; i < count; i++ {
+		entry := audit.Link(audit.Entry{
+			Time:   time.Date(2024, 5, 1, 10, i, 0, 0, time.UTC),
+			KeyID:  "client-1",
+			Action: "denylist.add",
+			Target: "ip 1.2.3.4",
+			Before: json.RawMessage(`{"listed":false}`),
+			After:  json.RawMessage(`{"listed":true}`),
+		}, head, []byte(testAuditKey))
+		head = entry
+		if edit != nil {
+			edit(i, &entry)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// writeAuditLog writes a chained log of count entries as JSON lines, letting edit change an entry after it is linked
+func writeAuditLog(t *testing.T, count int, edit func(i int, entry *audit.Entry)) string {
+	var lines []string
+	for _, entry := range chainEntries(count, edit) {
+		data, _ := json.Marshal(entry)
+		lines = append(lines, string(data))
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write audit log: %v", err)
+	}
+	return path
+}
+
+func TestAuditVerify(t *testing.T) {
+	t.Setenv(audit.KeyEnv, testAuditKey)
+	path := writeAuditLog(t, 3, nil)
+
+	var stdout, stderr bytes.Buffer
+	if code := runAudit([]string{"verify", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "verified 3 entries, head ") {
+		t.Errorf("expected 3 entries to be verified, got %q", stdout.String())
+	}
+
+	head := strings.TrimSpace(strings.TrimPrefix(stdout.String(), "verified 3 entries, head "))
+	stdout.Reset()
+	if code := runAudit([]string{"verify", "-head", head, path}, &stdout, &stderr); code != 0 {
+		t.Errorf("expected the log to still contain its head, got exit code %d: %s", code, stderr.String())
+	}
+
+	truncated := writeAuditLog(t, 2, nil)
+	if code := runAudit([]string{"verify", "-head", head, truncated}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected a truncated log to fail against the earlier head, got exit code %d", code)
+	}
+}
+
+func TestAuditVerifyTampered(t *testing.T) {
+	t.Setenv(audit.KeyEnv, testAuditKey)
+	path := writeAuditLog(t, 3, func(i int, entry *audit.Entry) {
+		if i == 1 {
+			entry.After = json.RawMessage(`{"listed":false}`)
+		}
+	})
+
+	var stdout, stderr bytes.Buffer
+	if code := runAudit([]string{"verify", path}, &stdout, &stderr); code != 1 {
+		t.Fatalf("expected exit code 1 for a tampered log, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "audit entry 2: hash does not match") {
+		t.Errorf("expected entry 2 to be reported, got %q", stderr.String())
+	}
+}
+
+func TestAuditVerifyRulesFile(t *testing.T) {
+	t.Setenv(audit.KeyEnv, testAuditKey)
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	// The log is written under the key prefix and database set in the server's rules file, on a database no other
+	// package's tests use
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 4})
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Del(ctx, "staging:{config}:audit:log").Err(); err != nil {
+		t.Fatalf("failed to clear the audit log: %v", err)
+	}
+	for _, entry := range chainEntries(2, nil) {
+		data, _ := json.Marshal(entry)
+		if err := client.RPush(ctx, "staging:{config}:audit:log", data).Err(); err != nil {
+			t.Fatalf("failed to write the audit log: %v", err)
+		}
+	}
+	defer func() { services.RedisKeyPrefix = "" }()
+
+	rulesPath := writeRules(t, `rules: []
+services:
+  redis:
+    host: `+addr+`
+    db: 4
+    keyPrefix: staging
+    enabled: true
+`)
+
+	var stdout, stderr bytes.Buffer
+	if code := runAudit([]string{"verify", "-rules", rulesPath, "-redis", addr}, &stdout, &stderr); code != 2 {
+		t.Errorf("expected -redis and -rules together to be a usage error, got exit code %d", code)
+	}
+	if code := runAudit([]string{"verify", "-rules", rulesPath}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "verified 2 entries, head ") {
+		t.Errorf("expected the log to be read with the rules file's redis settings, got %q", stdout.String())
+	}
+}
+
+func TestAuditVerifyEmptyAndKey(t *testing.T) {
+	t.Setenv(audit.KeyEnv, testAuditKey)
+	empty := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatalf("failed to write audit log: %v", err)
+	}
+
+	// An empty log is what a wiped one looks like, so it only passes when asked to
+	var stdout, stderr bytes.Buffer
+	if code := runAudit([]string{"verify", empty}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected an empty log to fail, got exit code %d", code)
+	}
+	if code := runAudit([]string{"verify", "-allow-empty", empty}, &stdout, &stderr); code != 0 {
+		t.Errorf("expected an empty log to pass with -allow-empty, got exit code %d: %s", code, stderr.String())
+	}
+
+	// Entries signed with another key don't verify
+	path := writeAuditLog(t, 2, nil)
+	t.Setenv(audit.KeyEnv, "fedcba9876543210fedcba9876543210")
+	if code := runAudit([]string{"verify", path}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected a log signed with another key to fail, got exit code %d", code)
+	}
+
+	t.Setenv(audit.KeyEnv, "")
+	stderr.Reset()
+	if code := runAudit([]string{"verify", path}, &stdout, &stderr); code != 2 || !strings.Contains(stderr.String(), audit.KeyEnv) {
+		t.Errorf("expected a missing key to be reported, got exit code %d: %s", code, stderr.String())
+	}
+}
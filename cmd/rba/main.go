@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"rba/rules"
+)
+
+// commands maps each subcommand to its runner. Runners take the arguments after the subcommand and return the exit code.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"validate": runValidate,
+	"replay":   runReplay,
+	"audit":    runAudit,
+}
+
+// redisFlags reads the redis server to connect to from the command line: the services.redis block of a rules file,
+// for servers that need credentials, TLS, sentinel or cluster, or else a single server at host
+func redisFlags(host string, rulesPath string) (rules.RedisConfig, error) {
+	if rulesPath == "" {
+		return rules.RedisConfig{Host: host}, nil
+	}
+	if host != "" {
+		return rules.RedisConfig{}, errors.New("pass either a redis host or a rules file to read services.redis from, not both")
+	}
+	servicesConfig, err := rules.ReadServicesConfig(rulesPath)
+	if err != nil {
+		return rules.RedisConfig{}, fmt.Errorf("%s: %w", rulesPath, err)
+	}
+	if servicesConfig.Redis.Host == "" && len(servicesConfig.Redis.Addrs) == 0 {
+		return rules.RedisConfig{}, fmt.Errorf("%s: services.redis has no host or addrs", rulesPath)
+	}
+	return servicesConfig.Redis, nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: rba <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	fmt.Fprintln(w, "  validate [rules.yaml]    check a rules file and print the rules that run on each event")
+	fmt.Fprintln(w, "  replay events.jsonl      score historical events with a rules file, see rba replay -h")
+	fmt.Fprintln(w, "  audit verify             check the audit log's hash chain, see rba audit verify -h")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	os.Exit(run(os.Args[2:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"rba/rules"
+	"rba/services"
+	"rba/util"
+)
+
+// replayEvent is one line of the input file, an /event request body with the time it originally happened
+type replayEvent struct {
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp *time.Time             `json:"timestamp,omitempty"`
+}
+
+// replayResult is written for each event replayed
+type replayResult struct {
+	Line          int               `json:"line"`
+	Event         string            `json:"event"`
+	Timestamp     *time.Time        `json:"timestamp,omitempty"`
+	Risk          float64           `json:"risk"`
+	Decision      string            `json:"decision"`
+	RuleResults   []util.RiskResult `json:"ruleResults"`
+	ShadowResults []util.RiskResult `json:"shadowResults,omitempty"`
+	Degraded      bool              `json:"degraded,omitempty"`
+}
+
+// replayClock follows the latest timestamp replayed, so windows and lateness behave as they did when the events happened
+type replayClock struct {
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time {
+	return c.now
+}
+
+func (c *replayClock) advance(t time.Time) {
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// firstTimestamp returns the timestamp of the first event in a replay file that has one, so events before it without a
+// timestamp are replayed at the time the file starts rather than now. Lines that don't parse are left for the replay to
+// report.
+func firstTimestamp(reader io.Reader) (time.Time, bool) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event struct {
+			Timestamp *time.Time `json:"timestamp"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && event.Timestamp != nil {
+			return *event.Timestamp, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// replayStats accumulates the summary printed at the end of a replay
+type replayStats struct {
+	events     int
+	alerts     int
+	late       int
+	challenges int
+	degraded   int
+	riskTotal  float64
+	perEvent   map[string][2]int
+	ruleHits   map[string]int
+	ruleErrs   map[string]int
+}
+
+func (s *replayStats) add(result replayResult) {
+	s.events++
+	s.riskTotal += result.Risk
+	counts := s.perEvent[result.Event]
+	counts[0]++
+	switch result.Decision {
+	case util.Decisions.Alert:
+		s.alerts++
+		counts[1]++
+	case util.Decisions.Late:
+		s.late++
+	case util.Decisions.Challenge:
+		s.challenges++
+	}
+	if result.Degraded {
+		s.degraded++
+	}
+	s.perEvent[result.Event] = counts
+
+	s.addRuleResults(result.RuleResults, "")
+	s.addRuleResults(result.ShadowResults, " (shadow)")
+}
+
+// addRuleResults counts hits and errors per rule, suffix distinguishes shadow rules from enforced rules of the same name
+func (s *replayStats) addRuleResults(results []util.RiskResult, suffix string) {
+	for _, ruleResult := range results {
+		if ruleResult.Err != nil {
+			s.ruleErrs[ruleResult.Name+suffix]++
+		} else if ruleResult.Score > 0 {
+			s.ruleHits[ruleResult.Name+suffix]++
+		}
+	}
+}
+
+func (s *replayStats) print(w io.Writer, threshold float64) {
+	if s.events == 0 {
+		fmt.Fprintln(w, "no events replayed")
+		return
+	}
+
+	fmt.Fprintf(w, "events: %d, alerts above %v: %d (%.1f%%), late: %d, challenges: %d, degraded: %d, mean risk: %.3f\n",
+		s.events, threshold, s.alerts, 100*float64(s.alerts)/float64(s.events), s.late, s.challenges, s.degraded, s.riskTotal/float64(s.events))
+
+	fmt.Fprintln(w, "by event:")
+	for _, event := range util.AllEvents {
+		if counts, ok := s.perEvent[event]; ok {
+			fmt.Fprintf(w, "  %-24s %d events, %d alerts\n", event, counts[0], counts[1])
+		}
+	}
+
+	names := make([]string, 0, len(s.ruleHits)+len(s.ruleErrs))
+	for name := range s.ruleHits {
+		names = append(names, name)
+	}
+	for name := range s.ruleErrs {
+		if _, ok := s.ruleHits[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "by rule:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-24s %d hits, %d errors\n", name, s.ruleHits[name], s.ruleErrs[name])
+	}
+}
+
+// runReplay evaluates a JSONL file of events through the rules in a rules file, writing a result line per event to
+// stdout and summary stats to stderr. NATS is never published to, and rules keep state in memory or a scratch redis server.
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rulesPath := flags.String("rules", "./rules.yaml", "rules file to evaluate events with")
+	redisHost := flags.String("redis", "", "scratch redis server for rules that keep state, never the production one. Defaults to keeping state in memory")
+	redisRules := flags.String("redis-rules", "", "a rules file whose services.redis settings reach the scratch redis, for one that needs credentials or TLS. Used instead of -redis")
+	flush := flags.Bool("flush", false, "delete all keys in the scratch redis database before replaying")
+	threshold := flags.Float64("threshold", 0, "risk above which an event is an alert, defaults to services.nats.threshold")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: rba replay [flags] events.jsonl")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	scratch, err := redisFlags(*redisHost, *redisRules)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	handlers, servicesConfig, err := rules.LoadReplayConfig(*rulesPath, scratch)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *rulesPath, err)
+		return 1
+	}
+
+	thresholdSet := false
+	flags.Visit(func(f *flag.Flag) { thresholdSet = thresholdSet || f.Name == "threshold" })
+	if !thresholdSet {
+		*threshold = servicesConfig.Nats.Threshold
+	}
+
+	ctx := context.Background()
+	if *flush && servicesConfig.Redis.Enabled {
+		if err := services.State.Flush(ctx); err != nil {
+			fmt.Fprintf(stderr, "failed to flush redis: %v\n", err)
+			return 1
+		}
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	var clock replayClock
+	if start, ok := firstTimestamp(file); ok {
+		clock.advance(start)
+	} else {
+		clock.advance(time.Now())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	stats := replayStats{perEvent: map[string][2]int{}, ruleHits: map[string]int{}, ruleErrs: map[string]int{}}
+	encoder := json.NewEncoder(stdout)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event replayEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			fmt.Fprintf(stderr, "%s: line %d: %v\n", flags.Arg(0), line, err)
+			return 1
+		}
+		if !util.IsValidEvent(event.Event) {
+			fmt.Fprintf(stderr, "%s: line %d: invalid event type %q\n", flags.Arg(0), line, event.Event)
+			return 1
+		}
+
+		// Events without a timestamp happen at the latest time replayed, or when the file starts if there is none yet
+		if event.Timestamp != nil {
+			clock.advance(*event.Timestamp)
+		}
+
+		result := replayResult{Line: line, Event: event.Event, Timestamp: event.Timestamp, Decision: util.Decisions.Pass, RuleResults: []util.RiskResult{}}
+		eventTime, err := util.ResolveEventTime(event.Timestamp, clock.Now(), rules.AllowedLateness())
+		if err != nil {
+			result.Decision = util.Decisions.Late
+		} else {
+			result.Timestamp = &eventTime
+			if eventHandlers := handlers[event.Event]; len(eventHandlers) > 0 {
+				assessment := rules.Assess(util.WithEventTime(ctx, eventTime), eventHandlers, event.Event, event.Data)
+				result.Risk, result.RuleResults, result.ShadowResults = assessment.Risk, assessment.RuleResults, assessment.ShadowResults
+				result.Degraded = assessment.Degraded
+				result.Decision = assessment.Decide(*threshold)
+			} else {
+				result.Decision = util.Decide(result.Risk, *threshold)
+			}
+		}
+
+		stats.add(result)
+		if err := encoder.Encode(result); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	stats.print(stderr, *threshold)
+	return 0
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rba/util"
+)
+
+func TestReplay(t *testing.T) {
+	rulesPath := writeRules(t, `rules:
+  - name: expression
+    id: nonCanadian
+    expression: country != "CA"
+    score: 0.8
+    events: [login]
+    strategy: average
+services:
+  nats:
+    threshold: 0.5
+`)
+	eventsPath := filepath.Join(t.TempDir(), "events.jsonl")
+	events := `{"event": "login", "timestamp": "2024-05-01T10:00:00Z", "data": {"country": "CA"}}
+{"event": "login", "timestamp": "2024-05-01T10:00:05Z", "data": {"country": "US"}}
+
+{"event": "registration", "timestamp": "2024-05-01T10:00:09Z", "data": {"country": "US"}}
+{"event": "login", "timestamp": "2024-05-01T11:00:00Z", "data": {"country": "CA"}}
+{"event": "login", "timestamp": "2024-05-01T10:00:10Z", "data": {"country": "US"}}
+`
+	if err := os.WriteFile(eventsPath, []byte(events), 0o600); err != nil {
+		t.Fatalf("failed to write events: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runReplay([]string{"-rules", rulesPath, eventsPath}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	var results []replayResult
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		var result replayResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode result: %v", err)
+		}
+		results = append(results, result)
+	}
+
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	expected := []struct {
+		line     int
+		risk     float64
+		decision string
+	}{
+		{1, 0, util.Decisions.Pass},
+		{2, 0.8, util.Decisions.Alert},
+		{4, 0, util.Decisions.Pass},
+		{5, 0, util.Decisions.Pass},
+		// An hour behind the latest event is past the default allowed lateness
+		{6, 0, util.Decisions.Late},
+	}
+	for i, want := range expected {
+		if results[i].Line != want.line || results[i].Risk != want.risk || results[i].Decision != want.decision {
+			t.Errorf("expected line %d risk %v %s, got line %d risk %v %s",
+				want.line, want.risk, want.decision, results[i].Line, results[i].Risk, results[i].Decision)
+		}
+	}
+	if !strings.Contains(stderr.String(), "events: 5, alerts above 0.5: 1 (20.0%), late: 1") || !strings.Contains(stderr.String(), "nonCanadian") {
+		t.Errorf("expected summary with 1 alert and nonCanadian hits, got:\n%s", stderr.String())
+	}
+}
+
+func TestReplayKeepsStateInMemory(t *testing.T) {
+	rulesPath := writeRules(t, `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 1
+    strategy: average
+services:
+  redis:
+    host: production:6379
+    enabled: true
+  nats:
+    threshold: 0.5
+`)
+	eventsPath := filepath.Join(t.TempDir(), "events.jsonl")
+	events := `{"event": "login", "timestamp": "2024-05-01T10:00:00Z", "data": {"ip": "1.2.3.4"}}
+{"event": "login", "timestamp": "2024-05-01T10:00:10Z", "data": {"ip": "1.2.3.4"}}
+`
+	if err := os.WriteFile(eventsPath, []byte(events), 0o600); err != nil {
+		t.Fatalf("failed to write events: %v", err)
+	}
+
+	// The production redis in the rules file is never connected to without -redis
+	var stdout, stderr bytes.Buffer
+	if code := runReplay([]string{"-rules", rulesPath, eventsPath}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	var last replayResult
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if last.Decision != util.Decisions.Alert {
+		t.Errorf("expected the second login to exceed the velocity limit, got %+v", last)
+	}
+}
+
+func TestReplayStartsAtFirstTimestamp(t *testing.T) {
+	rulesPath := writeRules(t, `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 1
+    strategy: average
+services:
+  nats:
+    threshold: 0.5
+`)
+	eventsPath := filepath.Join(t.TempDir(), "events.jsonl")
+	events := `{"event": "login", "data": {"ip": "1.2.3.4"}}
+{"event": "login", "timestamp": "2024-05-01T10:00:10Z", "data": {"ip": "1.2.3.4"}}
+`
+	if err := os.WriteFile(eventsPath, []byte(events), 0o600); err != nil {
+		t.Fatalf("failed to write events: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runReplay([]string{"-rules", rulesPath, eventsPath}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	// The first login is replayed at the file's first timestamp rather than now, so the second isn't late and is
+	// counted in the same window
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	var first, last replayResult
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if first.Timestamp == nil || !first.Timestamp.Equal(time.Date(2024, 5, 1, 10, 0, 10, 0, time.UTC)) {
+		t.Errorf("expected the first login at the file's first timestamp, got %v", first.Timestamp)
+	}
+	if last.Decision != util.Decisions.Alert {
+		t.Errorf("expected the second login to exceed the velocity limit, got %+v", last)
+	}
+}
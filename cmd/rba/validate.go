@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"rba/rules"
+	"rba/util"
+)
+
+// runValidate parses and builds a rules file without connecting to redis or nats, then prints the rules and
+// strategies that run on each event
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := "./rules.yaml"
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+
+	handlers, _, err := rules.ValidateConfig(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	printHandlers(stdout, handlers, "")
+
+	rulesets := rules.TenantRulesets()
+	names := slices.Sorted(maps.Keys(rulesets))
+	for _, name := range names {
+		ruleset := rulesets[name]
+		fmt.Fprintf(stdout, "tenant %s, alerting above %v on %s", name, ruleset.Threshold, ruleset.Subject)
+		if ruleset.Challenge != nil {
+			fmt.Fprintf(stdout, ", challenging above %v", *ruleset.Challenge)
+		}
+		fmt.Fprintln(stdout)
+		printHandlers(stdout, ruleset.Handlers, "  ")
+	}
+	fmt.Fprintf(stdout, "%s is valid\n", path)
+	return 0
+}
+
+// printHandlers lists the rules and strategies that run on each event
+func printHandlers(stdout io.Writer, handlers map[string][]util.NamedRiskHandler, indent string) {
+	for _, event := range util.AllEvents {
+		fmt.Fprintln(stdout, indent+event)
+		if len(handlers[event]) == 0 {
+			fmt.Fprintln(stdout, indent+"  (no rules)")
+			continue
+		}
+		for _, handler := range handlers[event] {
+			if handler.Shadow {
+				fmt.Fprintf(stdout, "%s  %-24s %s (%s)\n", indent, handler.Name, handler.Strategy, util.Modes.Shadow)
+				continue
+			}
+			fmt.Fprintf(stdout, "%s  %-24s %s\n", indent, handler.Name, handler.Strategy)
+		}
+	}
+}
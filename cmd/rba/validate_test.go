@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRules(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	// The redis host is never connected to, validation runs offline
+	path := writeRules(t, `rules:
+  - name: velocity
+    intervalSeconds: 5m
+    limit: 10
+    strategy: average
+services:
+  redis:
+    host: unreachable:6379
+    enabled: true
+`)
+
+	var stdout, stderr bytes.Buffer
+	if code := runValidate([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "login\n  velocity") {
+		t.Errorf("expected summary to list velocity under login, got:\n%s", stdout.String())
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	path := writeRules(t, `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 10
+    strategy: average
+services:
+  state:
+    backend: memory
+tenancy:
+  isolate: true
+  tenants:
+    - name: portal
+      keyIds: [portal-web]
+      rules:
+        - name: velocity
+          intervalSeconds: 60
+          limit: 3
+          strategy: override
+      nats:
+        threshold: 0.7
+`)
+
+	var stdout, stderr bytes.Buffer
+	if code := runValidate([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "tenant portal, alerting above 0.7 on alerts\n  login\n    velocity                 override") {
+		t.Errorf("expected summary to list portal's ruleset, got:\n%s", stdout.String())
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  string
+		expect string
+	}{
+		{
+			name: "invalid setting",
+			rules: `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: ten
+    strategy: average
+services:
+  redis:
+    host: localhost:6379
+    enabled: true
+`,
+			expect: "line 4: velocity: limit",
+		},
+		{
+			name: "no state store",
+			rules: `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 10
+    strategy: average
+`,
+			expect: "line 2: velocity: rule keeps state between events",
+		},
+		{
+			name: "conflicting redis modes",
+			rules: `services:
+  redis:
+    addrs: [sentinel-1:26379, sentinel-2:26379]
+    sentinel:
+      masterName: rba
+    cluster: true
+    enabled: true
+`,
+			expect: "sentinel and cluster can't be used together",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runValidate([]string{writeRules(t, tt.rules)}, &stdout, &stderr); code != 1 {
+				t.Errorf("expected exit code 1, got %d", code)
+			}
+			if !strings.Contains(stderr.String(), tt.expect) {
+				t.Errorf("expected error containing %q, got %s", tt.expect, stderr.String())
+			}
+		})
+	}
+}
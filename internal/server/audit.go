@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"rba/audit"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type AuditResponse struct {
+	Entries []audit.Entry `json:"entries"`
+	// Pass as after to get the following page, left out on the last page
+	Next *int64 `json:"next,omitempty"`
+}
+
+// AuditHandler lists the audit log oldest first, starting after the sequence number in after
+func (s *Server) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	after, limit := int64(0), defaultAuditLimit
+	if value := r.URL.Query().Get("after"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		after = parsed
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAuditLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	entries, err := audit.List(ctx, after, limit)
+	if errors.Is(err, audit.ErrUnavailable) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	response := AuditResponse{Entries: entries}
+	if len(entries) == limit {
+		next := entries[len(entries)-1].Seq
+		response.Next = &next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
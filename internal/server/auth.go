@@ -6,6 +6,8 @@ import (
 	"encoding/hex"
 	"net/http"
 	"os"
+	"rba/rules"
+	"rba/util"
 	"strconv"
 	"time"
 )
@@ -66,7 +68,23 @@ func AuthMiddleware(secrets map[string][]byte) func(http.Handler) http.Handler {
 				http.Error(w, "forbidden", http.StatusForbidden)
 				return
 			}
-			next.ServeHTTP(w, r)
+			ctx := util.WithKeyID(r.Context(), keyID)
+			if tenant := rules.TenantOf(keyID); tenant != "" {
+				ctx = util.WithTenant(ctx, tenant)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// NoTenantMiddleware refuses callers that belong to a tenant, for routes over state every tenant shares. When tenants
+// are isolated only the admin keys in tenancy.adminKeyIds can use them.
+func NoTenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if util.TenantFromContext(r.Context()) != "" {
+			http.Error(w, "forbidden, this is shared by every tenant and needs an admin key", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ChallengerHandler reports how often the challenger ruleset disagreed with the primary ruleset
+func (s *Server) ChallengerHandler(w http.ResponseWriter, r *http.Request) {
+	if s.challenger == nil {
+		http.Error(w, "No challenger ruleset configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.challenger.Report())
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"rba/util"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type EntityProfileResponse struct {
+	Type  string                            `json:"type"`
+	ID    string                            `json:"id"`
+	Rules map[string]map[string]interface{} `json:"rules"`
+}
+
+// EntityHandler reports everything the configured rules currently hold about an IP, account or device
+func (s *Server) EntityHandler(w http.ResponseWriter, r *http.Request) {
+	entityType := chi.URLParam(r, "type")
+	if !util.IsValidEntity(entityType) {
+		http.Error(w, "Invalid entity type", http.StatusBadRequest)
+		return
+	}
+
+	id, err := url.PathUnescape(chi.URLParam(r, "id"))
+	if err != nil || id == "" {
+		http.Error(w, "invalid encoding", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	response := EntityProfileResponse{
+		Type:  entityType,
+		ID:    id,
+		Rules: map[string]map[string]interface{}{},
+	}
+
+	// Rules are registered once per event they run on, so only inspect each one once
+	ruleset, _ := s.ruleset(util.TenantFromContext(r.Context()))
+	for _, riskHandlers := range ruleset.Handlers {
+		for _, namedHandler := range riskHandlers {
+			if namedHandler.Introspect == nil {
+				continue
+			}
+			// Shadow rules keep their own state, so a shadow copy of an enforced rule is reported apart from it
+			name := namedHandler.Name
+			if namedHandler.Shadow {
+				name = util.ShadowName(name)
+			}
+			if _, seen := response.Rules[name]; seen {
+				continue
+			}
+
+			profile, err := namedHandler.Introspect(ctx, entityType, id)
+			if err != nil {
+				log.Printf("failed to inspect %s for %s %s: %v", namedHandler.Name, entityType, id, err)
+				http.Error(w, "failed to read entity state", http.StatusInternalServerError)
+				return
+			}
+			if profile != nil {
+				response.Rules[name] = profile
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+}
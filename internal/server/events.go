@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rba/assessments"
+	"rba/util"
+	"strconv"
+	"time"
+)
+
+// parseEventsQuery reads the filters and page of a GET /events request
+func parseEventsQuery(r *http.Request) (assessments.Query, error) {
+	params := r.URL.Query()
+	query := assessments.Query{
+		Tenant:   util.TenantFromContext(r.Context()),
+		Account:  params.Get("account"),
+		IP:       params.Get("ip"),
+		Decision: params.Get("decision"),
+		Rule:     params.Get("rule"),
+		Cursor:   params.Get("cursor"),
+	}
+
+	for name, bound := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, fmt.Errorf("%s must be an RFC 3339 time", name)
+		}
+		*bound = parsed
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > assessments.MaxQueryLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", assessments.MaxQueryLimit)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+// EventsHandler lists stored assessments newest first, filtered by account, ip, decision, rule and time range.
+// Pass nextCursor from a response as cursor to get the following page.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseEventsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.store == nil {
+		writeAssessmentError(w, assessments.ErrUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	page, err := s.store.Query(ctx, query)
+	if errors.Is(err, assessments.ErrBadCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeAssessmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
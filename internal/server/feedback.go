@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"rba/assessments"
+	"rba/util"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type FeedbackRequest struct {
+	Label   string `json:"label"`
+	Comment string `json:"comment"`
+}
+
+// writeAssessmentError maps errors from the assessment store to a response
+func writeAssessmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, assessments.ErrNotFound):
+		http.Error(w, "Event not found", http.StatusNotFound)
+	case errors.Is(err, assessments.ErrUnavailable):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Print(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// EventRecordHandler returns a stored assessment by the ID /event returned for it
+func (s *Server) EventRecordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	if s.store == nil {
+		writeAssessmentError(w, assessments.ErrUnavailable)
+		return
+	}
+
+	record, err := s.store.Get(ctx, util.TenantFromContext(r.Context()), chi.URLParam(r, "id"))
+	if err != nil {
+		writeAssessmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// FeedbackHandler labels an assessed event as confirmed fraud, a false positive or legitimate
+func (s *Server) FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !util.IsValidLabel(req.Label) {
+		http.Error(w, "Invalid label, must be one of confirmed_fraud, false_positive or legitimate", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	record, err := assessments.SetFeedback(ctx, s.store, util.TenantFromContext(r.Context()), chi.URLParam(r, "id"), assessments.Feedback{
+		Label:   req.Label,
+		Comment: req.Comment,
+		KeyID:   util.KeyIDFromContext(r.Context()),
+		At:      s.clock.Now(),
+	})
+	if err != nil {
+		writeAssessmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// FeedbackReportHandler reports the precision and recall of the decision and each rule over labelled events
+func (s *Server) FeedbackReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	report, err := assessments.BuildReport(ctx, s.store, util.TenantFromContext(r.Context()))
+	if err != nil {
+		writeAssessmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"rba/services"
+)
+
+// HealthHandler reports ok, or degraded while the redis circuit breaker isn't closed. Events are still assessed while
+// it is open, with the error policies of the rules that need redis, so the status stays 200.
+func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if s.breaker != nil {
+		if state := s.breaker.Stats().State; state != services.BreakerClosed {
+			fmt.Fprintf(w, "degraded: redis circuit breaker %s", state)
+			return
+		}
+	}
+	w.Write([]byte("ok"))
+}
+
+// redisBreaker returns the breaker set up when the rules were loaded, for NewServer whose services parameter hides the
+// package
+func redisBreaker() *services.Breaker {
+	return services.RedisBreaker
+}
+
+// breakerStates are the values of the rba_redis_breaker_state gauge
+var breakerStates = map[string]int{
+	services.BreakerClosed:   0,
+	services.BreakerHalfOpen: 1,
+	services.BreakerOpen:     2,
+}
+
+// MetricsHandler reports the redis circuit breaker in the Prometheus text format
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if s.breaker == nil {
+		return
+	}
+
+	stats := s.breaker.Stats()
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"rba_redis_breaker_state", "gauge", "State of the redis circuit breaker, 0 closed, 1 half-open, 2 open", int64(breakerStates[stats.State])},
+		{"rba_redis_breaker_consecutive_failures", "gauge", "Redis calls that failed or timed out in a row", int64(stats.ConsecutiveFailures)},
+		{"rba_redis_breaker_failures_total", "counter", "Redis calls that failed or timed out", stats.Failures},
+		{"rba_redis_breaker_rejected_total", "counter", "Redis calls short-circuited while the breaker was open", stats.Rejected},
+		{"rba_redis_breaker_trips_total", "counter", "Times the redis circuit breaker opened", stats.Trips},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
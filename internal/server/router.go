@@ -3,10 +3,12 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"log"
 	"net/http"
+	"rba/assessments"
 	"rba/internal/server/ruleRouter"
+	"rba/rules"
 	"rba/util"
-	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -26,17 +28,24 @@ func (s *Server) RegisterRoutes() http.Handler {
 		MaxAge:           300,
 	}))
 
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+	r.Get("/health", s.HealthHandler)
+	r.Get("/metrics", s.MetricsHandler)
 
 	// Group for routes requiring auth
 	r.Group(func(protected chi.Router) {
 		protected.Use(AuthMiddleware(s.authKeys))
 		protected.Post("/event", s.EventHandler)
-
-		protected.Mount("/configuration/rules/denylist", ruleRouter.DenyListRouter())
+		protected.Get("/entities/{type}/{id}", s.EntityHandler)
+		protected.Get("/events", s.EventsHandler)
+		protected.Get("/events/{id}", s.EventRecordHandler)
+		protected.Post("/events/{id}/feedback", s.FeedbackHandler)
+		protected.Get("/feedback/report", s.FeedbackReportHandler)
+		protected.With(NoTenantMiddleware).Get("/challenger", s.ChallengerHandler)
+		protected.With(NoTenantMiddleware).Get("/audit", s.AuditHandler)
+
+		// The lists managed through the configuration API are shared by every tenant
+		protected.With(NoTenantMiddleware).Mount("/configuration/rules/denylist", ruleRouter.DenyListRouter())
+		protected.With(NoTenantMiddleware).Mount("/configuration/rules/identifierReputation", ruleRouter.IdentifierReputationRouter())
 	})
 
 	return r
@@ -45,6 +54,8 @@ func (s *Server) RegisterRoutes() http.Handler {
 type EventRequest struct {
 	Event string                 `json:"event"`
 	Data  map[string]interface{} `json:"data"`
+	// Optional, when the event happened. Windowed rules count the event at this time rather than when it is received.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
 }
 
 func (s *Server) EventHandler(w http.ResponseWriter, r *http.Request) {
@@ -57,77 +68,77 @@ func (s *Server) EventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If event name is invalid send a 400 since we don't know which risk modules to run
-	validEvents := map[string]bool{
-		"login": true,
-		"login_failure": true,
+	if !util.IsValidEvent(req.Event) {
+		http.Error(w, "Invalid event type", http.StatusBadRequest)
+		return
 	}
 
-	if !validEvents[req.Event] {
-		http.Error(w, "Invalid event type", http.StatusBadRequest)
+	eventTime, err := util.ResolveEventTime(req.Timestamp, s.clock.Now(), rules.AllowedLateness())
+	if err != nil {
+		http.Error(w, "Event timestamp is older than the allowed lateness", http.StatusBadRequest)
 		return
 	}
 
-	riskHandlers, found := s.riskHandlers[req.Event]
+	tenant := util.TenantFromContext(r.Context())
+	ruleset, ownRuleset := s.ruleset(tenant)
+	riskHandlers, found := ruleset.Handlers[req.Event]
 	if !found || len(riskHandlers) == 0 {
 		http.Error(w, "No handlers for event", http.StatusNotFound)
 		return
 	}
 
-	riskAssessments := make(chan util.RiskResult, len(riskHandlers))
-	var wg sync.WaitGroup
-
-	for _, namedHandler := range riskHandlers {
-		wg.Add(1)
-		go func(h util.RiskHandlerFunc) {
-			defer wg.Done()
-
-			// Create a context with 100ms timeout
-			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-			defer cancel()
-
-			resultChan := make(chan util.RiskResult, 1)
-
-			// Need to run this in a routine so it does not block the context check for timeout
-			go func() {
-				resultChan <- namedHandler.Handler(ctx, req.Data)
-			}()
-
-			select {
-			case <-ctx.Done():
-				// If handler takes too long send back an error for the result
-				errText := "deadline exceeded"
-				riskAssessments <- util.RiskResult{
-					Name:     namedHandler.Name,
-					Score:    0,
-					Err:      &errText,
-					Strategy: namedHandler.Strategy,
-				}
-			case result := <-resultChan:
-				// Otherwise include the handler result
-				riskAssessments <- result
-			}
-		}(namedHandler.Handler)
+	type RiskResponse struct {
+		ID            string            `json:"id"`
+		Risk          float64           `json:"risk"`
+		Decision      string            `json:"decision"`
+		RuleResults   []util.RiskResult `json:"ruleResults"`
+		ShadowResults []util.RiskResult `json:"shadowResults,omitempty"`
+		// Set when a rule errored or timed out, so the risk was assessed without it
+		Degraded bool `json:"degraded,omitempty"`
 	}
 
-	go func() {
-		wg.Wait()
-		close(riskAssessments)
-	}()
+	// Not the request's context, the challenger carries on after the response is sent
+	ctx := util.WithEventTime(util.WithTenant(context.Background(), tenant), eventTime)
+	assessment := rules.Assess(ctx, riskHandlers, req.Event, req.Data)
 
-	type RiskResponse struct {
-		Risk        float64           `json:"risk"`
-		RuleResults []util.RiskResult `json:"ruleResults"`
+	// The challenger runs in the background so it never adds latency to the response, and is skipped when it is too
+	// busy to keep up. It is only compared with the primary ruleset.
+	if s.challenger != nil && !ownRuleset {
+		s.challenger.CompareAsync(ctx, req.Event, req.Data, assessment)
 	}
 
-	avg, results := util.CalculateRisk(riskAssessments)
+	if s.services.Nats.Enabled && assessment.Risk > ruleset.Threshold {
+		util.PublishMessage(ruleset.Subject, assessment.RuleResults)
+	}
 
-	if s.services.Nats.Enabled && avg > float64(s.services.Nats.Threshold) {
-		util.PublishMessage(results)
+	// Keep the assessment so it can be queried and given feedback later
+	record := assessments.Record{
+		ID:            assessments.NewID(),
+		Tenant:        tenant,
+		Event:         req.Event,
+		Timestamp:     eventTime,
+		Data:          req.Data,
+		Risk:          assessment.Risk,
+		Decision:      ruleset.Decide(assessment),
+		RuleResults:   assessment.RuleResults,
+		ShadowResults: assessment.ShadowResults,
+		Degraded:      assessment.Degraded,
+	}
+	if s.store != nil {
+		storeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if err := s.store.Save(storeCtx, record); err != nil {
+			log.Printf("failed to store assessment: %v", err)
+		}
 	}
 
 	response := RiskResponse{
-		Risk:        avg,
-		RuleResults: results,
+		ID:            record.ID,
+		Risk:          record.Risk,
+		Decision:      record.Decision,
+		RuleResults:   record.RuleResults,
+		ShadowResults: record.ShadowResults,
+		Degraded:      record.Degraded,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
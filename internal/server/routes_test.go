@@ -1,12 +1,25 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"rba/assessments"
+	"rba/internal/server/ruleRouter"
 	"rba/rules"
+	"rba/services"
+	"rba/state"
 	"rba/util"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func TestHandler(t *testing.T) {
@@ -32,3 +45,428 @@ func TestHandler(t *testing.T) {
 		t.Errorf("expected status OK; got %v", resp.Status)
 	}
 }
+
+func TestHealthAndMetricsBreaker(t *testing.T) {
+	breaker := services.NewBreaker(1, time.Minute)
+	newServer := &Server{riskHandlers: map[string][]util.NamedRiskHandler{}, breaker: breaker}
+	ts := httptest.NewServer(newServer.RegisterRoutes())
+	defer ts.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status OK for %s; got %v", path, resp.Status)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := get("/health"); body != "ok" {
+		t.Errorf("expected ok while the breaker is closed, got %q", body)
+	}
+
+	// Trip the breaker with a failing call
+	store := services.NewBreakerStore(failingStore{}, breaker)
+	store.Counter(context.Background(), "key")
+
+	if body := get("/health"); body != "degraded: redis circuit breaker open" {
+		t.Errorf("expected degraded while the breaker is open, got %q", body)
+	}
+	metrics := get("/metrics")
+	for _, line := range []string{"rba_redis_breaker_state 2", "rba_redis_breaker_trips_total 1", "# TYPE rba_redis_breaker_failures_total counter"} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("expected %q in metrics, got:\n%s", line, metrics)
+		}
+	}
+}
+
+// failingStore is a state store whose redis is down
+type failingStore struct {
+	state.Store
+}
+
+func (failingStore) Counter(ctx context.Context, key string) (int64, error) {
+	return 0, errors.New("dial tcp: connection refused")
+}
+
+func TestEntityHandler(t *testing.T) {
+	introspected := util.NamedRiskHandler{
+		Name: "stub",
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.IP {
+				return nil, nil
+			}
+			return map[string]interface{}{"requests": 3}, nil
+		},
+	}
+	newServer := &Server{
+		riskHandlers: map[string][]util.NamedRiskHandler{
+			util.Events.Login:        {introspected},
+			util.Events.LoginFailure: {introspected},
+		},
+	}
+
+	router := chi.NewRouter()
+	router.Get("/entities/{type}/{id}", newServer.EntityHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/entities/ip/1.2.3.4", ts.URL))
+	if err != nil {
+		t.Fatalf("error making request to server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+
+	var profile EntityProfileResponse
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if profile.Type != util.Entities.IP || profile.ID != "1.2.3.4" {
+		t.Errorf("expected profile for ip 1.2.3.4, got %s %s", profile.Type, profile.ID)
+	}
+	if requests := profile.Rules["stub"]["requests"]; requests != float64(3) {
+		t.Errorf("expected 3 requests from the stub rule, got %v", requests)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/entities/session/abc", ts.URL))
+	if err != nil {
+		t.Fatalf("error making request to server: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an unknown entity type; got %v", resp.Status)
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestEventHandlerEventTime(t *testing.T) {
+	received := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var assessedAt time.Time
+	newServer := &Server{
+		riskHandlers: map[string][]util.NamedRiskHandler{
+			util.Events.Login: {{
+				Name:     "stub",
+				Strategy: util.Strategies.Average,
+				Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+					assessedAt = util.EventTimeFromContext(ctx)
+					return util.RiskResult{Name: "stub", Strategy: util.Strategies.Average}
+				},
+			}},
+		},
+		clock: fixedClock(received),
+	}
+
+	router := chi.NewRouter()
+	router.Post("/event", newServer.EventHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	post := func(timestamp string) int {
+		body := fmt.Sprintf(`{"event": "login", "timestamp": %q, "data": {}}`, timestamp)
+		resp, err := http.Post(fmt.Sprintf("%s/event", ts.URL), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("2024-05-01T09:58:00Z"); status != http.StatusOK {
+		t.Fatalf("expected status OK for an event within the allowed lateness; got %v", status)
+	}
+	if !assessedAt.Equal(received.Add(-2 * time.Minute)) {
+		t.Errorf("expected the event to be assessed at its timestamp, got %v", assessedAt)
+	}
+
+	if status := post("2024-05-01T09:00:00Z"); status != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an event past the allowed lateness; got %v", status)
+	}
+}
+
+func TestEventHandlerDegraded(t *testing.T) {
+	newServer := &Server{
+		riskHandlers: map[string][]util.NamedRiskHandler{
+			util.Events.Login: {{
+				Name:     "velocity",
+				Strategy: util.Strategies.Average,
+				OnError:  util.ErrorPolicy{Action: util.ErrorActions.Challenge},
+				Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+					errText := "connection refused"
+					return util.RiskResult{Name: "velocity", Strategy: util.Strategies.Average, Err: &errText}
+				},
+			}},
+		},
+		clock: util.SystemClock{},
+	}
+
+	router := chi.NewRouter()
+	router.Post("/event", newServer.EventHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Post(fmt.Sprintf("%s/event", ts.URL), "application/json", strings.NewReader(`{"event": "login", "data": {}}`))
+	if err != nil {
+		t.Fatalf("error making request to server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Decision string `json:"decision"`
+		Degraded bool   `json:"degraded"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !body.Degraded || body.Decision != util.Decisions.Challenge {
+		t.Errorf("expected a degraded challenge when the rule errors, got %+v", body)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	store, err := assessments.OpenBoltStore(filepath.Join(t.TempDir(), "assessments.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error opening store: %v", err)
+	}
+	defer store.Close()
+
+	newServer := &Server{
+		riskHandlers: map[string][]util.NamedRiskHandler{
+			util.Events.Login: {{
+				Name:     "stub",
+				Strategy: util.Strategies.Average,
+				Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+					return util.RiskResult{Name: "stub", Strategy: util.Strategies.Average}
+				},
+			}},
+		},
+		clock: util.SystemClock{},
+		store: store,
+	}
+
+	router := chi.NewRouter()
+	router.Post("/event", newServer.EventHandler)
+	router.Get("/events", newServer.EventsHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	for _, account := range []string{"alice", "bob", "alice"} {
+		body := fmt.Sprintf(`{"event": "login", "data": {"account": %q, "ip": "1.2.3.4"}}`, account)
+		resp, err := http.Post(fmt.Sprintf("%s/event", ts.URL), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/events?account=alice&limit=1", ts.URL))
+	if err != nil {
+		t.Fatalf("error making request to server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+
+	var page assessments.Page
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(page.Events) != 1 || page.Events[0].Data["account"] != "alice" || page.NextCursor == "" {
+		t.Errorf("expected one of alice's events and a cursor for the next, got %+v", page)
+	}
+
+	for _, query := range []string{"limit=0", "from=yesterday", "cursor=abc"} {
+		resp, err := http.Get(fmt.Sprintf("%s/events?%s", ts.URL, query))
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status Bad Request for %s; got %v", query, resp.Status)
+		}
+	}
+}
+
+// tenantHeader stands in for AuthMiddleware resolving the tenant of the API key, taking it from X-Tenant
+func tenantHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(util.WithTenant(r.Context(), r.Header.Get("X-Tenant"))))
+	})
+}
+
+func TestEventsHandlerTenants(t *testing.T) {
+	store, err := assessments.OpenBoltStore(filepath.Join(t.TempDir(), "assessments.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error opening store: %v", err)
+	}
+	defer store.Close()
+
+	newServer := &Server{
+		riskHandlers: map[string][]util.NamedRiskHandler{
+			util.Events.Login: {{
+				Name:     "stub",
+				Strategy: util.Strategies.Average,
+				Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+					return util.RiskResult{Name: "stub", Strategy: util.Strategies.Average}
+				},
+			}},
+		},
+		clock: util.SystemClock{},
+		store: store,
+	}
+
+	router := chi.NewRouter()
+	router.Use(tenantHeader)
+	router.Post("/event", newServer.EventHandler)
+	router.Get("/events", newServer.EventsHandler)
+	router.Get("/events/{id}", newServer.EventRecordHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	send := func(method string, path string, tenant string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		return resp
+	}
+
+	ids := map[string]string{}
+	for _, tenant := range []string{"portal", "mobile"} {
+		resp := send(http.MethodPost, "/event", tenant, `{"event": "login", "data": {"ip": "1.2.3.4"}}`)
+		var body struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		ids[tenant] = body.ID
+	}
+
+	resp := send(http.MethodGet, "/events", "portal", "")
+	var page assessments.Page
+	json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if len(page.Events) != 1 || page.Events[0].ID != ids["portal"] {
+		t.Errorf("expected only portal's event, got %+v", page.Events)
+	}
+
+	resp = send(http.MethodGet, "/events/"+ids["mobile"], "portal", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status Not Found for another tenant's event; got %v", resp.Status)
+	}
+}
+
+func TestSharedRoutesNeedNoTenant(t *testing.T) {
+	newServer := &Server{}
+	router := chi.NewRouter()
+	router.Use(tenantHeader)
+	router.With(NoTenantMiddleware).Get("/challenger", newServer.ChallengerHandler)
+	router.With(NoTenantMiddleware).Mount("/configuration/rules/denylist", ruleRouter.DenyListRouter())
+	router.With(NoTenantMiddleware).Mount("/configuration/rules/identifierReputation", ruleRouter.IdentifierReputationRouter())
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	send := func(method string, path string, tenant string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for tenant, expected := range map[string]int{"portal": http.StatusForbidden, "": http.StatusNotFound} {
+		if resp := send(http.MethodGet, "/challenger", tenant, ""); resp.StatusCode != expected {
+			t.Errorf("expected status %d for tenant %q; got %v", expected, tenant, resp.Status)
+		}
+	}
+
+	changes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPut, "/configuration/rules/denylist", `{"type": "ips", "value": "1.2.3.4"}`},
+		{http.MethodDelete, "/configuration/rules/denylist/ips/1.2.3.4", ""},
+		{http.MethodPut, "/configuration/rules/identifierReputation", `{"value": "erin@example.com"}`},
+		{http.MethodDelete, "/configuration/rules/identifierReputation/erin@example.com", ""},
+	}
+	for _, change := range changes {
+		if resp := send(change.method, change.path, "portal", change.body); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status Forbidden for a tenant's %s %s; got %v", change.method, change.path, resp.Status)
+		}
+	}
+}
+
+func TestEventHandlerTenantRuleset(t *testing.T) {
+	stub := func(score float64) map[string][]util.NamedRiskHandler {
+		return map[string][]util.NamedRiskHandler{
+			util.Events.Login: {{
+				Name:     "stub",
+				Strategy: util.Strategies.Average,
+				Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+					return util.RiskResult{Name: "stub", Strategy: util.Strategies.Average, Score: score}
+				},
+			}},
+		}
+	}
+	challenge := 0.5
+	newServer := &Server{
+		riskHandlers: stub(0.6),
+		services:     rules.ServicesConfig{Nats: rules.NatsConfig{Threshold: 0.5}},
+		clock:        util.SystemClock{},
+		tenants: map[string]rules.Ruleset{
+			"portal": {Handlers: stub(0.6), Threshold: 0.8, Subject: "alerts.portal"},
+			"kiosk":  {Handlers: stub(0.6), Threshold: 0.8, Subject: "alerts.kiosk", Challenge: &challenge},
+		},
+	}
+
+	router := chi.NewRouter()
+	router.Use(tenantHeader)
+	router.Post("/event", newServer.EventHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	decision := func(tenant string) string {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/event", strings.NewReader(`{"event": "login", "data": {"ip": "1.2.3.4"}}`))
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Decision string `json:"decision"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body.Decision
+	}
+
+	if got := decision("portal"); got != util.Decisions.Pass {
+		t.Errorf("expected portal's threshold of 0.8 to pass a risk of 0.6, got %q", got)
+	}
+	if got := decision("kiosk"); got != util.Decisions.Challenge {
+		t.Errorf("expected kiosk's challenge band above 0.5 to challenge a risk of 0.6, got %q", got)
+	}
+	if got := decision("mobile"); got != util.Decisions.Alert {
+		t.Errorf("expected a tenant without its own ruleset to use the primary threshold, got %q", got)
+	}
+}
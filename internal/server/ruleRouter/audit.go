@@ -0,0 +1,27 @@
+package ruleRouter
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"rba/audit"
+)
+
+// applyChange makes a change to a list and records it in the audit log in one transaction. When it can't be recorded
+// the change isn't made and the request fails.
+func applyChange(w http.ResponseWriter, r *http.Request, action string, target string, change audit.SetChange) bool {
+	entry, err := audit.NewEntry(r, action, target, nil, nil)
+	if err == nil {
+		_, err = audit.Apply(r.Context(), entry, change)
+	}
+	if err != nil {
+		log.Printf("AUDIT FAILURE: %s %s by %s was not applied as it could not be recorded: %v", action, target, entry.KeyID, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, audit.ErrUnavailable) || errors.Is(err, audit.ErrNoKey) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "change not applied as it could not be recorded in the audit log", status)
+		return false
+	}
+	return true
+}
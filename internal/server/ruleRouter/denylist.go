@@ -61,11 +61,14 @@ func DenyListRouter() chi.Router {
 
 		defer r.Body.Close()
 
-		errCode, err := rules.UpdateDenylistParam(r.Context(), payload.Value, payload.ParamType, "add")
+		change, errCode, err := rules.DenylistChange(payload.Value, payload.ParamType, "add")
 		if err != nil {
 			http.Error(w, err.Error(), errCode)
 			return
 		}
+		if !applyChange(w, r, "denylist.add", payload.ParamType+" "+payload.Value, change) {
+			return
+		}
 
 		w.WriteHeader(http.StatusAccepted)
 	})
@@ -80,11 +83,14 @@ func DenyListRouter() chi.Router {
 			return
 		}
 
-		errCode, err := rules.RemoveDenylistEntry(r.Context(), paramType, entry)
+		change, errCode, err := rules.DenylistChange(entry, paramType, "remove")
 		if err != nil {
 			http.Error(w, err.Error(), errCode)
 			return
 		}
+		if !applyChange(w, r, "denylist.remove", paramType+" "+entry, change) {
+			return
+		}
 
 		w.WriteHeader(http.StatusAccepted)
 	})
@@ -0,0 +1,86 @@
+package ruleRouter
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"rba/rules"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type IdentifierDenylistGetResponse struct {
+	Identifiers []string `json:"identifiers"`
+}
+
+func IdentifierReputationRouter() chi.Router {
+
+	router := chi.NewRouter()
+
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		identifiers, errCode, err := rules.GetIdentifierDenylist(r.Context())
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), errCode)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		response := IdentifierDenylistGetResponse{
+			Identifiers: identifiers,
+		}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	})
+
+	router.Put("/", func(w http.ResponseWriter, r *http.Request) {
+		type IdentifierDenylistUpdate struct {
+			Value string `json:"value"`
+		}
+
+		var payload IdentifierDenylistUpdate
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+
+		defer r.Body.Close()
+
+		change, errCode, err := rules.IdentifierDenylistChange(payload.Value, "add")
+		if err != nil {
+			http.Error(w, err.Error(), errCode)
+			return
+		}
+		if !applyChange(w, r, "identifierDenylist.add", payload.Value, change) {
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	router.Delete("/{entry}", func(w http.ResponseWriter, r *http.Request) {
+		entry, err := url.PathUnescape(chi.URLParam(r, "entry"))
+		if err != nil {
+			http.Error(w, "invalid encoding", http.StatusBadRequest)
+			return
+		}
+
+		change, errCode, err := rules.IdentifierDenylistChange(entry, "remove")
+		if err != nil {
+			http.Error(w, err.Error(), errCode)
+			return
+		}
+		if !applyChange(w, r, "identifierDenylist.remove", entry, change) {
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	return router
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"rba/assessments"
 	"rba/rules"
+	"rba/services"
 	"rba/util"
 	"strconv"
 	"time"
@@ -15,9 +17,18 @@ type Server struct {
 	riskHandlers map[string][]util.NamedRiskHandler
 	services     rules.ServicesConfig
 	authKeys     map[string][]byte
+	clock        util.Clock
+	// Optional, a second ruleset compared with riskHandlers for every event
+	challenger *rules.Challenger
+	// Optional, where assessments are kept for feedback and queries
+	store assessments.Store
+	// Rulesets of the tenants that have their own, by tenant name. Other tenants use riskHandlers.
+	tenants map[string]rules.Ruleset
+	// Optional, the circuit breaker around the rules' redis state reported on /health and /metrics
+	breaker *services.Breaker
 }
 
-func NewServer(riskHandlers map[string][]util.NamedRiskHandler, services rules.ServicesConfig, authKeys map[string][]byte) *http.Server {
+func NewServer(riskHandlers map[string][]util.NamedRiskHandler, services rules.ServicesConfig, authKeys map[string][]byte, challenger *rules.Challenger, store assessments.Store, tenants map[string]rules.Ruleset) *http.Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 
 	NewServer := &Server{
@@ -25,6 +36,11 @@ func NewServer(riskHandlers map[string][]util.NamedRiskHandler, services rules.S
 		riskHandlers: riskHandlers,
 		services:     services,
 		authKeys:     authKeys,
+		clock:        util.SystemClock{},
+		challenger:   challenger,
+		store:        store,
+		tenants:      tenants,
+		breaker:      redisBreaker(),
 	}
 
 	server := &http.Server{
@@ -37,3 +53,15 @@ func NewServer(riskHandlers map[string][]util.NamedRiskHandler, services rules.S
 
 	return server
 }
+
+// ruleset returns the ruleset a tenant's events are assessed with, and whether it is the tenant's own
+func (s *Server) ruleset(tenant string) (rules.Ruleset, bool) {
+	if ruleset, ok := s.tenants[tenant]; ok {
+		return ruleset, true
+	}
+	return rules.Ruleset{
+		Handlers:  s.riskHandlers,
+		Threshold: s.services.Nats.Threshold,
+		Subject:   s.services.Nats.AlertSubject(),
+	}, false
+}
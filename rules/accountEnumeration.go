@@ -0,0 +1,208 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"rba/services"
+	"rba/util"
+	"time"
+)
+
+func init() {
+	Register(RuleType{
+		Name:          util.Rules.AccountEnumeration,
+		Params:        paramSchema(accountEnumerationParams{}),
+		RequiresState: true,
+		Events:        []string{util.Events.PasswordResetRequest, util.Events.Registration},
+		Parse:         fixedEvents(parseAccountEnumerationRule),
+	})
+}
+
+// Subnet sizes identifiers are grouped by, so a caller rotating through addresses in one network is still caught
+const (
+	enumerationSubnetBitsV4 = 24
+	enumerationSubnetBitsV6 = 64
+)
+
+type accountEnumerationParams struct {
+	Interval                     time.Duration `param:"intervalSeconds,required" min:"1"`
+	DistinctIdentifiers          int           `param:"distinctIdentifiers,required" min:"1"`
+	DistinctIdentifiersPerSubnet int           `param:"distinctIdentifiersPerSubnet,required" min:"1"`
+	UnknownRatio                 float64       `param:"unknownRatio,required" min:"0" max:"1"`
+	MinAttempts                  int           `param:"minAttempts,required" min:"1"`
+	strategyParams
+}
+
+type accountEnumerationConfig struct {
+	interval                     time.Duration
+	distinctIdentifiers          int
+	distinctIdentifiersPerSubnet int
+	unknownRatio                 float64
+	minAttempts                  int
+}
+
+// subnetOf returns the network an IP belongs to, a /24 for IPv4 and a /64 for IPv6
+func subnetOf(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid IP: %s", ip)
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		mask := net.CIDRMask(enumerationSubnetBitsV4, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String(), nil
+	}
+	mask := net.CIDRMask(enumerationSubnetBitsV6, 128)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String(), nil
+}
+
+// EvaluateAccountEnumerationRisk checks the state store for an IP probing password reset or registration for valid identifiers.
+// Distinct identifiers are counted per IP and per subnet. When accountExists is known, the share of attempts on
+// unknown accounts is also tracked per IP.
+func EvaluateAccountEnumerationRisk(
+	ctx context.Context,
+	ip string,
+	identifier string,
+	accountExists *bool,
+	cfg accountEnumerationConfig,
+) (float64, error) {
+	subnet, err := subnetOf(ip)
+	if err != nil {
+		return 0, err
+	}
+
+	at := eventTime(ctx)
+	ipCount, err := services.State.RecordDistinct(ctx, stateKey(ctx, "accountEnumeration:identifiers:%s", ip), at, identifier, cfg.interval, allowedLateness)
+	if err != nil {
+		return 0, err
+	}
+
+	subnetCount, err := services.State.RecordDistinct(ctx, stateKey(ctx, "accountEnumeration:subnetIdentifiers:%s", subnet), at, identifier, cfg.interval, allowedLateness)
+	if err != nil {
+		return 0, err
+	}
+
+	score := 0.0
+	if int(ipCount) >= cfg.distinctIdentifiers || int(subnetCount) >= cfg.distinctIdentifiersPerSubnet {
+		score = 1.0
+	}
+
+	if accountExists == nil {
+		return score, nil
+	}
+
+	// Attempts and unknown accounts are fields of one hash per window, so they are counted over the same span and the
+	// ratio stays within 0 and 1
+	increments := map[string]int64{"attempts": 1, "unknown": 0}
+	if !*accountExists {
+		increments["unknown"] = 1
+	}
+	counts, err := slidingFields(ctx, stateKey(ctx, "accountEnumeration:outcomes:%s", ip), cfg.interval, increments, "attempts", "unknown")
+	if err != nil {
+		return 0, err
+	}
+
+	attempts, unknown := counts["attempts"], counts["unknown"]
+	if attempts >= float64(cfg.minAttempts) && unknown/attempts >= cfg.unknownRatio {
+		score = 1.0
+	}
+	return score, nil
+}
+
+// inspectAccountEnumeration reads the identifiers and attempt counters held for an IP and its subnet over the interval
+func inspectAccountEnumeration(ctx context.Context, ip string, interval time.Duration) (map[string]interface{}, error) {
+	subnet, err := subnetOf(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	at := eventTime(ctx)
+	identifiers, err := services.State.DistinctMembers(ctx, stateKey(ctx, "accountEnumeration:identifiers:%s", ip), at, interval)
+	if err != nil {
+		return nil, err
+	}
+	subnetIdentifiers, err := services.State.DistinctMembers(ctx, stateKey(ctx, "accountEnumeration:subnetIdentifiers:%s", subnet), at, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := slidingFields(ctx, stateKey(ctx, "accountEnumeration:outcomes:%s", ip), interval, nil, "attempts", "unknown")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"distinctIdentifiers":       identifiers,
+		"subnet":                    subnet,
+		"subnetDistinctIdentifiers": len(subnetIdentifiers),
+		"attempts":                  counts["attempts"],
+		"unknownAccountAttempts":    counts["unknown"],
+	}, nil
+}
+
+func parseAccountEnumerationRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
+	var params accountEnumerationParams
+	if err := decodeParams(util.Rules.AccountEnumeration, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
+	}
+
+	strategy := params.Strategy
+	cfg := accountEnumerationConfig{
+		interval:                     params.Interval,
+		distinctIdentifiers:          params.DistinctIdentifiers,
+		distinctIdentifiersPerSubnet: params.DistinctIdentifiersPerSubnet,
+		unknownRatio:                 params.UnknownRatio,
+		minAttempts:                  params.MinAttempts,
+	}
+
+	return util.NamedRiskHandler{
+		Name:     util.Rules.AccountEnumeration,
+		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.IP {
+				return nil, nil
+			}
+			return inspectAccountEnumeration(ctx, id, cfg.interval)
+		},
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			base := util.RiskResult{
+				Name:     util.Rules.AccountEnumeration,
+				Strategy: strategy,
+				Score:    0,
+				Err:      nil,
+			}
+
+			ip, err := util.GetStringField(args, "ip")
+			if err != nil {
+				errText := "missing ip"
+				result := base
+				result.Err = &errText
+				return result
+			}
+
+			identifier, err := util.GetStringField(args, "identifier")
+			if err != nil {
+				errText := "missing identifier"
+				result := base
+				result.Err = &errText
+				return result
+			}
+
+			// accountExists is optional, only callers that know the outcome send it
+			var accountExists *bool
+			if exists, ok := args["accountExists"].(bool); ok {
+				accountExists = &exists
+			}
+
+			score, redisErr := EvaluateAccountEnumerationRisk(ctx, ip, identifier, accountExists, cfg)
+
+			result := base
+			result.Score = score
+			if redisErr != nil {
+				errText := redisErr.Error()
+				result.Err = &errText
+			}
+			return result
+		},
+	}, nil
+}
@@ -0,0 +1,111 @@
+package rules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+)
+
+func TestEvaluateAccountEnumerationRisk(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := util.WithEventTime(context.Background(), windowStart)
+		cfg := accountEnumerationConfig{
+			interval:                     2 * time.Second,
+			distinctIdentifiers:          3,
+			distinctIdentifiersPerSubnet: 4,
+			unknownRatio:                 0.8,
+			minAttempts:                  100,
+		}
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// Two identifiers from one IP and one from a neighbour stay under both thresholds
+		for _, probe := range []struct{ ip, identifier string }{
+			{"10.0.0.1", "alice@example.com"},
+			{"10.0.0.1", "bob@example.com"},
+			{"10.0.0.2", "carol@example.com"},
+		} {
+			score, err := EvaluateAccountEnumerationRisk(ctx, probe.ip, probe.identifier, nil, cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if score != 0.0 {
+				t.Errorf("expected score 0.0 for %s from %s, got %v", probe.identifier, probe.ip, score)
+			}
+		}
+
+		// A fourth identifier from a rotated address in the same /24 trips the subnet threshold
+		score, _ := EvaluateAccountEnumerationRisk(ctx, "10.0.0.3", "dave@example.com", nil, cfg)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 once the subnet threshold is reached, got %v", score)
+		}
+
+		// A third identifier from the first IP trips the per IP threshold
+		score, _ = EvaluateAccountEnumerationRisk(ctx, "10.0.0.1", "erin@example.com", nil, cfg)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 once the per IP threshold is reached, got %v", score)
+		}
+	})
+}
+
+func TestEvaluateAccountEnumerationRiskUnknownRatio(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := util.WithEventTime(context.Background(), windowStart)
+		cfg := accountEnumerationConfig{
+			interval:                     2 * time.Second,
+			distinctIdentifiers:          100,
+			distinctIdentifiersPerSubnet: 100,
+			unknownRatio:                 0.5,
+			minAttempts:                  4,
+		}
+		exists, missing := true, false
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// Below minAttempts the ratio is not applied, even when every account is unknown
+		for _, identifier := range []string{"a", "b", "c"} {
+			score, err := EvaluateAccountEnumerationRisk(ctx, "10.1.0.1", identifier, &missing, cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if score != 0.0 {
+				t.Errorf("expected score 0.0 before minAttempts, got %v", score)
+			}
+		}
+
+		// 3 unknown out of 4 attempts is over the ratio
+		score, _ := EvaluateAccountEnumerationRisk(ctx, "10.1.0.1", "d", &exists, cfg)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 when the unknown ratio is exceeded, got %v", score)
+		}
+
+		// Mostly known accounts from another IP stay under the ratio
+		for _, identifier := range []string{"e", "f", "g"} {
+			_, _ = EvaluateAccountEnumerationRisk(ctx, "10.2.0.1", identifier, &exists, cfg)
+		}
+		score, _ = EvaluateAccountEnumerationRisk(ctx, "10.2.0.1", "h", &missing, cfg)
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 when most accounts exist, got %v", score)
+		}
+
+		// Attempts either side of a window boundary are counted together
+		at := func(offset time.Duration) context.Context {
+			return util.WithEventTime(ctx, windowStart.Add(offset))
+		}
+		for _, identifier := range []string{"i", "j", "k"} {
+			_, _ = EvaluateAccountEnumerationRisk(at(1900*time.Millisecond), "10.3.0.1", identifier, &missing, cfg)
+		}
+		_, _ = EvaluateAccountEnumerationRisk(at(2100*time.Millisecond), "10.3.0.1", "l", &missing, cfg)
+		score, _ = EvaluateAccountEnumerationRisk(at(2100*time.Millisecond), "10.3.0.1", "m", &missing, cfg)
+		if score != 1.0 {
+			t.Errorf("expected attempts straddling a window boundary to reach minAttempts, got %v", score)
+		}
+	})
+}
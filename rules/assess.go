@@ -0,0 +1,152 @@
+package rules
+
+import (
+	"context"
+	"log"
+	"rba/util"
+	"sync"
+	"time"
+)
+
+// Time each rule handler has to return before its result is replaced with an error
+const handlerTimeout = 100 * time.Millisecond
+
+// Assessment is the outcome of assessing an event
+type Assessment struct {
+	Risk        float64
+	RuleResults []util.RiskResult
+	// Results of rules in shadow mode, which are not part of Risk
+	ShadowResults []util.RiskResult
+	// Set when an enforced rule errored or ran out of time, so the risk is missing its result
+	Degraded bool
+	// Set when an enforced rule with onError: challenge could not assess the event
+	Challenge bool
+}
+
+// Decide returns the decision for the assessment. Risk above the threshold is an alert, otherwise a rule that asked
+// to challenge on error turns a pass into a challenge.
+func (a Assessment) Decide(threshold float64) string {
+	decision := util.Decide(a.Risk, threshold)
+	if decision == util.Decisions.Pass && a.Challenge {
+		return util.Decisions.Challenge
+	}
+	return decision
+}
+
+// applyErrorPolicy marks an errored result with the action its rule takes on errors, giving it the policy's score
+// when it is scored
+func applyErrorPolicy(result util.RiskResult, policy util.ErrorPolicy) util.RiskResult {
+	if result.Err == nil || policy.Action == "" || policy.Action == util.ErrorActions.Ignore {
+		return result
+	}
+	result.OnError = policy.Action
+	if policy.Action == util.ErrorActions.Score {
+		result.Score = policy.Score
+	}
+	return result
+}
+
+// Assess runs the handlers for an event concurrently and aggregates their results, then accumulates the risk
+// against the event's entities. Used by the event API and offline replays so both score events the same way.
+func Assess(ctx context.Context, handlers []util.NamedRiskHandler, event string, data map[string]interface{}) Assessment {
+	riskAssessments := make(chan util.RiskResult, len(handlers))
+	shadowAssessments := make(chan util.RiskResult, len(handlers))
+	var wg sync.WaitGroup
+
+	for _, namedHandler := range handlers {
+		// Shadow results are kept apart so they never reach the risk calculation
+		out := riskAssessments
+		if namedHandler.Shadow {
+			out = shadowAssessments
+		}
+
+		wg.Add(1)
+		go func(h util.RiskHandlerFunc, policy util.ErrorPolicy) {
+			defer wg.Done()
+
+			// Create a context with 100ms timeout
+			ctx, cancel := context.WithTimeout(util.WithEvent(ctx, event), handlerTimeout)
+			defer cancel()
+
+			resultChan := make(chan util.RiskResult, 1)
+
+			// Need to run this in a routine so it does not block the context check for timeout
+			go func() {
+				resultChan <- h(ctx, data)
+			}()
+
+			select {
+			case <-ctx.Done():
+				// If handler takes too long send back an error for the result
+				errText := "deadline exceeded"
+				out <- applyErrorPolicy(util.RiskResult{
+					Name:     namedHandler.Name,
+					Score:    0,
+					Err:      &errText,
+					Strategy: namedHandler.Strategy,
+				}, policy)
+			case result := <-resultChan:
+				// Otherwise include the handler result
+				out <- applyErrorPolicy(result, policy)
+			}
+		}(namedHandler.Handler, namedHandler.OnError)
+	}
+
+	go func() {
+		wg.Wait()
+		close(riskAssessments)
+		close(shadowAssessments)
+	}()
+
+	avg, results := util.CalculateRisk(riskAssessments)
+
+	var degraded, challenge bool
+	for _, result := range results {
+		if result.Err != nil {
+			degraded = true
+		}
+		if result.OnError == util.ErrorActions.Challenge {
+			challenge = true
+		}
+	}
+
+	var shadowResults []util.RiskResult
+	for result := range shadowAssessments {
+		shadowResults = append(shadowResults, result)
+		if result.Err != nil {
+			log.Printf("shadow rule %s on %s: error %s", result.Name, event, *result.Err)
+		} else {
+			log.Printf("shadow rule %s on %s: score %v", result.Name, event, result.Score)
+		}
+	}
+
+	// Rules that record the event's outcome are left out of the risk they are given, so their own score doesn't feed
+	// back into itself. Shadow rules never record, as they must not change what enforced rules see.
+	var recorders []util.NamedRiskHandler
+	recorderNames := map[string]bool{}
+	for _, handler := range handlers {
+		if handler.Record != nil && !handler.Shadow {
+			recorders = append(recorders, handler)
+			recorderNames[handler.Name] = true
+		}
+	}
+	if len(recorders) > 0 {
+		var eventResults []util.RiskResult
+		for _, result := range results {
+			if !recorderNames[result.Name] {
+				eventResults = append(eventResults, result)
+			}
+		}
+		eventRisk := util.AggregateRisk(eventResults)
+
+		recordCtx, cancel := context.WithTimeout(ctx, handlerTimeout)
+		defer cancel()
+		for _, recorder := range recorders {
+			if err := recorder.Record(recordCtx, data, eventRisk); err != nil {
+				log.Printf("%s failed to record event: %v", recorder.Name, err)
+			}
+		}
+	}
+
+	return Assessment{Risk: avg, RuleResults: results, ShadowResults: shadowResults, Degraded: degraded, Challenge: challenge}
+}
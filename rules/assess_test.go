@@ -0,0 +1,190 @@
+package rules
+
+import (
+	"context"
+	"testing"
+
+	"rba/services"
+	"rba/types"
+	"rba/util"
+)
+
+func stubHandler(name string, score float64) util.NamedRiskHandler {
+	return util.NamedRiskHandler{
+		Name:     name,
+		Strategy: util.Strategies.Average,
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			return util.RiskResult{Name: name, Strategy: util.Strategies.Average, Score: score}
+		},
+	}
+}
+
+func TestAssessShadow(t *testing.T) {
+	shadow := stubHandler("candidate", 1)
+	shadow.Shadow = true
+
+	assessment := Assess(context.Background(), []util.NamedRiskHandler{stubHandler("production", 0.2), shadow}, util.Events.Login, map[string]interface{}{})
+	if assessment.Risk != 0.2 {
+		t.Errorf("expected shadow rule to be left out of the risk, got %v", assessment.Risk)
+	}
+	if len(assessment.RuleResults) != 1 || assessment.RuleResults[0].Name != "production" {
+		t.Errorf("expected only the production result in rule results, got %v", assessment.RuleResults)
+	}
+	if len(assessment.ShadowResults) != 1 || assessment.ShadowResults[0].Score != 1 {
+		t.Errorf("expected the candidate result in shadow results, got %v", assessment.ShadowResults)
+	}
+}
+
+func TestAssessShadowState(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := util.WithEventTime(context.Background(), windowStart)
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		params := map[string]interface{}{"intervalSeconds": 60, "limit": 2, "strategy": "average"}
+		enforced, _, err := buildRule(types.RuleConfig{Name: util.Rules.Velocity, Params: params})
+		if err != nil {
+			t.Fatalf("unexpected error building rule: %v", err)
+		}
+		shadowParams := map[string]interface{}{"intervalSeconds": 60, "limit": 2, "strategy": "average", "mode": "shadow"}
+		shadow, _, err := buildRule(types.RuleConfig{Name: util.Rules.Velocity, Params: shadowParams})
+		if err != nil {
+			t.Fatalf("unexpected error building rule: %v", err)
+		}
+
+		// Two logins are within the limit, as the shadow copy counts them under its own keys
+		data := map[string]interface{}{"ip": "1.2.3.4"}
+		for i := 0; i < 2; i++ {
+			assessment := Assess(ctx, []util.NamedRiskHandler{enforced, shadow}, util.Events.Login, data)
+			if assessment.Risk != 0 {
+				t.Errorf("expected login %d to be within the limit with a shadow copy running, got risk %v", i+1, assessment.Risk)
+			}
+			if len(assessment.ShadowResults) != 1 || assessment.ShadowResults[0].Score != 0 {
+				t.Errorf("expected the shadow copy to score login %d the same, got %v", i+1, assessment.ShadowResults)
+			}
+		}
+	})
+}
+
+func TestBuildRuleMode(t *testing.T) {
+	params := map[string]interface{}{"id": "candidate", "expression": "true", "strategy": "average", "mode": "shadow"}
+	handler, _, err := buildRule(types.RuleConfig{Name: util.Rules.Expression, Params: params})
+	if err != nil {
+		t.Fatalf("unexpected error building rule: %v", err)
+	}
+	if !handler.Shadow {
+		t.Errorf("expected mode shadow to mark the handler as shadow")
+	}
+	if _, exists := params["mode"]; !exists {
+		t.Errorf("expected the configured params to be left unchanged")
+	}
+
+	params["mode"] = "dryrun"
+	if _, _, err := buildRule(types.RuleConfig{Name: util.Rules.Expression, Params: params}); err == nil {
+		t.Errorf("expected an unknown mode to fail")
+	}
+}
+
+func failingHandler(name string, policy util.ErrorPolicy) util.NamedRiskHandler {
+	return util.NamedRiskHandler{
+		Name:     name,
+		Strategy: util.Strategies.Average,
+		OnError:  policy,
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			errText := "connection refused"
+			return util.RiskResult{Name: name, Strategy: util.Strategies.Average, Err: &errText}
+		},
+	}
+}
+
+func TestAssessErrorPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   util.ErrorPolicy
+		risk     float64
+		decision string
+	}{
+		{"unset", util.ErrorPolicy{}, 0.2, util.Decisions.Pass},
+		{"ignore", util.ErrorPolicy{Action: util.ErrorActions.Ignore}, 0.2, util.Decisions.Pass},
+		{"score", util.ErrorPolicy{Action: util.ErrorActions.Score, Score: 1}, 0.6, util.Decisions.Alert},
+		{"challenge", util.ErrorPolicy{Action: util.ErrorActions.Challenge}, 0.2, util.Decisions.Challenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := []util.NamedRiskHandler{stubHandler("production", 0.2), failingHandler("velocity", tt.policy)}
+			assessment := Assess(context.Background(), handlers, util.Events.Login, map[string]interface{}{})
+			if assessment.Risk != tt.risk {
+				t.Errorf("expected risk %v, got %v", tt.risk, assessment.Risk)
+			}
+			if !assessment.Degraded {
+				t.Errorf("expected an errored rule to mark the assessment degraded")
+			}
+			if got := assessment.Decide(0.5); got != tt.decision {
+				t.Errorf("expected decision %s, got %s", tt.decision, got)
+			}
+		})
+	}
+
+	// Risk above the threshold is still an alert when a rule asks for a challenge
+	handlers := []util.NamedRiskHandler{stubHandler("production", 0.9), failingHandler("velocity", util.ErrorPolicy{Action: util.ErrorActions.Challenge})}
+	if got := Assess(context.Background(), handlers, util.Events.Login, map[string]interface{}{}).Decide(0.5); got != util.Decisions.Alert {
+		t.Errorf("expected an alert to win over a challenge, got %s", got)
+	}
+
+	// Errors in shadow rules don't degrade the assessment
+	shadow := failingHandler("candidate", util.ErrorPolicy{Action: util.ErrorActions.Challenge})
+	shadow.Shadow = true
+	assessment := Assess(context.Background(), []util.NamedRiskHandler{stubHandler("production", 0.2), shadow}, util.Events.Login, map[string]interface{}{})
+	if assessment.Degraded || assessment.Decide(0.5) != util.Decisions.Pass {
+		t.Errorf("expected a failing shadow rule to leave the assessment alone, got %+v", assessment)
+	}
+}
+
+func TestAssessTimeoutErrorPolicy(t *testing.T) {
+	slow := util.NamedRiskHandler{
+		Name:     "slow",
+		Strategy: util.Strategies.Average,
+		OnError:  util.ErrorPolicy{Action: util.ErrorActions.Score, Score: 0.8},
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			<-ctx.Done()
+			return util.RiskResult{Name: "slow", Strategy: util.Strategies.Average}
+		},
+	}
+	assessment := Assess(context.Background(), []util.NamedRiskHandler{slow}, util.Events.Login, map[string]interface{}{})
+	if !assessment.Degraded || assessment.Risk != 0.8 {
+		t.Errorf("expected a timed out rule to be scored 0.8 and degrade the assessment, got %+v", assessment)
+	}
+	if result := assessment.RuleResults[0]; result.Err == nil || result.OnError != util.ErrorActions.Score {
+		t.Errorf("expected the result to keep its error and policy, got %+v", result)
+	}
+}
+
+func TestBuildRuleOnError(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		policy util.ErrorPolicy
+	}{
+		{"ignore", util.ErrorPolicy{Action: util.ErrorActions.Ignore}},
+		{"challenge", util.ErrorPolicy{Action: util.ErrorActions.Challenge}},
+		{0.8, util.ErrorPolicy{Action: util.ErrorActions.Score, Score: 0.8}},
+		{1, util.ErrorPolicy{Action: util.ErrorActions.Score, Score: 1}},
+	}
+	for _, tt := range tests {
+		params := map[string]interface{}{"id": "check", "expression": "true", "strategy": "average", "onError": tt.value}
+		handler, _, err := buildRule(types.RuleConfig{Name: util.Rules.Expression, Params: params})
+		if err != nil {
+			t.Fatalf("onError %v: unexpected error building rule: %v", tt.value, err)
+		}
+		if handler.OnError != tt.policy {
+			t.Errorf("onError %v: expected %+v, got %+v", tt.value, tt.policy, handler.OnError)
+		}
+	}
+
+	for _, value := range []interface{}{"retry", 1.5, -1, true} {
+		params := map[string]interface{}{"id": "check", "expression": "true", "strategy": "average", "onError": value}
+		if _, _, err := buildRule(types.RuleConfig{Name: util.Rules.Expression, Params: params}); err == nil {
+			t.Errorf("expected onError %v to fail", value)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"rba/util"
+	"sync"
+	"time"
+)
+
+// Namespace the challenger keeps its rule state under, apart from the champion's
+const challengerNamespace = "challenger"
+
+// Number of recent disagreements kept for the report
+const challengerRecentLimit = 100
+
+// Number of comparisons run at once. Events that arrive while all are busy aren't compared, so a slow challenger
+// can't pile up goroutines and state calls behind the champion.
+const challengerConcurrency = 64
+
+// Disagreement is an event the champion and challenger rulesets scored differently
+type Disagreement struct {
+	Event              string    `json:"event"`
+	Timestamp          time.Time `json:"timestamp"`
+	ChampionRisk       float64   `json:"championRisk"`
+	ChallengerRisk     float64   `json:"challengerRisk"`
+	ChampionDecision   string    `json:"championDecision"`
+	ChallengerDecision string    `json:"challengerDecision"`
+}
+
+// ChallengerReport counts how often the challenger disagreed with the champion since the server started, and how many
+// events weren't compared because the challenger was too busy
+type ChallengerReport struct {
+	Compared              int            `json:"compared"`
+	ScoreDisagreements    int            `json:"scoreDisagreements"`
+	DecisionDisagreements int            `json:"decisionDisagreements"`
+	Dropped               int            `json:"dropped"`
+	Recent                []Disagreement `json:"recent"`
+}
+
+// Challenger is a second ruleset evaluated alongside the primary, champion, ruleset for every event. Its results are
+// only compared with the champion's, never returned or alerted on.
+type Challenger struct {
+	handlers  map[string][]util.NamedRiskHandler
+	threshold float64
+	// Holds a token for each comparison running in the background
+	slots chan struct{}
+
+	mu     sync.Mutex
+	report ChallengerReport
+}
+
+// moduleConfig is the read-only config rule parsers keep at package level for the configuration API and event time.
+// It belongs to the champion, so it is put back after a challenger is parsed.
+type moduleConfig struct {
+	denylist             denylistConfigT
+	identifierReputation identifierReputationConfigT
+	allowedLateness      time.Duration
+	tenancy              TenancyConfig
+	tenantRulesets       map[string]Ruleset
+}
+
+func saveModuleConfig() moduleConfig {
+	return moduleConfig{
+		denylist:             denylistConfig,
+		identifierReputation: identifierReputationConfig,
+		allowedLateness:      allowedLateness,
+		tenancy:              tenancy,
+		tenantRulesets:       tenantRulesets,
+	}
+}
+
+func (m moduleConfig) restore() {
+	denylistConfig = m.denylist
+	identifierReputationConfig = m.identifierReputation
+	allowedLateness = m.allowedLateness
+	tenancy = m.tenancy
+	tenantRulesets = m.tenantRulesets
+}
+
+// LoadChallengerConfig loads a complete ruleset to compare with the champion. It runs against the champion's services,
+// which must already be connected, and decisions use the champion's NATS threshold. Rule types whose lists are managed
+// through the configuration API are rejected, as setting them up would change the champion's lists.
+func LoadChallengerConfig(path string, champion ServicesConfig) (*Challenger, error) {
+	defer saveModuleConfig().restore()
+
+	handlers, _, ruleTypes, err := readConfig(path, func(servicesConfig *ServicesConfig) {
+		*servicesConfig = champion
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ruleType := range ruleTypes {
+		if ruleType.PrimaryOnly {
+			return nil, fmt.Errorf("challenger: %w", primaryOnlyError(ruleType.Name))
+		}
+	}
+	// Set up while the challenger's package level config is in place, it is put back to the champion's on return
+	if err := setupRuleTypes(util.WithNamespace(context.Background(), challengerNamespace), ruleTypes); err != nil {
+		return nil, err
+	}
+
+	return &Challenger{
+		handlers:  handlers,
+		threshold: champion.Nats.Threshold,
+		slots:     make(chan struct{}, challengerConcurrency),
+		report:    ChallengerReport{Recent: []Disagreement{}},
+	}, nil
+}
+
+// CompareAsync runs Compare in the background and reports whether it was started. The event is dropped, and counted
+// in the report, when as many comparisons as the challenger allows are already running.
+func (c *Challenger) CompareAsync(ctx context.Context, event string, data map[string]interface{}, champion Assessment) bool {
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		c.mu.Lock()
+		c.report.Dropped++
+		c.mu.Unlock()
+		return false
+	}
+
+	go func() {
+		defer func() { <-c.slots }()
+		c.Compare(ctx, event, data, champion)
+	}()
+	return true
+}
+
+// Compare assesses an event with the challenger ruleset and records whether it disagrees with the champion's assessment.
+// ctx should carry the same event time the champion was assessed at.
+func (c *Challenger) Compare(ctx context.Context, event string, data map[string]interface{}, champion Assessment) Assessment {
+	challenger := Assess(util.WithNamespace(ctx, challengerNamespace), c.handlers[event], event, data)
+
+	disagreement := Disagreement{
+		Event:              event,
+		Timestamp:          util.EventTimeFromContext(ctx),
+		ChampionRisk:       champion.Risk,
+		ChallengerRisk:     challenger.Risk,
+		ChampionDecision:   champion.Decide(c.threshold),
+		ChallengerDecision: challenger.Decide(c.threshold),
+	}
+	scoreDiffers := math.Abs(champion.Risk-challenger.Risk) > 1e-9
+	decisionDiffers := disagreement.ChampionDecision != disagreement.ChallengerDecision
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.report.Compared++
+	if scoreDiffers {
+		c.report.ScoreDisagreements++
+		c.report.Recent = append(c.report.Recent, disagreement)
+		if len(c.report.Recent) > challengerRecentLimit {
+			c.report.Recent = c.report.Recent[1:]
+		}
+	}
+	if decisionDiffers {
+		c.report.DecisionDisagreements++
+		log.Printf("challenger disagrees on %s: champion %s (%v), challenger %s (%v)",
+			event, disagreement.ChampionDecision, champion.Risk, disagreement.ChallengerDecision, challenger.Risk)
+	}
+	return challenger
+}
+
+// Report returns a copy of the disagreements recorded so far
+func (c *Challenger) Report() ChallengerReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := c.report
+	report.Recent = append([]Disagreement{}, c.report.Recent...)
+	return report
+}
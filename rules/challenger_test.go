@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+)
+
+func TestChallengerCompare(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		path := filepath.Join(t.TempDir(), "challenger.yaml")
+		challengerRules := `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 0
+    strategy: average
+eventTime:
+  allowedLatenessSeconds: 5
+`
+		if err := os.WriteFile(path, []byte(challengerRules), 0o600); err != nil {
+			t.Fatalf("failed to write rules: %v", err)
+		}
+
+		champion := ServicesConfig{Redis: RedisConfig{Host: "localhost:6379", Enabled: true}, Nats: NatsConfig{Threshold: 0.5}}
+		challenger, err := LoadChallengerConfig(path, champion)
+		if err != nil {
+			t.Fatalf("unexpected error loading challenger: %v", err)
+		}
+		if AllowedLateness() != defaultAllowedLateness {
+			t.Errorf("expected the challenger's event time config to leave the champion's unchanged, got %v", AllowedLateness())
+		}
+
+		data := map[string]interface{}{"ip": "1.2.3.4"}
+		assessment := challenger.Compare(util.WithEventTime(ctx, time.Now()), util.Events.Login, data, Assessment{Risk: 0})
+		if assessment.Risk != 1 {
+			t.Errorf("expected the challenger to score the login 1, got %v", assessment.Risk)
+		}
+
+		report := challenger.Report()
+		if report.Compared != 1 || report.ScoreDisagreements != 1 || report.DecisionDisagreements != 1 {
+			t.Errorf("expected one score and decision disagreement, got %+v", report)
+		}
+		if len(report.Recent) != 1 || report.Recent[0].ChallengerDecision != util.Decisions.Alert {
+			t.Errorf("expected the disagreement to be kept with the challenger alerting, got %v", report.Recent)
+		}
+
+		// The challenger's state is kept apart from the champion's
+		if count, _ := services.State.CountInWindow(ctx, "velocity:slidingLog:60000:0:1.2.3.4", time.Now().UnixMilli(), time.Minute); count != 0 {
+			t.Errorf("expected no champion velocity state to be written")
+		}
+		if count, _ := services.State.CountInWindow(ctx, "challenger:velocity:slidingLog:60000:0:1.2.3.4", time.Now().UnixMilli(), time.Minute); count != 1 {
+			t.Errorf("expected velocity state under the challenger namespace")
+		}
+	})
+}
+
+func TestChallengerCompareAsyncDrops(t *testing.T) {
+	challenger := &Challenger{slots: make(chan struct{}, 1), report: ChallengerReport{Recent: []Disagreement{}}}
+
+	// With every slot taken the event is dropped rather than queued
+	challenger.slots <- struct{}{}
+	if challenger.CompareAsync(context.Background(), util.Events.Login, map[string]interface{}{}, Assessment{}) {
+		t.Errorf("expected the comparison to be dropped while the challenger is busy")
+	}
+	if report := challenger.Report(); report.Dropped != 1 || report.Compared != 0 {
+		t.Errorf("expected one dropped comparison, got %+v", report)
+	}
+
+	<-challenger.slots
+	if !challenger.CompareAsync(context.Background(), util.Events.Login, map[string]interface{}{}, Assessment{}) {
+		t.Errorf("expected the comparison to start once a slot is free")
+	}
+	// The slot is given back when the comparison finishes
+	challenger.slots <- struct{}{}
+	if report := challenger.Report(); report.Compared != 1 {
+		t.Errorf("expected the comparison to have run, got %+v", report)
+	}
+}
+
+func TestChallengerRejectsConfigurationAPIRules(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		path := filepath.Join(t.TempDir(), "challenger.yaml")
+		if err := os.WriteFile(path, []byte(`rules:
+  - name: denylist
+    sourceList: redis
+    ips: [10.0.0.1]
+    strategy: override
+`), 0o600); err != nil {
+			t.Fatalf("failed to write rules: %v", err)
+		}
+
+		champion := ServicesConfig{State: StateConfig{Backend: util.Services.Memory}, Nats: NatsConfig{Threshold: 0.5}}
+		if _, err := LoadChallengerConfig(path, champion); err == nil || !strings.Contains(err.Error(), "challenger: denylist: rule is managed through the configuration API") {
+			t.Errorf("expected a denylist in the challenger to be rejected, got %v", err)
+		}
+		if seeded, _ := services.State.IsMember(ctx, denylistKeys["ips"], "10.0.0.1"); seeded {
+			t.Errorf("expected the production denylist to be left alone")
+		}
+		if denylistConfig.configured {
+			t.Errorf("expected the champion's denylist config to be left alone")
+		}
+	})
+}
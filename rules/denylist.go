@@ -6,12 +6,18 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"rba/audit"
 	"rba/services"
 	"rba/util"
-
-	"github.com/redis/go-redis/v9"
 )
 
+type denylistParams struct {
+	SourceList string   `param:"sourceList,required" oneof:"static,redis"`
+	IPs        []string `param:"ips"`
+	CIDRs      []string `param:"cidrs"`
+	strategyParams
+}
+
 // Read-only configuration, should not be changed after initial parse. e.g. checking the sourceList to know to use redis.
 type denylistConfigT struct {
 	configured bool
@@ -22,49 +28,76 @@ type denylistConfigT struct {
 
 var denylistConfig = denylistConfigT{}
 
-func UpdateDenylistParam(ctx context.Context, ip string, paramType string, operation string) (int, error) {
+// Redis sets of the source list by param type, changed through the configuration API alongside the audit log
+var denylistKeys = map[string]string{
+	"ips":   audit.ConfigKey("denylist:ips"),
+	"cidrs": audit.ConfigKey("denylist:cidrs"),
+}
+
+func init() {
+	Register(RuleType{
+		Name:        util.Rules.Denylist,
+		Params:      paramSchema(denylistParams{}),
+		Events:      []string{util.Events.Login},
+		Parse:       fixedEvents(parseDenylistRule),
+		Setup:       setupDenylist,
+		PrimaryOnly: true,
+	})
+}
+
+// setupDenylist seeds the redis source list with the configured entries once services are connected
+func setupDenylist(ctx context.Context) error {
+	if !denylistConfig.configured || denylistConfig.sourceList != util.Services.Redis {
+		return nil
+	}
+	if services.State == nil {
+		return errors.New("denylist: sourceList redis requires a state store, enable services.redis or set services.state.backend")
+	}
+
+	if len(denylistConfig.cidrs) > 0 {
+		if _, err := services.State.AddToSet(ctx, denylistKeys["cidrs"], 0, denylistConfig.cidrs...); err != nil {
+			return err
+		}
+	}
+	if len(denylistConfig.ips) > 0 {
+		if _, err := services.State.AddToSet(ctx, denylistKeys["ips"], 0, denylistConfig.ips...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DenylistChange validates an add or remove of an ip or cidr on the redis source list and returns the change to make.
+// The configuration API makes it with audit.Apply, so it is recorded in the same transaction.
+func DenylistChange(value string, paramType string, operation string) (audit.SetChange, int, error) {
 	if paramType != "ip" && paramType != "cidr" {
-		return http.StatusBadRequest, errors.New("must provide cidr or ip for the param type")
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("must provide cidr or ip for the param type")
 	}
 
 	if operation != "add" && operation != "remove" {
-		return http.StatusBadRequest, errors.New("must provide add or remove for the operation")
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("must provide add or remove for the operation")
 	}
 
 	if !denylistConfig.configured {
-		return http.StatusBadRequest, errors.New("denylist is not configured")
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("denylist is not configured")
 	}
 
-	if denylistConfig.sourceList == util.Services.Redis {
-		if paramType == "ip" {
-			targetIP := net.ParseIP(ip)
-			if targetIP == nil {
-				return http.StatusBadRequest, errors.New("invalid ip address")
-			}
-		}
-
-		if paramType == "cidr" {
-			_, _, err := net.ParseCIDR(ip)
-			if err != nil {
-				return http.StatusBadRequest, errors.New("invalid cidr")
-			}
-		}
+	if denylistConfig.sourceList != util.Services.Redis {
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("no dynamic source configured")
+	}
+	if err := listsInRedis(); err != nil {
+		return audit.SetChange{}, http.StatusServiceUnavailable, err
+	}
 
-		ctx := context.TODO()
-		var ipCmd *redis.IntCmd
-		if operation == "add" {
-			ipCmd = services.RedisClient.SAdd(ctx, "denylist:"+paramType+"s", ip)
-		} else {
-			ipCmd = services.RedisClient.SRem(ctx, "denylist:"+paramType+"s", ip)
-		}
-		_, err := ipCmd.Result()
-		if err != nil {
-			return http.StatusInternalServerError, errors.New("failed to add param to redis")
+	if paramType == "ip" && net.ParseIP(value) == nil {
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("invalid ip address")
+	}
+	if paramType == "cidr" {
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return audit.SetChange{}, http.StatusBadRequest, errors.New("invalid cidr")
 		}
-		return http.StatusOK, nil
-	} else {
-		return http.StatusBadRequest, errors.New("no dynamic source configured")
 	}
+	return audit.SetChange{Key: denylistKeys[paramType+"s"], Member: value, Remove: operation == "remove"}, http.StatusOK, nil
 }
 
 func GetDenylistParams(ctx context.Context, paramType string) ([]string, int, error) {
@@ -78,8 +111,7 @@ func GetDenylistParams(ctx context.Context, paramType string) ([]string, int, er
 
 	if denylistConfig.sourceList == util.Services.Redis {
 		ctx := context.TODO()
-		ipCmd := services.RedisClient.SMembers(ctx, "denylist:"+paramType)
-		result, err := ipCmd.Result()
+		result, err := services.State.SetMembers(ctx, denylistKeys[paramType])
 		if err != nil {
 			return nil, http.StatusInternalServerError, errors.New("failed to fetch list from redis")
 		}
@@ -92,40 +124,6 @@ func GetDenylistParams(ctx context.Context, paramType string) ([]string, int, er
 	}
 }
 
-func RemoveDenylistEntry(ctx context.Context, paramType string, entry string) (int, error) {
-	if paramType != "ip" && paramType != "cidr" {
-		return http.StatusBadRequest, errors.New("must provide cidr or ip for the param type")
-	}
-
-	if !denylistConfig.configured {
-		return http.StatusBadRequest, errors.New("denylist is not configured")
-	}
-
-	if denylistConfig.sourceList == util.Services.Redis {
-		if paramType == "ip" {
-			targetIP := net.ParseIP(entry)
-			if targetIP == nil {
-				return http.StatusBadRequest, errors.New("invalid ip address")
-			}
-		}
-
-		if paramType == "cidr" {
-			_, _, err := net.ParseCIDR(entry)
-			if err != nil {
-				return http.StatusBadRequest, errors.New("invalid cidr")
-			}
-		}
-		ipCmd := services.RedisClient.SRem(ctx, "denylist:"+paramType+"s", entry)
-		_, err := ipCmd.Result()
-		if err != nil {
-			return http.StatusInternalServerError, errors.New("failed to remove entry")
-		}
-		return http.StatusOK, nil
-	} else {
-		return http.StatusBadRequest, errors.New("no dynamic source configured")
-	}
-}
-
 // Checks if IP in CIDR range, or directly equal
 func ipInCIDR(ipStr, cidrOrIPStr string) (bool, error) {
 	userIP := net.ParseIP(ipStr)
@@ -146,78 +144,35 @@ func ipInCIDR(ipStr, cidrOrIPStr string) (bool, error) {
 }
 
 func parseDenylistRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
-	ipsRaw, ipsExist := raw["ips"]
-	cidrsRaw, cidrsExist := raw["cidrs"]
-	sourceListRaw, sourceListExists := raw["sourceList"]
-
-	if !sourceListExists {
-		return util.NamedRiskHandler{}, errors.New("denylist: must provide source")
-	}
-
-	sourceList, ok := sourceListRaw.(string)
-	if !ok {
-		return util.NamedRiskHandler{}, errors.New("denylist: source list configuration must be a string")
-	}
-
-	if sourceList != "static" && sourceList != util.Services.Redis {
-		return util.NamedRiskHandler{}, errors.New("denylist: invalid source list")
+	var params denylistParams
+	if err := decodeParams(util.Rules.Denylist, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
 	}
 
+	sourceList, strategy := params.SourceList, params.Strategy
 	denylistConfig.sourceList = sourceList
 
-	if sourceList == "static" && !ipsExist && !cidrsExist {
+	if sourceList == "static" && params.IPs == nil && params.CIDRs == nil {
 		return util.NamedRiskHandler{}, errors.New("denylist: must provide a static ip list when source is static")
 	}
 
-	ipsList, ok := ipsRaw.([]interface{})
-	if ipsExist && !ok {
-		return util.NamedRiskHandler{}, errors.New("denylist: denylisted IPs must be a list")
-	}
+	ips := make([]string, 0, len(params.IPs))
+	cidrs := make([]string, 0, len(params.CIDRs))
 
-	cidrList, ok := cidrsRaw.([]interface{})
-	if cidrsExist && !ok {
-		return util.NamedRiskHandler{}, errors.New("denylist: denylisted CIDRs must be a list")
-	}
-
-	strategy, ok := raw["strategy"].(string)
-	if !ok || !util.IsValidStrategy(strategy) {
-		return util.NamedRiskHandler{}, errors.New("denylist: missing or invalid strategy")
-	}
-
-	// Convert []interface{} to []string
-	ips := make([]string, 0, len(ipsList))
-	cidrs := make([]string, 0, len(cidrList))
-
-	for _, item := range cidrList {
-		cidr, ok := item.(string)
-		if !ok {
-			return util.NamedRiskHandler{}, errors.New("denylist: denylistedIPs must be strings")
-		}
+	for _, cidr := range params.CIDRs {
 		_, ipNet, cidrParseErr := net.ParseCIDR(cidr)
 		if cidrParseErr != nil {
 			return util.NamedRiskHandler{}, errors.New("denylist: could not parse CIDR")
 		}
 		cidrs = append(cidrs, ipNet.String())
-		if sourceList == util.Services.Redis {
-			ctx := context.TODO()
-			services.RedisClient.SAdd(ctx, "denylist:cidrs", cidrs)
-		}
 	}
 
-	for _, item := range ipsList {
-		ip, ok := item.(string)
-		if !ok {
-			return util.NamedRiskHandler{}, errors.New("denylist: denylistedIPs must be strings")
-		}
+	for _, ip := range params.IPs {
 		targetIP := net.ParseIP(ip)
 		if targetIP == nil {
 			return util.NamedRiskHandler{}, errors.New("denylist: invalid ip address provided, provide an ip")
 		}
 		ips = append(ips, targetIP.String())
-		if sourceList == util.Services.Redis {
-			ctx := context.TODO()
-			services.RedisClient.SAdd(ctx, "denylist:ips", ips)
-		}
 	}
 
 	// Once all parsers have passed, indicate the rule is properly configured
@@ -228,6 +183,27 @@ func parseDenylistRule(raw map[string]interface{}) (util.NamedRiskHandler, error
 	return util.NamedRiskHandler{
 		Name:     util.Rules.Denylist,
 		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.IP {
+				return nil, nil
+			}
+			matches := []string{}
+			for _, paramType := range []string{"ips", "cidrs"} {
+				entries, _, err := GetDenylistParams(ctx, paramType)
+				if err != nil {
+					return nil, err
+				}
+				for _, entry := range entries {
+					if inRange, err := ipInCIDR(id, entry); err == nil && inRange {
+						matches = append(matches, entry)
+					}
+				}
+			}
+			return map[string]interface{}{
+				"denylisted": len(matches) > 0,
+				"matches":    matches,
+			}, nil
+		},
 		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
 			base := util.RiskResult{
 				Name:     util.Rules.Denylist,
@@ -0,0 +1,189 @@
+package rules
+
+import (
+	"context"
+	"math"
+	"rba/services"
+	"rba/util"
+	"strconv"
+	"time"
+)
+
+func init() {
+	Register(RuleType{
+		Name:          util.Rules.EntityRisk,
+		Params:        paramSchema(entityRiskParams{}),
+		RequiresState: true,
+		Events:        util.AllEvents,
+		Parse:         fixedEvents(parseEntityRiskRule),
+	})
+}
+
+type entityRiskParams struct {
+	HalfLife  time.Duration `param:"halfLifeSeconds,required" min:"1"`
+	Threshold float64       `param:"threshold,required" min:"0.01"`
+	strategyParams
+}
+
+// Entries are dropped after this many half-lives, by which point less than 0.1% of the score remains
+const entityRiskTTLHalfLives = 10
+
+// Entity types risk is accumulated for, matching the event data field they are read from
+var entityRiskTypes = []string{util.Entities.Account, util.Entities.IP, util.Entities.Device}
+
+func entityRiskKey(ctx context.Context, entityType string, id string) string {
+	return stateKey(ctx, "entityRisk:%s:%s", entityType, id)
+}
+
+func knownDevicesKey(ctx context.Context, account string) string {
+	return stateKey(ctx, "entityRisk:knownDevices:%s", account)
+}
+
+// decayRisk applies exponential decay to a score last updated elapsed ago
+func decayRisk(score float64, elapsed time.Duration, halfLife time.Duration) float64 {
+	if elapsed <= 0 {
+		return score
+	}
+	return score * math.Exp2(-elapsed.Seconds()/halfLife.Seconds())
+}
+
+// GetEntityRisk returns the decayed accumulated risk for an entity, or 0 if nothing is held for it
+func GetEntityRisk(ctx context.Context, entityType string, id string, halfLife time.Duration) (float64, error) {
+	values, err := services.State.GetFields(ctx, entityRiskKey(ctx, entityType, id), "score", "updatedAt")
+	if err != nil {
+		return 0, err
+	}
+
+	scoreRaw, ok := values["score"]
+	if !ok {
+		return 0, nil
+	}
+	updatedRaw := values["updatedAt"]
+
+	score, err := strconv.ParseFloat(scoreRaw, 64)
+	if err != nil {
+		return 0, err
+	}
+	updatedAt, err := strconv.ParseInt(updatedRaw, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	elapsed := util.EventTimeFromContext(ctx).Sub(time.UnixMilli(updatedAt))
+	return decayRisk(score, elapsed, halfLife), nil
+}
+
+// RecordEntityRisk adds an event's final risk to the accumulated score of the account, IP and device it came from,
+// and remembers the device as known for the account. The entityRisk rule runs it after each event is assessed. A late
+// event's risk is decayed to the time of the latest update rather than moving it back.
+func RecordEntityRisk(ctx context.Context, args map[string]interface{}, risk float64, halfLife time.Duration) error {
+	ttl := entityRiskTTLHalfLives * halfLife
+	account, accountErr := util.GetStringField(args, util.Entities.Account)
+	device, deviceErr := util.GetStringField(args, util.Entities.Device)
+	if accountErr == nil && deviceErr == nil {
+		if _, err := services.State.AddToSet(ctx, knownDevicesKey(ctx, account), ttl, device); err != nil {
+			return err
+		}
+	}
+
+	if risk <= 0 {
+		return nil
+	}
+
+	for _, entityType := range entityRiskTypes {
+		id, err := util.GetStringField(args, entityType)
+		if err != nil {
+			continue
+		}
+
+		// Decayed and added in one step so concurrent events don't lose each other's risk
+		at := util.EventTimeFromContext(ctx).UnixMilli()
+		if _, err := services.State.AddDecaying(ctx, entityRiskKey(ctx, entityType, id), at, risk, halfLife, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspectEntityRisk reports the accumulated risk for an entity, and the devices seen for an account
+func inspectEntityRisk(ctx context.Context, entityType string, id string, halfLife time.Duration) (map[string]interface{}, error) {
+	risk, err := GetEntityRisk(ctx, entityType, id, halfLife)
+	if err != nil {
+		return nil, err
+	}
+	profile := map[string]interface{}{"risk": risk}
+
+	if entityType == util.Entities.Account {
+		devices, err := services.State.SetMembers(ctx, knownDevicesKey(ctx, id))
+		if err != nil {
+			return nil, err
+		}
+		profile["knownDevices"] = devices
+	}
+	return profile, nil
+}
+
+// EvaluateEntityRisk scores the highest accumulated risk of the account, IP and device against the threshold.
+// The score scales linearly, reaching 1 once the accumulated risk meets the threshold.
+func EvaluateEntityRisk(ctx context.Context, ids map[string]string, threshold float64, halfLife time.Duration) (float64, error) {
+	var highest float64
+	for entityType, id := range ids {
+		risk, err := GetEntityRisk(ctx, entityType, id, halfLife)
+		if err != nil {
+			return 0, err
+		}
+		highest = math.Max(highest, risk)
+	}
+	return math.Min(highest/threshold, 1), nil
+}
+
+func parseEntityRiskRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
+	var params entityRiskParams
+	if err := decodeParams(util.Rules.EntityRisk, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
+	}
+
+	halfLife, threshold, strategy := params.HalfLife, params.Threshold, params.Strategy
+
+	return util.NamedRiskHandler{
+		Name:     util.Rules.EntityRisk,
+		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			return inspectEntityRisk(ctx, entityType, id, halfLife)
+		},
+		Record: func(ctx context.Context, args map[string]interface{}, risk float64) error {
+			return RecordEntityRisk(ctx, args, risk, halfLife)
+		},
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			base := util.RiskResult{
+				Name:     util.Rules.EntityRisk,
+				Strategy: strategy,
+				Score:    0,
+				Err:      nil,
+			}
+
+			ids := map[string]string{}
+			for _, entityType := range entityRiskTypes {
+				if id, err := util.GetStringField(args, entityType); err == nil {
+					ids[entityType] = id
+				}
+			}
+			if len(ids) == 0 {
+				errText := "missing ip, account or device"
+				result := base
+				result.Err = &errText
+				return result
+			}
+
+			score, redisErr := EvaluateEntityRisk(ctx, ids, threshold, halfLife)
+
+			result := base
+			result.Score = score
+			if redisErr != nil {
+				errText := redisErr.Error()
+				result.Err = &errText
+			}
+			return result
+		},
+	}, nil
+}
@@ -0,0 +1,62 @@
+package rules
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"rba/services"
+)
+
+func TestDecayRisk(t *testing.T) {
+	halfLife := time.Minute
+
+	if decayed := decayRisk(0.8, 0, halfLife); decayed != 0.8 {
+		t.Errorf("expected no decay with no elapsed time, got %v", decayed)
+	}
+	if decayed := decayRisk(0.8, halfLife, halfLife); math.Abs(decayed-0.4) > 1e-9 {
+		t.Errorf("expected score to halve after one half-life, got %v", decayed)
+	}
+	if decayed := decayRisk(0.8, 2*halfLife, halfLife); math.Abs(decayed-0.2) > 1e-9 {
+		t.Errorf("expected score to quarter after two half-lives, got %v", decayed)
+	}
+}
+
+func TestRecordEntityRisk(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		halfLife := time.Hour
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		args := map[string]interface{}{"ip": "1.2.3.4", "account": "alice"}
+
+		// Borderline events accumulate until they reach the threshold
+		for i := 0; i < 3; i++ {
+			score, err := EvaluateEntityRisk(ctx, map[string]string{"ip": "1.2.3.4", "account": "alice"}, 1.5, halfLife)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if score >= 1.0 {
+				t.Errorf("expected score below 1.0 after %d events, got %v", i, score)
+			}
+			if err := RecordEntityRisk(ctx, args, 0.5, halfLife); err != nil {
+				t.Fatalf("unexpected error recording risk: %v", err)
+			}
+		}
+
+		score, _ := EvaluateEntityRisk(ctx, map[string]string{"account": "alice"}, 1.5, halfLife)
+		if math.Abs(score-1.0) > 1e-3 {
+			t.Errorf("expected score 1.0 once accumulated risk reaches the threshold, got %v", score)
+		}
+
+		// Other accounts from a different IP are unaffected
+		score, _ = EvaluateEntityRisk(ctx, map[string]string{"ip": "5.6.7.8", "account": "bob"}, 1.5, halfLife)
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for an unrelated entity, got %v", score)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"rba/util"
+	"slices"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+)
+
+func init() {
+	Register(RuleType{
+		Name:   util.Rules.Expression,
+		Params: paramSchema(expressionParams{}),
+		Events: util.AllEvents,
+		Parse:  parseExpressionRule,
+	})
+}
+
+type expressionParams struct {
+	ID         string  `param:"id,required"`
+	Expression string  `param:"expression,required"`
+	Score      float64 `param:"score" default:"1" min:"0" max:"1"`
+	eventsParams
+	strategyParams
+}
+
+// Upper bound on the size of a compiled expression, keeps a single rule from being arbitrarily expensive to run
+const expressionMaxNodes = 1000
+
+// Variables set for every event, alongside the event data fields
+var expressionBuiltins = []string{"data", "event", "timestamp"}
+
+// builtinCollector records the built-in variables an expression reads
+type builtinCollector struct {
+	used []string
+}
+
+func (c *builtinCollector) Visit(node *ast.Node) {
+	if identifier, ok := (*node).(*ast.IdentifierNode); ok && slices.Contains(expressionBuiltins, identifier.Value) && !slices.Contains(c.used, identifier.Value) {
+		c.used = append(c.used, identifier.Value)
+	}
+}
+
+// builtinsRead returns the built-in variables a compiled expression reads
+func builtinsRead(program *vm.Program) []string {
+	collector := &builtinCollector{}
+	node := program.Node()
+	ast.Walk(&node, collector)
+	return collector.used
+}
+
+// checkBuiltinClash fails when the event has a data field named after a built-in variable the expression reads, since
+// the expression would silently get the built-in instead of the field
+func checkBuiltinClash(builtins []string, args map[string]interface{}) error {
+	for _, name := range builtins {
+		if _, clash := args[name]; clash {
+			return fmt.Errorf("event data field %s clashes with the built-in variable %s, read it as data[%q]", name, name, name)
+		}
+	}
+	return nil
+}
+
+// expressionEnv builds the variables an expression can reference. Event data fields are available directly and
+// under data, alongside the event name and the unix time the event happened. The built-ins take precedence, so
+// checkBuiltinClash must pass first.
+func expressionEnv(ctx context.Context, args map[string]interface{}) map[string]interface{} {
+	env := make(map[string]interface{}, len(args)+3)
+	for key, value := range args {
+		env[key] = value
+	}
+	env["data"] = args
+	env["event"] = util.EventFromContext(ctx)
+	env["timestamp"] = util.EventTimeFromContext(ctx).Unix()
+	return env
+}
+
+// EvaluateExpression runs a compiled expression and converts the result to a score.
+// Booleans score matchScore when true and 0 when false, numbers are clamped between 0 and 1.
+func EvaluateExpression(program *vm.Program, env map[string]interface{}, matchScore float64) (float64, error) {
+	output, err := expr.Run(program, env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := output.(type) {
+	case bool:
+		if v {
+			return matchScore, nil
+		}
+		return 0, nil
+	case int:
+		return math.Min(math.Max(float64(v), 0), 1), nil
+	case float64:
+		return math.Min(math.Max(v, 0), 1), nil
+	default:
+		return 0, fmt.Errorf("expression returned %T, expected a bool or number", output)
+	}
+}
+
+// parseExpressionRule compiles the expression once at load time and returns the handler along with the events it runs on
+func parseExpressionRule(raw map[string]interface{}) (util.NamedRiskHandler, []string, error) {
+	var params expressionParams
+	if err := decodeParams(util.Rules.Expression, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, nil, err
+	}
+
+	program, err := expr.Compile(
+		params.Expression,
+		expr.Env(map[string]interface{}{}),
+		expr.AllowUndefinedVariables(),
+		expr.MaxNodes(expressionMaxNodes),
+	)
+	if err != nil {
+		return util.NamedRiskHandler{}, nil, &ParamError{Rule: util.Rules.Expression, Key: "expression", Msg: fmt.Sprintf("%s failed to compile: %v", params.ID, err)}
+	}
+
+	events, err := resolveEvents(util.Rules.Expression, params.Events)
+	if err != nil {
+		return util.NamedRiskHandler{}, nil, err
+	}
+
+	id, matchScore, strategy := params.ID, params.Score, params.Strategy
+	builtins := builtinsRead(program)
+
+	return util.NamedRiskHandler{
+		Name:     id,
+		Strategy: strategy,
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			result := util.RiskResult{
+				Name:     id,
+				Strategy: strategy,
+				Score:    0,
+				Err:      nil,
+			}
+
+			if err := checkBuiltinClash(builtins, args); err != nil {
+				errText := err.Error()
+				result.Err = &errText
+				return result
+			}
+
+			score, err := EvaluateExpression(program, expressionEnv(ctx, args), matchScore)
+			result.Score = score
+			if err != nil {
+				errText := err.Error()
+				result.Err = &errText
+			}
+			return result
+		},
+	}, events, nil
+}
@@ -0,0 +1,128 @@
+package rules
+
+import (
+	"context"
+	"testing"
+
+	"rba/util"
+)
+
+func TestParseExpressionRule(t *testing.T) {
+	raw := map[string]interface{}{
+		"id":         "nonCanadianReset",
+		"expression": `country != "CA" && event == "password_reset_request"`,
+		"score":      0.7,
+		"events":     []interface{}{util.Events.PasswordResetRequest},
+		"strategy":   util.Strategies.Average,
+	}
+
+	handler, events, err := parseExpressionRule(raw)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+	if handler.Name != "nonCanadianReset" {
+		t.Errorf("expected rule name nonCanadianReset, got %s", handler.Name)
+	}
+	if len(events) != 1 || events[0] != util.Events.PasswordResetRequest {
+		t.Errorf("expected rule to run on password_reset_request only, got %v", events)
+	}
+
+	ctx := util.WithEvent(context.Background(), util.Events.PasswordResetRequest)
+
+	result := handler.Handler(ctx, map[string]interface{}{"country": "US"})
+	if result.Err != nil || result.Score != 0.7 {
+		t.Errorf("expected score 0.7 for a non Canadian reset, got %v (err %v)", result.Score, result.Err)
+	}
+
+	result = handler.Handler(ctx, map[string]interface{}{"country": "CA"})
+	if result.Err != nil || result.Score != 0 {
+		t.Errorf("expected score 0 for a Canadian reset, got %v (err %v)", result.Score, result.Err)
+	}
+}
+
+func TestParseExpressionRuleArithmetic(t *testing.T) {
+	raw := map[string]interface{}{
+		"id":         "failedAttempts",
+		"expression": `(data.failedAttempts ?? 0) / 10`,
+		"strategy":   util.Strategies.Average,
+	}
+
+	handler, events, err := parseExpressionRule(raw)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+	if len(events) != len(util.AllEvents) {
+		t.Errorf("expected rule to run on all events when none are listed, got %v", events)
+	}
+
+	result := handler.Handler(context.Background(), map[string]interface{}{"failedAttempts": float64(4)})
+	if result.Err != nil || result.Score != 0.4 {
+		t.Errorf("expected score 0.4, got %v (err %v)", result.Score, result.Err)
+	}
+
+	// Scores are clamped to 1
+	result = handler.Handler(context.Background(), map[string]interface{}{"failedAttempts": float64(40)})
+	if result.Score != 1 {
+		t.Errorf("expected score clamped to 1, got %v", result.Score)
+	}
+}
+
+func TestParseExpressionRuleEmptyID(t *testing.T) {
+	raw := map[string]interface{}{"id": "", "expression": "true", "strategy": util.Strategies.Average}
+	if _, _, err := parseExpressionRule(raw); err == nil {
+		t.Errorf("expected an empty id to fail")
+	}
+}
+
+func TestParseExpressionRuleCompileError(t *testing.T) {
+	raw := map[string]interface{}{
+		"id":         "broken",
+		"expression": `country != `,
+		"strategy":   util.Strategies.Average,
+	}
+	if _, _, err := parseExpressionRule(raw); err == nil {
+		t.Errorf("expected a compile error to fail the parse")
+	}
+
+	raw["expression"] = `true`
+	raw["events"] = []interface{}{"not_an_event"}
+	if _, _, err := parseExpressionRule(raw); err == nil {
+		t.Errorf("expected an unknown event to fail the parse")
+	}
+}
+
+func TestExpressionBuiltinClash(t *testing.T) {
+	raw := map[string]interface{}{
+		"id":         "resetEvent",
+		"expression": `event == "password_reset_request"`,
+		"strategy":   util.Strategies.Average,
+	}
+	handler, _, err := parseExpressionRule(raw)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+	ctx := util.WithEvent(context.Background(), util.Events.PasswordResetRequest)
+
+	result := handler.Handler(ctx, map[string]interface{}{"event": "signup"})
+	if result.Err == nil {
+		t.Errorf("expected an error when a data field clashes with a built-in the expression reads, got score %v", result.Score)
+	}
+
+	// A data field named after a built-in the expression doesn't read is no clash
+	result = handler.Handler(ctx, map[string]interface{}{"timestamp": "yesterday"})
+	if result.Err != nil || result.Score != 1 {
+		t.Errorf("expected score 1 when the clashing field isn't read, got %v (err %v)", result.Score, result.Err)
+	}
+
+	// The field can still be read under data
+	raw["expression"] = `data["event"] == "signup"`
+	if handler, _, err = parseExpressionRule(raw); err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+	if result := handler.Handler(ctx, map[string]interface{}{"data": 1}); result.Err == nil {
+		t.Errorf("expected a data field named data to clash with the data variable")
+	}
+	if result := handler.Handler(ctx, map[string]interface{}{"event": "signup"}); result.Err != nil || result.Score != 1 {
+		t.Errorf("expected the event field to be read under data, got %v (err %v)", result.Score, result.Err)
+	}
+}
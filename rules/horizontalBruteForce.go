@@ -2,15 +2,28 @@ package rules
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"rba/services"
 	"rba/util"
 	"time"
-	// "github.com/redis/go-redis/v9"
 )
 
-// EvaluateHorizontalBruteForceRisk checks Redis for suspicious login failures
+func init() {
+	Register(RuleType{
+		Name:          util.Rules.HorizontalBruteForce,
+		Params:        paramSchema(horizontalBruteForceParams{}),
+		RequiresState: true,
+		Events:        []string{util.Events.LoginFailure},
+		Parse:         fixedEvents(parseHorizontalBruteForceRule),
+	})
+}
+
+type horizontalBruteForceParams struct {
+	Interval         time.Duration `param:"intervalSeconds,required" min:"1"`
+	DistinctAccounts int           `param:"distinctAccounts,required" min:"1"`
+	strategyParams
+}
+
+// EvaluateHorizontalBruteForceRisk checks the state store for suspicious login failures
 // Counts distinct accounts per IP, not repeated attempts on the same account.
 func EvaluateHorizontalBruteForceRisk(
 	ctx context.Context,
@@ -20,17 +33,9 @@ func EvaluateHorizontalBruteForceRisk(
 	distinctAccounts int,
 ) (float64, error) {
 
-	// Track distinct accounts per IP using a Redis set
-	distinctKey := fmt.Sprintf("horizontalBruteForce:distinct:%s", ip)
-	if err := services.RedisClient.SAdd(ctx, distinctKey, account).Err(); err != nil {
-		return 0, err
-	}
-	if err := services.RedisClient.Expire(ctx, distinctKey, interval).Err(); err != nil {
-		return 0, err
-	}
-
-	// Fetch distinct account count
-	distinctCount, err := services.RedisClient.SCard(ctx, distinctKey).Result()
+	// Track distinct accounts per IP over the interval up to the event
+	distinctKey := stateKey(ctx, "horizontalBruteForce:accounts:%s", ip)
+	distinctCount, err := services.State.RecordDistinct(ctx, distinctKey, eventTime(ctx), account, interval, allowedLateness)
 	if err != nil {
 		return 0, err
 	}
@@ -43,27 +48,29 @@ func EvaluateHorizontalBruteForceRisk(
 }
 
 func parseHorizontalBruteForceRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
-	interval, ok := raw["intervalSeconds"].(int)
-	if redisErr := services.PingRedis(); redisErr != nil {
-		return util.NamedRiskHandler{}, errors.New("horizontalBruteForce: a valid redis connection is required for this rule. Check redis configuration")
-	}
-	if !ok {
-		return util.NamedRiskHandler{}, errors.New("horizontalBruteForce: missing or invalid intervalSeconds")
-	}
-
-	distinctAccounts, ok := raw["distinctAccounts"].(int)
-	if !ok {
-		return util.NamedRiskHandler{}, errors.New("horizontalBruteForce: missing or invalid distinctAccounts")
+	var params horizontalBruteForceParams
+	if err := decodeParams(util.Rules.HorizontalBruteForce, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
 	}
 
-	strategy, ok := raw["strategy"].(string)
-	if !ok || !util.IsValidStrategy(strategy) {
-		return util.NamedRiskHandler{}, errors.New("horizontalBruteForce: missing or invalid strategy")
-	}
+	interval, distinctAccounts, strategy := params.Interval, params.DistinctAccounts, params.Strategy
 
 	return util.NamedRiskHandler{
 		Name:     util.Rules.HorizontalBruteForce,
 		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.IP {
+				return nil, nil
+			}
+			accounts, err := services.State.DistinctMembers(ctx, stateKey(ctx, "horizontalBruteForce:accounts:%s", id), eventTime(ctx), interval)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"distinctAccounts": accounts,
+				"limit":            distinctAccounts,
+			}, nil
+		},
 		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
 			base := util.RiskResult{
 				Name:     util.Rules.HorizontalBruteForce,
@@ -92,7 +99,7 @@ func parseHorizontalBruteForceRule(raw map[string]interface{}) (util.NamedRiskHa
 				ctx,
 				ip,
 				account,
-				time.Duration(interval)*time.Second,
+				interval,
 				distinctAccounts,
 			)
 
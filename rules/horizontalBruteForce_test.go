@@ -2,43 +2,73 @@ package rules
 
 import (
 	"context"
-	"fmt"
+	"log"
 	"os"
 	"testing"
 	"time"
 
 	"rba/services"
+	"rba/state"
 	"rba/util"
 
 	"github.com/redis/go-redis/v9"
 )
 
-// TestMain runs before all tests. It sets up a Redis client using env vars.
+// windowStart is the event time of windowed rule tests, so what they count doesn't depend on when they run
+var windowStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// redisState is the redis store rule tests run against besides memory, nil when redis isn't available
+var redisState state.Store
+
+// TestMain connects to redis on database 5, apart from the other packages' tests which may run at the same time.
+// Rules keep their state in memory unless a test runs against each store.
 func TestMain(m *testing.M) {
 	addr := os.Getenv("REDIS_ADDR")
 	if addr == "" {
 		addr = "localhost:6379"
 	}
 
-	services.RedisClient = redis.NewClient(&redis.Options{
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{
 		Addr: addr,
+		DB:   5,
 	})
-
-	ctx := context.Background()
-	if err := services.RedisClient.Ping(ctx).Err(); err != nil {
-		panic(fmt.Sprintf("failed to connect to redis at %s: %v", addr, err))
-	}
-
-	// wipe all keys before tests
-	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
-		panic(fmt.Sprintf("failed to flush redis before tests: %v", err))
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Printf("redis is not available at %s, rule state is only tested in memory: %v", addr, err)
+	} else {
+		store := state.NewRedis(client, "")
+		if err := store.Preload(ctx); err != nil {
+			log.Fatalf("failed to preload scripts: %v", err)
+		}
+		redisState = store
 	}
 
+	services.State = state.NewMemory()
 	code := m.Run()
-	services.RedisClient.Close()
+	client.Close()
 	os.Exit(code)
 }
 
+// eachStore runs a test with the rule state in redis and then in memory, which should behave the same. The redis run is
+// skipped when redis isn't available.
+func eachStore(t *testing.T, test func(t *testing.T)) {
+	defer func(store state.Store) {
+		services.State = store
+	}(services.State)
+
+	t.Run("redis", func(t *testing.T) {
+		if redisState == nil {
+			t.Skip("redis is not available")
+		}
+		services.State = redisState
+		test(t)
+	})
+	t.Run("memory", func(t *testing.T) {
+		services.State = state.NewMemory()
+		test(t)
+	})
+}
+
 func TestParseHorizontalBruteForceRule(t *testing.T) {
 	raw := map[string]interface{}{
 		"intervalSeconds":  10,
@@ -60,43 +90,81 @@ func TestParseHorizontalBruteForceRule(t *testing.T) {
 }
 
 func TestEvaluateHorizontalBruteForceRisk(t *testing.T) {
-	ctx := context.Background()
-	ip := "1.2.3.4"
-	interval := 2 * time.Second
-	distinctAccounts := 3
-
-	// clear key before test
-	if err := services.RedisClient.FlushDB(ctx).Err(); err != nil {
-		t.Fatalf("failed to flush redis: %v", err)
-	}
-
-	// First attempt on "alice" should not exceed threshold
-	score, err := EvaluateHorizontalBruteForceRisk(ctx, ip, "alice", interval, distinctAccounts)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if score != 0.0 {
-		t.Errorf("expected score 0.0, got %v", score)
-	}
-
-	// Multiple attempts on the same account ("alice") should still count as 1 distinct account
-	for i := 0; i < 3; i++ {
-		_, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "alice", interval, distinctAccounts)
-	}
-	score, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "alice", interval, distinctAccounts)
-	if score != 0.0 {
-		t.Errorf("expected score 0.0 for repeated alice attempts, got %v", score)
-	}
-
-	// Add a second distinct account ("bob") from the same IP
-	score, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "bob", interval, distinctAccounts)
-	if score != 0.0 {
-		t.Errorf("expected score 0.0 when alice+bob are within distinctAccounts threshold, got %v", score)
-	}
+	eachStore(t, func(t *testing.T) {
+		ctx := util.WithEventTime(context.Background(), windowStart)
+		ip := "1.2.3.4"
+		interval := 2 * time.Second
+		distinctAccounts := 3
+
+		// clear key before test
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// First attempt on "alice" should not exceed threshold
+		score, err := EvaluateHorizontalBruteForceRisk(ctx, ip, "alice", interval, distinctAccounts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if score != 0.0 {
+			t.Errorf("expected score 0.0, got %v", score)
+		}
+
+		// Multiple attempts on the same account ("alice") should still count as 1 distinct account
+		for i := 0; i < 3; i++ {
+			_, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "alice", interval, distinctAccounts)
+		}
+		score, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "alice", interval, distinctAccounts)
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for repeated alice attempts, got %v", score)
+		}
+
+		// Add a second distinct account ("bob") from the same IP
+		score, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "bob", interval, distinctAccounts)
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 when alice+bob are within distinctAccounts threshold, got %v", score)
+		}
+
+		// Add a third distinct account ("charlie") from the same IP
+		score, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "charlie", interval, distinctAccounts)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 when alice+bob+charlie exceed distinctAccounts threshold, got %v", score)
+		}
+	})
+}
 
-	// Add a third distinct account ("charlie") from the same IP
-	score, _ = EvaluateHorizontalBruteForceRisk(ctx, ip, "charlie", interval, distinctAccounts)
-	if score != 1.0 {
-		t.Errorf("expected score 1.0 when alice+bob+charlie exceed distinctAccounts threshold, got %v", score)
-	}
+func TestHorizontalBruteForceEventTimeWindows(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		ip := "1.2.3.5"
+		interval := time.Minute
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// Events replayed from the past are counted over the interval up to when they happened, not when they are processed
+		at := func(offset time.Duration) context.Context {
+			return util.WithEventTime(ctx, windowStart.Add(offset))
+		}
+		_, _ = EvaluateHorizontalBruteForceRisk(at(0), ip, "alice", interval, 2)
+		score, _ := EvaluateHorizontalBruteForceRisk(at(2*time.Minute), ip, "bob", interval, 2)
+		if score != 0.0 {
+			t.Errorf("expected accounts further apart than the interval not to be counted together, got %v", score)
+		}
+
+		// A late event is counted against the accounts tried in the interval before it
+		score, _ = EvaluateHorizontalBruteForceRisk(at(30*time.Second), ip, "bob", interval, 2)
+		if score != 1.0 {
+			t.Errorf("expected a late event to be counted when it happened, got %v", score)
+		}
+
+		// Attempts either side of a minute boundary are still within one interval
+		straddling := "1.2.3.6"
+		_, _ = EvaluateHorizontalBruteForceRisk(at(5*time.Minute+50*time.Second), straddling, "alice", interval, 2)
+		score, _ = EvaluateHorizontalBruteForceRisk(at(6*time.Minute+10*time.Second), straddling, "bob", interval, 2)
+		if score != 1.0 {
+			t.Errorf("expected attempts straddling a minute boundary to be counted together, got %v", score)
+		}
+	})
 }
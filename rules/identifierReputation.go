@@ -0,0 +1,276 @@
+package rules
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"rba/audit"
+	"rba/services"
+	"rba/util"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register(RuleType{
+		Name:          util.Rules.IdentifierReputation,
+		Params:        paramSchema(identifierReputationParams{}),
+		RequiresState: true,
+		Events:        []string{util.Events.PasswordResetRequest, util.Events.Registration},
+		Parse:         fixedEvents(parseIdentifierReputationRule),
+		PrimaryOnly:   true,
+	})
+}
+
+type identifierReputationParams struct {
+	Interval       time.Duration `param:"intervalSeconds,required" min:"1"`
+	MaxVariants    int           `param:"maxVariants,required" min:"1"`
+	DomainListPath string        `param:"domainListPath"`
+	Domains        []string      `param:"domains"`
+	Patterns       []string      `param:"patterns"`
+	strategyParams
+}
+
+// Redis set of denylisted identifiers, changed through the configuration API alongside the audit log
+var identifierDenylistKey = audit.ConfigKey("identifierReputation:denylist")
+
+// Read-only configuration, should not be changed after initial parse. Used by the admin router to know the rule is active.
+type identifierReputationConfigT struct {
+	configured bool
+}
+
+var identifierReputationConfig = identifierReputationConfigT{}
+
+// Trailing digits on the local part, e.g. the 123 in jsmith123@example.com
+var numericSuffix = regexp.MustCompile(`[0-9]+$`)
+
+// normalizeIdentifier lowercases and trims an identifier so denylist entries match regardless of case
+func normalizeIdentifier(identifier string) string {
+	return strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// identifierBase strips plus addressing tags and numeric suffixes from the local part, so that
+// jsmith+1@example.com and jsmith42@example.com both reduce to jsmith@example.com
+func identifierBase(identifier string) string {
+	local, domain, hasDomain := strings.Cut(normalizeIdentifier(identifier), "@")
+	local, _, _ = strings.Cut(local, "+")
+	local = numericSuffix.ReplaceAllString(local, "")
+	if !hasDomain {
+		return local
+	}
+	return local + "@" + domain
+}
+
+// isDisposableDomain checks the identifier's email domain, and any parent domain, against the disposable list
+func isDisposableDomain(identifier string, domains map[string]bool) bool {
+	_, domain, ok := strings.Cut(normalizeIdentifier(identifier), "@")
+	if !ok {
+		return false
+	}
+	for domain != "" {
+		if domains[domain] {
+			return true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+// loadDomainList reads one domain per line, skipping blank lines and # comments
+func loadDomainList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, strings.ToLower(line))
+	}
+	return domains, scanner.Err()
+}
+
+// IdentifierDenylistChange validates an add or remove of an identifier on the denylist and returns the change to make,
+// with the identifier normalized. The configuration API makes it with audit.Apply, so it is recorded in the same
+// transaction.
+func IdentifierDenylistChange(identifier string, operation string) (audit.SetChange, int, error) {
+	if operation != "add" && operation != "remove" {
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("must provide add or remove for the operation")
+	}
+
+	if !identifierReputationConfig.configured {
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("identifierReputation is not configured")
+	}
+	if err := listsInRedis(); err != nil {
+		return audit.SetChange{}, http.StatusServiceUnavailable, err
+	}
+
+	identifier = normalizeIdentifier(identifier)
+	if identifier == "" {
+		return audit.SetChange{}, http.StatusBadRequest, errors.New("must provide an identifier")
+	}
+	return audit.SetChange{Key: identifierDenylistKey, Member: identifier, Remove: operation == "remove"}, http.StatusOK, nil
+}
+
+func GetIdentifierDenylist(ctx context.Context) ([]string, int, error) {
+	if !identifierReputationConfig.configured {
+		return nil, http.StatusBadRequest, errors.New("identifierReputation is not configured")
+	}
+
+	result, err := services.State.SetMembers(ctx, identifierDenylistKey)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed to fetch list from redis")
+	}
+	return result, http.StatusOK, nil
+}
+
+// IdentifierDenylisted reports whether an identifier is on the denylist once normalized
+func IdentifierDenylisted(ctx context.Context, identifier string) (bool, error) {
+	if !identifierReputationConfig.configured {
+		return false, errors.New("identifierReputation is not configured")
+	}
+	return services.State.IsMember(ctx, identifierDenylistKey, normalizeIdentifier(identifier))
+}
+
+// EvaluateIdentifierReputationRisk fails identifiers that are denylisted, use a disposable email domain, match a
+// suspicious pattern, or are one of too many variants of the same base identifier over the interval
+func EvaluateIdentifierReputationRisk(
+	ctx context.Context,
+	identifier string,
+	domains map[string]bool,
+	patterns []*regexp.Regexp,
+	interval time.Duration,
+	maxVariants int,
+) (float64, error) {
+	normalized := normalizeIdentifier(identifier)
+
+	denylisted, err := services.State.IsMember(ctx, identifierDenylistKey, normalized)
+	if err != nil {
+		return 0, err
+	}
+	if denylisted || isDisposableDomain(normalized, domains) {
+		return 1.0, nil
+	}
+
+	for _, pattern := range patterns {
+		if pattern.MatchString(normalized) {
+			return 1.0, nil
+		}
+	}
+
+	variantsKey := stateKey(ctx, "identifierReputation:recentVariants:%s", identifierBase(normalized))
+	variants, err := services.State.RecordDistinct(ctx, variantsKey, eventTime(ctx), normalized, interval, allowedLateness)
+	if err != nil {
+		return 0, err
+	}
+	if int(variants) > maxVariants {
+		return 1.0, nil
+	}
+	return 0.0, nil
+}
+
+func parseIdentifierReputationRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
+	var params identifierReputationParams
+	if err := decodeParams(util.Rules.IdentifierReputation, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
+	}
+
+	interval, maxVariants, strategy := params.Interval, params.MaxVariants, params.Strategy
+
+	domains := map[string]bool{}
+	if params.DomainListPath != "" {
+		list, err := loadDomainList(params.DomainListPath)
+		if err != nil {
+			return util.NamedRiskHandler{}, &ParamError{Rule: util.Rules.IdentifierReputation, Key: "domainListPath", Msg: fmt.Sprintf("could not load domain list: %v", err)}
+		}
+		for _, domain := range list {
+			domains[domain] = true
+		}
+	}
+	for _, domain := range params.Domains {
+		domains[strings.ToLower(domain)] = true
+	}
+
+	var patterns []*regexp.Regexp
+	for _, expr := range params.Patterns {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return util.NamedRiskHandler{}, &ParamError{Rule: util.Rules.IdentifierReputation, Key: "patterns", Msg: fmt.Sprintf("invalid pattern %q: %v", expr, err)}
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	// Once all parsers have passed, indicate the rule is properly configured
+	identifierReputationConfig.configured = true
+
+	return util.NamedRiskHandler{
+		Name:     util.Rules.IdentifierReputation,
+		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.Account {
+				return nil, nil
+			}
+			normalized := normalizeIdentifier(id)
+			denylisted, err := services.State.IsMember(ctx, identifierDenylistKey, normalized)
+			if err != nil {
+				return nil, err
+			}
+			variants, err := services.State.DistinctMembers(ctx, stateKey(ctx, "identifierReputation:recentVariants:%s", identifierBase(normalized)), eventTime(ctx), interval)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"denylisted":       denylisted,
+				"disposableDomain": isDisposableDomain(normalized, domains),
+				"variants":         variants,
+			}, nil
+		},
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			base := util.RiskResult{
+				Name:     util.Rules.IdentifierReputation,
+				Strategy: strategy,
+				Score:    0,
+				Err:      nil,
+			}
+
+			identifier, err := util.GetStringField(args, "identifier")
+			if err != nil {
+				errText := "missing identifier"
+				result := base
+				result.Err = &errText
+				return result
+			}
+
+			score, redisErr := EvaluateIdentifierReputationRisk(
+				ctx,
+				identifier,
+				domains,
+				patterns,
+				interval,
+				maxVariants,
+			)
+
+			result := base
+			result.Score = score
+			if redisErr != nil {
+				errText := redisErr.Error()
+				result.Err = &errText
+			}
+			return result
+		},
+	}, nil
+}
@@ -0,0 +1,94 @@
+package rules
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+)
+
+func TestIdentifierBase(t *testing.T) {
+	cases := map[string]string{
+		"JSmith@Example.com":       "jsmith@example.com",
+		"jsmith+promo@example.com": "jsmith@example.com",
+		"jsmith1234@example.com":   "jsmith@example.com",
+		"jsmith+1@example.com":     "jsmith@example.com",
+		"jsmith99":                 "jsmith",
+	}
+	for identifier, expected := range cases {
+		if base := identifierBase(identifier); base != expected {
+			t.Errorf("expected base %s for %s, got %s", expected, identifier, base)
+		}
+	}
+}
+
+func TestEvaluateIdentifierReputationRisk(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := util.WithEventTime(context.Background(), windowStart)
+		interval := 2 * time.Second
+		domains := map[string]bool{"mailinator.com": true}
+		patterns := []*regexp.Regexp{regexp.MustCompile(`[0-9]{6,}@`)}
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		score, err := EvaluateIdentifierReputationRisk(ctx, "alice@example.com", domains, patterns, interval, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for a clean identifier, got %v", score)
+		}
+
+		// Disposable domains, including subdomains, are flagged
+		for _, identifier := range []string{"bob@mailinator.com", "bob@eu.Mailinator.com"} {
+			score, _ = EvaluateIdentifierReputationRisk(ctx, identifier, domains, patterns, interval, 2)
+			if score != 1.0 {
+				t.Errorf("expected score 1.0 for disposable identifier %s, got %v", identifier, score)
+			}
+		}
+
+		// Pattern matches are flagged
+		score, _ = EvaluateIdentifierReputationRisk(ctx, "carol1234567@example.com", domains, patterns, interval, 2)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 for a pattern match, got %v", score)
+		}
+
+		// Plus addressing and numeric suffix variants of one base are flagged past maxVariants
+		for _, identifier := range []string{"dave+a@example.com", "dave1@example.com"} {
+			score, _ = EvaluateIdentifierReputationRisk(ctx, identifier, domains, patterns, interval, 2)
+			if score != 0.0 {
+				t.Errorf("expected score 0.0 for %s within maxVariants, got %v", identifier, score)
+			}
+		}
+		score, _ = EvaluateIdentifierReputationRisk(ctx, "dave+b@example.com", domains, patterns, interval, 2)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 once maxVariants is exceeded, got %v", score)
+		}
+
+		// Denylisted identifiers are flagged regardless of case
+		identifierReputationConfig.configured = true
+		defer func(backend string) { stateBackend = backend }(stateBackend)
+		stateBackend = util.Services.Memory
+		if _, code, err := IdentifierDenylistChange("Erin@Example.com", "add"); err == nil || code != http.StatusServiceUnavailable {
+			t.Errorf("expected changes to need the redis state backend to be recorded with the audit log, got %d (err %v)", code, err)
+		}
+		stateBackend = util.Services.Redis
+		change, _, err := IdentifierDenylistChange("Erin@Example.com", "add")
+		if err != nil {
+			t.Fatalf("unexpected error validating the change: %v", err)
+		}
+		if _, err := services.State.AddToSet(ctx, change.Key, 0, change.Member); err != nil {
+			t.Fatalf("unexpected error adding to denylist: %v", err)
+		}
+		score, _ = EvaluateIdentifierReputationRisk(ctx, "erin@example.com", domains, patterns, interval, 2)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 for a denylisted identifier, got %v", score)
+		}
+	})
+}
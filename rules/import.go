@@ -1,105 +1,388 @@
 package rules
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"rba/assessments"
 	"rba/services"
+	"rba/state"
 	"rba/types"
 	"rba/util"
+	"slices"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Rules    []types.RuleConfig `yaml:"rules"`
-	Services ServicesConfig     `yaml:"services"`
+	Rules     []types.RuleConfig `yaml:"rules"`
+	Services  ServicesConfig     `yaml:"services"`
+	EventTime EventTimeConfig    `yaml:"eventTime"`
+	Tenancy   TenancyConfig      `yaml:"tenancy"`
+}
+
+type EventTimeConfig struct {
+	// How far behind the time it is received an event's timestamp may be. Defaults to 5 minutes when unset.
+	AllowedLatenessSeconds *int `yaml:"allowedLatenessSeconds"`
+}
+
+const defaultAllowedLateness = 5 * time.Minute
+
+// Read-only, set when the config is read
+var allowedLateness = defaultAllowedLateness
+
+// AllowedLateness returns how late an event may arrive and still be assessed at its own timestamp
+func AllowedLateness() time.Duration {
+	return allowedLateness
 }
 
 type ServicesConfig struct {
-	Redis RedisConfig `yaml:"redis"`
-	Nats  NatsConfig  `yaml:"nats"`
+	Redis       RedisConfig        `yaml:"redis"`
+	Nats        NatsConfig         `yaml:"nats"`
+	Assessments assessments.Config `yaml:"assessments"`
+	State       StateConfig        `yaml:"state"`
+}
+
+// StateConfig chooses where rules keep state between events
+type StateConfig struct {
+	// redis or memory, defaults to redis when it is enabled. Memory state is lost on restart and not shared between
+	// servers.
+	Backend string `yaml:"backend"`
+}
+
+// StateBackend returns the configured state backend, applying the default. It is empty when there is no state store.
+func (s ServicesConfig) StateBackend() string {
+	if s.State.Backend != "" {
+		return s.State.Backend
+	}
+	if s.Redis.Enabled {
+		return util.Services.Redis
+	}
+	return ""
 }
 
 type NatsConfig struct {
 	Url       string  `yaml:"url"`
 	Threshold float64 `yaml:"threshold"`
 	Enabled   bool    `yaml:"enabled"`
+	// Subject alerts are published to, defaults to alerts
+	Subject string `yaml:"subject"`
+}
+
+const defaultAlertSubject = "alerts"
+
+// AlertSubject returns the subject alerts are published to, applying the default
+func (n NatsConfig) AlertSubject() string {
+	if n.Subject != "" {
+		return n.Subject
+	}
+	return defaultAlertSubject
 }
 
 type RedisConfig struct {
 	Host    string `yaml:"host"`
 	Enabled bool   `yaml:"enabled"`
+	// Prepended to every key, so environments such as dev, test and prod can share a redis
+	KeyPrefix string `yaml:"keyPrefix"`
+	// Sentinel or cluster node addresses, used instead of host
+	Addrs []string `yaml:"addrs"`
+	DB    int      `yaml:"db"`
+	// Names of the environment variables holding the ACL username and password, REDIS_USERNAME and REDIS_PASSWORD
+	// when unset
+	UsernameEnv string              `yaml:"usernameEnv"`
+	PasswordEnv string              `yaml:"passwordEnv"`
+	Sentinel    RedisSentinelConfig `yaml:"sentinel"`
+	Cluster     bool                `yaml:"cluster"`
+	TLS         RedisTLSConfig      `yaml:"tls"`
+	// Connection pool and timeouts, go-redis defaults when 0
+	PoolSize       int `yaml:"poolSize"`
+	MinIdleConns   int `yaml:"minIdleConns"`
+	DialTimeoutMs  int `yaml:"dialTimeoutMs"`
+	ReadTimeoutMs  int `yaml:"readTimeoutMs"`
+	WriteTimeoutMs int `yaml:"writeTimeoutMs"`
+	// Stops rules calling redis while it is failing, so events aren't held up waiting for it
+	Breaker RedisBreakerConfig `yaml:"breaker"`
+}
+
+// RedisBreakerConfig sets when the circuit breaker around the rules' redis state opens and how long it stays open
+type RedisBreakerConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Consecutive failures or timeouts that open the breaker, defaults to 5
+	Failures int `yaml:"failures"`
+	// How long the breaker stays open before a call is let through to probe redis, defaults to 5000
+	CooldownMs int `yaml:"cooldownMs"`
+}
+
+// RedisSentinelConfig connects to the master a set of sentinels elects, listed in addrs
+type RedisSentinelConfig struct {
+	MasterName string `yaml:"masterName"`
+	// Names of the environment variables holding the sentinels' own credentials, REDIS_SENTINEL_USERNAME and
+	// REDIS_SENTINEL_PASSWORD when unset
+	UsernameEnv string `yaml:"usernameEnv"`
+	PasswordEnv string `yaml:"passwordEnv"`
+}
+
+type RedisTLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CA bundle to verify the server with, the system roots when unset
+	CAFile string `yaml:"caFile"`
+	// Client certificate and key for mutual TLS
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// Name to verify the server certificate against, when it differs from the address
+	ServerName string `yaml:"serverName"`
 }
 
 type Rule struct {
 	Name string
 }
 
-func LoadConfig(path string) (map[string][]util.NamedRiskHandler, ServicesConfig, error) {
-	var handlers = make(map[string][]util.NamedRiskHandler)
+// resolveEvents validates the events a rule is configured to run on, defaulting to all events
+func resolveEvents(rule string, configured []string) ([]string, error) {
+	if configured == nil {
+		return util.AllEvents, nil
+	}
+
+	events := make([]string, 0, len(configured))
+	for _, event := range configured {
+		if !util.IsValidEvent(event) {
+			return nil, &ParamError{Rule: rule, Key: "events", Msg: fmt.Sprintf("unknown event %q", event)}
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// ValidateConfig parses a rules file and builds its rules without connecting to any services, so a config can be
+// checked offline. Rules that keep state are only accepted when there is a state store.
+func ValidateConfig(path string) (map[string][]util.NamedRiskHandler, ServicesConfig, error) {
+	handlers, servicesConfig, _, err := readConfig(path, nil)
+	return handlers, servicesConfig, err
+}
+
+// readConfig parses and builds a rules file, also returning the rule types it uses. If set, override can change the
+// services config before it is validated.
+func readConfig(path string, override func(*ServicesConfig)) (map[string][]util.NamedRiskHandler, ServicesConfig, []RuleType, error) {
 	data, err := os.ReadFile(path)
 
 	var servicesConfig = ServicesConfig{}
 
 	if err != nil {
-		return nil, servicesConfig, err
+		return nil, servicesConfig, nil, err
 	}
 
 	// Parse the yaml into cfg. Then iterate through rules pushing to the provided parser
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		log.Println(err)
-		return nil, servicesConfig, err
+		return nil, servicesConfig, nil, err
 	}
 
 	servicesConfig = cfg.Services
+	if override != nil {
+		override(&servicesConfig)
+	}
+	if err := validateServices(servicesConfig); err != nil {
+		return nil, servicesConfig, nil, err
+	}
+
+	allowedLateness = defaultAllowedLateness
+	if lateness := cfg.EventTime.AllowedLatenessSeconds; lateness != nil {
+		if *lateness < 0 {
+			return nil, servicesConfig, nil, errors.New("eventTime: allowedLatenessSeconds must be at least 0")
+		}
+		allowedLateness = time.Duration(*lateness) * time.Second
+	}
+
+	if err := cfg.Tenancy.validate(); err != nil {
+		return nil, servicesConfig, nil, err
+	}
+	tenancy = cfg.Tenancy
+
+	handlers, used, err := buildRules(cfg.Rules, servicesConfig)
+	if err != nil {
+		return nil, servicesConfig, nil, err
+	}
+
+	rulesets, tenantUsed, err := buildRulesets(cfg.Tenancy, servicesConfig, handlers)
+	if err != nil {
+		return nil, servicesConfig, nil, err
+	}
+	tenantRulesets = rulesets
+	for _, ruleType := range tenantUsed {
+		used = addRuleType(used, ruleType)
+	}
+
+	return handlers, servicesConfig, used, nil
+}
+
+// buildRules builds each rule, grouping the handlers by the events they run on, and returns the rule types used
+func buildRules(rawRules []types.RuleConfig, servicesConfig ServicesConfig) (map[string][]util.NamedRiskHandler, []RuleType, error) {
+	handlers := make(map[string][]util.NamedRiskHandler)
+	var used []RuleType
+	for _, rawRule := range rawRules {
+		handler, events, err := buildRule(rawRule)
+		if err != nil {
+			return nil, nil, err
+		}
+		ruleType, _ := lookupRuleType(rawRule.Name)
+		if ruleType.RequiresState && servicesConfig.StateBackend() == "" {
+			return nil, nil, locateParamError(fmt.Errorf("%s: rule keeps state between events, enable services.redis or set services.state.backend to memory", rawRule.Name), rawRule.Line, nil)
+		}
+		used = addRuleType(used, ruleType)
+		for _, event := range events {
+			handlers[event] = append(handlers[event], handler)
+		}
+	}
+	return handlers, used, nil
+}
+
+// addRuleType adds a rule type to the ones used unless it is already there
+func addRuleType(used []RuleType, ruleType RuleType) []RuleType {
+	if slices.ContainsFunc(used, func(r RuleType) bool { return r.Name == ruleType.Name }) {
+		return used
+	}
+	return append(used, ruleType)
+}
 
-	// Parse Services and ensure connections setup.
+// validateServices checks the settings of the enabled services
+func validateServices(servicesConfig ServicesConfig) error {
 	if servicesConfig.Nats.Enabled {
 		if servicesConfig.Nats.Threshold < 0 || servicesConfig.Nats.Threshold > 1 {
-			panic("Threshold for publishing must be between 0 and 1")
+			return errors.New("threshold for publishing must be between 0 and 1")
 		}
 		if servicesConfig.Nats.Url == "" {
-			panic("Provide a valid nats URL")
-		}
-		_, err := services.ConnectNats(servicesConfig.Nats.Url)
-		if err != nil {
-			panic(err)
+			return errors.New("provide a valid nats URL")
 		}
 	}
 
 	if servicesConfig.Redis.Enabled {
-		if servicesConfig.Redis.Host == "" {
-			panic("Provide a valid redis host")
+		if err := servicesConfig.Redis.validate(); err != nil {
+			return err
+		}
+	}
+	switch servicesConfig.State.Backend {
+	case "", util.Services.Memory:
+	case util.Services.Redis:
+		if !servicesConfig.Redis.Enabled {
+			return errors.New("the redis state backend requires redis to be enabled")
+		}
+	default:
+		return fmt.Errorf("unknown state backend %q, must be redis or memory", servicesConfig.State.Backend)
+	}
+
+	return servicesConfig.Assessments.Validate(servicesConfig.Redis.Enabled)
+}
+
+// LoadConfig validates a rules file and connects to the services it enables
+func LoadConfig(path string) (map[string][]util.NamedRiskHandler, ServicesConfig, error) {
+	return loadConfig(path, nil)
+}
+
+// ReadServicesConfig reads the services of a rules file without building its rules or connecting to anything, so tools
+// can reach the same redis as the server with its credentials, TLS, sentinel or cluster settings and key prefix
+func ReadServicesConfig(path string) (ServicesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ServicesConfig{}, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return ServicesConfig{}, err
+	}
+	return cfg.Services, nil
+}
+
+// LoadReplayConfig loads a rules file for an offline replay. NATS is never connected, and rules keep state in memory,
+// or in the scratch redis server when scratch has a host or addrs, instead of the configured store.
+func LoadReplayConfig(path string, scratch RedisConfig) (map[string][]util.NamedRiskHandler, ServicesConfig, error) {
+	scratch.Enabled = scratch.Host != "" || len(scratch.Addrs) > 0
+	// A replay should score every event, so the scratch redis is never short-circuited
+	scratch.Breaker = RedisBreakerConfig{Disabled: true}
+
+	return loadConfig(path, func(servicesConfig *ServicesConfig) {
+		servicesConfig.Nats.Enabled = false
+		servicesConfig.Redis = scratch
+		servicesConfig.State.Backend = util.Services.Memory
+		if scratch.Enabled {
+			servicesConfig.State.Backend = util.Services.Redis
+		}
+		servicesConfig.Assessments = assessments.Config{Store: assessments.Backends.None}
+	})
+}
+
+func loadConfig(path string, override func(*ServicesConfig)) (map[string][]util.NamedRiskHandler, ServicesConfig, error) {
+	handlers, servicesConfig, ruleTypes, err := readConfig(path, override)
+	if err != nil {
+		log.Println(err)
+		return nil, servicesConfig, err
+	}
+
+	if servicesConfig.Nats.Enabled {
+		if _, err := services.ConnectNats(servicesConfig.Nats.Url); err != nil {
+			return nil, servicesConfig, err
 		}
-		_, err := services.ConnectRedis(servicesConfig.Redis.Host)
+	}
+
+	if servicesConfig.Redis.Enabled {
+		options, err := servicesConfig.Redis.Options()
 		if err != nil {
-			panic("Could not connect to redis. Please check configuration")
+			return nil, servicesConfig, fmt.Errorf("invalid redis configuration: %w", err)
+		}
+		if _, err := services.ConnectRedis(options); err != nil {
+			return nil, servicesConfig, fmt.Errorf("could not connect to redis, please check configuration: %w", err)
 		}
+		services.RedisKeyPrefix = servicesConfig.Redis.KeyPrefix
 	}
 
-	for _, rawRule := range cfg.Rules {
-		switch rawRule.Name {
-		case "velocity":
-			handler, err := parseVelocityRule(rawRule.Params)
-			if err != nil {
-				return nil, servicesConfig, err
-			}
-			handlers["login"] = append(handlers["login"], handler)
-		case "denylist":
-			handler, err := parseDenylistRule(rawRule.Params)
-			if err != nil {
-				return nil, servicesConfig, err
-			}
-			handlers["login"] = append(handlers["login"], handler)
-		case "horizontalBruteForce":
-			handler, err := parseHorizontalBruteForceRule(rawRule.Params)
-			if err != nil {
-				return nil, servicesConfig, err
-			}
-			handlers["login_failure"] = append(handlers["login_failure"], handler)
+	stateBackend = servicesConfig.StateBackend()
+	switch stateBackend {
+	case util.Services.Redis:
+		store := state.NewRedis(services.RedisClient, services.RedisKeyPrefix)
+		if err := store.Preload(context.Background()); err != nil {
+			return nil, servicesConfig, fmt.Errorf("could not load redis scripts: %w", err)
 		}
+		services.State = store
+		services.RedisBreaker = servicesConfig.Redis.Breaker.breaker()
+		if services.RedisBreaker != nil {
+			services.State = services.NewBreakerStore(store, services.RedisBreaker)
+		}
+	case util.Services.Memory:
+		services.State = state.NewMemory()
+	}
+
+	if err := setupRuleTypes(context.Background(), ruleTypes); err != nil {
+		return nil, servicesConfig, err
 	}
 
 	return handlers, servicesConfig, nil
 }
+
+// Where the rules keep their state, set by LoadConfig
+var stateBackend string
+
+// listsInRedis checks the lists managed through the configuration API are kept in redis, where changes to them are
+// written in one transaction with the audit log
+func listsInRedis() error {
+	if stateBackend != util.Services.Redis {
+		return errors.New("changing lists through the configuration API needs services.state.backend redis, so changes are written with the audit log")
+	}
+	return nil
+}
+
+// setupRuleTypes runs the Setup of each rule type used, once services are connected
+func setupRuleTypes(ctx context.Context, ruleTypes []RuleType) error {
+	for _, ruleType := range ruleTypes {
+		if ruleType.Setup == nil {
+			continue
+		}
+		if err := ruleType.Setup(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"rba/services"
+	"rba/util"
+	"strconv"
+	"time"
+)
+
+// stateKey builds the key for state a rule keeps, such as counters and windows. Keys are prefixed with the tenant in
+// ctx so tenants never see each other's counts, then with the namespace so a challenger ruleset never reads or changes
+// the champion's state. Lists managed through the configuration API, like the denylists, are shared and use neither.
+func stateKey(ctx context.Context, format string, args ...interface{}) string {
+	key := fmt.Sprintf(format, args...)
+	if namespace := util.NamespaceFromContext(ctx); namespace != "" {
+		key = namespace + ":" + key
+	}
+	if tenant := util.TenantFromContext(ctx); tenant != "" {
+		key = "tenant:" + tenant + ":" + key
+	}
+	return key
+}
+
+// shadowContext puts a shadow rule's state in a namespace of its own, nested in any namespace already in ctx, so a
+// shadow copy of an enforced rule never adds to the counts the enforced rule scores on
+func shadowContext(ctx context.Context, name string) context.Context {
+	namespace := "shadow:" + name
+	if parent := util.NamespaceFromContext(ctx); parent != "" {
+		namespace = parent + ":" + namespace
+	}
+	return util.WithNamespace(ctx, namespace)
+}
+
+// eventTime is the event time in ctx as a unix millisecond, which windowed state is kept by so replays and late events
+// count when the event happened rather than when it was processed
+func eventTime(ctx context.Context) int64 {
+	return util.EventTimeFromContext(ctx).UnixMilli()
+}
+
+// slidingFields adds increments to fields of a hash kept for each fixed window of the interval, and returns the fields
+// counted over the interval up to the event time in ctx: the event's window plus the share of the window before it still
+// inside the interval, as the slidingWindow velocity algorithm counts. A window's fields change together, so counts are
+// consistent with each other. With no increments the fields are only read.
+func slidingFields(ctx context.Context, key string, interval time.Duration, increments map[string]int64, fields ...string) (map[string]float64, error) {
+	at := eventTime(ctx)
+	size := interval.Milliseconds()
+	window := at / size
+
+	current := map[string]int64{}
+	currentKey := fmt.Sprintf("%s:%d", key, window)
+	if increments != nil {
+		// Kept until the next window, late events included, has used it as its previous one
+		counts, err := services.State.IncrementFields(ctx, currentKey, increments, 2*interval+allowedLateness)
+		if err != nil {
+			return nil, err
+		}
+		current = counts
+	} else if err := readIntFields(ctx, currentKey, fields, current); err != nil {
+		return nil, err
+	}
+	previous := map[string]int64{}
+	if err := readIntFields(ctx, fmt.Sprintf("%s:%d", key, window-1), fields, previous); err != nil {
+		return nil, err
+	}
+
+	overlap := float64(size-(at-window*size)) / float64(size)
+	counts := make(map[string]float64, len(fields))
+	for _, field := range fields {
+		counts[field] = float64(current[field]) + float64(previous[field])*overlap
+	}
+	return counts, nil
+}
+
+// readIntFields reads integer fields of a hash into counts, leaving out fields that aren't set
+func readIntFields(ctx context.Context, key string, fields []string, counts map[string]int64) error {
+	values, err := services.State.GetFields(ctx, key, fields...)
+	if err != nil {
+		return err
+	}
+	for field, value := range values {
+		counts[field], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return nil
+}
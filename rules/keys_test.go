@@ -0,0 +1,30 @@
+package rules
+
+import (
+	"context"
+	"testing"
+
+	"rba/util"
+)
+
+func TestStateKey(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		expect string
+	}{
+		{"default", ctx, "velocity:1.2.3.4"},
+		{"challenger", util.WithNamespace(ctx, challengerNamespace), "challenger:velocity:1.2.3.4"},
+		{"tenant", util.WithTenant(ctx, "portal"), "tenant:portal:velocity:1.2.3.4"},
+		{"tenant challenger", util.WithNamespace(util.WithTenant(ctx, "portal"), challengerNamespace), "tenant:portal:challenger:velocity:1.2.3.4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := stateKey(tt.ctx, "velocity:%s", "1.2.3.4"); key != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, key)
+			}
+		})
+	}
+}
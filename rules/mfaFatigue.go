@@ -0,0 +1,148 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"rba/services"
+	"rba/util"
+	"time"
+)
+
+func init() {
+	Register(RuleType{
+		Name:          util.Rules.MfaFatigue,
+		Params:        paramSchema(mfaFatigueParams{}),
+		RequiresState: true,
+		Events:        []string{util.Events.MfaChallenge, util.Events.MfaDenied, util.Events.MfaFailure, util.Events.Login},
+		Parse:         fixedEvents(parseMfaFatigueRule),
+	})
+}
+
+type mfaFatigueParams struct {
+	Interval   time.Duration `param:"intervalSeconds,required" min:"1"`
+	MaxPrompts int           `param:"maxPrompts,required" min:"1"`
+	MaxDenials int           `param:"maxDenials,required" min:"1"`
+	strategyParams
+}
+
+// EvaluateMfaFatigueRisk detects push bombing against a single account. Both limits are exceeded by going over them:
+// more than maxPrompts push prompts (mfa_challenge), or more than maxDenials denials and failures, in the interval are
+// flagged. A successful login after more than maxDenials denials is flagged as the user likely gave in to the prompts.
+// The flagged login ends the attempt, so the denials are cleared and the account isn't flagged for the rest of the
+// window. Logins that aren't flagged keep them, as the denials may still be followed by an accepted prompt.
+func EvaluateMfaFatigueRisk(
+	ctx context.Context,
+	event string,
+	account string,
+	interval time.Duration,
+	maxPrompts int,
+	maxDenials int,
+) (float64, error) {
+	now := util.EventTimeFromContext(ctx).UnixMilli()
+	promptsKey := stateKey(ctx, "mfaFatigue:prompts:%s", account)
+	denialsKey := stateKey(ctx, "mfaFatigue:denials:%s", account)
+
+	switch event {
+	case util.Events.MfaChallenge:
+		count, err := services.State.RecordInWindow(ctx, promptsKey, now, interval, allowedLateness)
+		if err != nil {
+			return 0, err
+		}
+		if count > int64(maxPrompts) {
+			return 1.0, nil
+		}
+	case util.Events.MfaDenied, util.Events.MfaFailure:
+		count, err := services.State.RecordInWindow(ctx, denialsKey, now, interval, allowedLateness)
+		if err != nil {
+			return 0, err
+		}
+		if count > int64(maxDenials) {
+			return 1.0, nil
+		}
+	case util.Events.Login:
+		count, err := services.State.CountInWindow(ctx, denialsKey, now, interval)
+		if err != nil {
+			return 0, err
+		}
+		if count > int64(maxDenials) {
+			if err := services.State.Delete(ctx, denialsKey); err != nil {
+				return 0, err
+			}
+			return 1.0, nil
+		}
+	default:
+		return 0, fmt.Errorf("unsupported event %q", event)
+	}
+
+	return 0.0, nil
+}
+
+func parseMfaFatigueRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
+	var params mfaFatigueParams
+	if err := decodeParams(util.Rules.MfaFatigue, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
+	}
+
+	interval, maxPrompts, maxDenials, strategy := params.Interval, params.MaxPrompts, params.MaxDenials, params.Strategy
+
+	return util.NamedRiskHandler{
+		Name:     util.Rules.MfaFatigue,
+		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.Account {
+				return nil, nil
+			}
+			now := util.EventTimeFromContext(ctx).UnixMilli()
+			prompts, err := services.State.CountInWindow(ctx, stateKey(ctx, "mfaFatigue:prompts:%s", id), now, interval)
+			if err != nil {
+				return nil, err
+			}
+			denials, err := services.State.CountInWindow(ctx, stateKey(ctx, "mfaFatigue:denials:%s", id), now, interval)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"prompts": prompts,
+				"denials": denials,
+			}, nil
+		},
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			base := util.RiskResult{
+				Name:     util.Rules.MfaFatigue,
+				Strategy: strategy,
+				Score:    0,
+				Err:      nil,
+			}
+
+			event := util.EventFromContext(ctx)
+			account, err := util.GetStringField(args, "account")
+			if err != nil {
+				// Logins without an account can't be tied to earlier denials, so there is nothing to assess
+				if event == util.Events.Login {
+					return base
+				}
+				errText := "missing account"
+				result := base
+				result.Err = &errText
+				return result
+			}
+
+			score, redisErr := EvaluateMfaFatigueRisk(
+				ctx,
+				event,
+				account,
+				interval,
+				maxPrompts,
+				maxDenials,
+			)
+
+			result := base
+			result.Score = score
+			if redisErr != nil {
+				errText := redisErr.Error()
+				result.Err = &errText
+			}
+			return result
+		},
+	}, nil
+}
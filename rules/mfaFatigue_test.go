@@ -0,0 +1,147 @@
+package rules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+)
+
+func TestParseMfaFatigueRule(t *testing.T) {
+	raw := map[string]interface{}{
+		"intervalSeconds": 60,
+		"maxPrompts":      3,
+		"maxDenials":      2,
+		"strategy":        util.Strategies.Average,
+	}
+
+	handler, err := parseMfaFatigueRule(raw)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+	if handler.Name != util.Rules.MfaFatigue {
+		t.Errorf("expected rule name %s, got %s", util.Rules.MfaFatigue, handler.Name)
+	}
+
+	delete(raw, "maxDenials")
+	if _, err := parseMfaFatigueRule(raw); err == nil {
+		t.Errorf("expected error when maxDenials is missing")
+	}
+}
+
+func TestEvaluateMfaFatigueRiskPushBombing(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		interval := 2 * time.Second
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// Three prompts are within the limit
+		for i := 0; i < 3; i++ {
+			score, err := EvaluateMfaFatigueRisk(ctx, util.Events.MfaChallenge, "alice", interval, 3, 5)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if score != 0.0 {
+				t.Errorf("expected score 0.0 for prompt %d, got %v", i+1, score)
+			}
+		}
+
+		// The fourth prompt in the window exceeds maxPrompts
+		score, _ := EvaluateMfaFatigueRisk(ctx, util.Events.MfaChallenge, "alice", interval, 3, 5)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 once maxPrompts is exceeded, got %v", score)
+		}
+
+		// Prompts are tracked per account
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.MfaChallenge, "bob", interval, 3, 5)
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for a different account, got %v", score)
+		}
+	})
+}
+
+func TestEvaluateMfaFatigueRiskAcceptAfterDenials(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		interval := 2 * time.Second
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// A login with no prior denials is fine
+		score, err := EvaluateMfaFatigueRisk(ctx, util.Events.Login, "alice", interval, 10, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for a clean login, got %v", score)
+		}
+
+		for i := 0; i < 2; i++ {
+			score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.MfaDenied, "alice", interval, 10, 2)
+			if score != 0.0 {
+				t.Errorf("expected score 0.0 for denial %d, within maxDenials, got %v", i+1, score)
+			}
+		}
+
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.MfaFailure, "alice", interval, 10, 2)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 once maxDenials is exceeded, got %v", score)
+		}
+
+		// Accepting the prompt after the denials is flagged
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.Login, "alice", interval, 10, 2)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 for a login after repeated denials, got %v", score)
+		}
+
+		// The login clears the denials, so the account isn't flagged for the rest of the window
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.Login, "alice", interval, 10, 2)
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for a login after the denials were cleared, got %v", score)
+		}
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.MfaDenied, "alice", interval, 10, 2)
+		if score != 0.0 {
+			t.Errorf("expected a denial after the login to start a new count, got %v", score)
+		}
+	})
+}
+
+func TestEvaluateMfaFatigueRiskLoginKeepsDenials(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		interval := 2 * time.Second
+
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			_, _ = EvaluateMfaFatigueRisk(ctx, util.Events.MfaDenied, "alice", interval, 10, 2)
+		}
+
+		// A login within maxDenials, such as one the push bomber doesn't control, isn't flagged and keeps the denials
+		score, err := EvaluateMfaFatigueRisk(ctx, util.Events.Login, "alice", interval, 10, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if score != 0.0 {
+			t.Errorf("expected score 0.0 for a login within maxDenials, got %v", score)
+		}
+
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.MfaDenied, "alice", interval, 10, 2)
+		if score != 1.0 {
+			t.Errorf("expected the denials before the login to be counted, got %v", score)
+		}
+		score, _ = EvaluateMfaFatigueRisk(ctx, util.Events.Login, "alice", interval, 10, 2)
+		if score != 1.0 {
+			t.Errorf("expected score 1.0 for accepting the prompt after the denials, got %v", score)
+		}
+	})
+}
@@ -0,0 +1,329 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Rule settings are declared as a struct and decoded from the rules.yaml map with decodeParams. Supported tags:
+
+	param:"name"           the setting's key in rules.yaml, add ",required" if it must be set. Required strings can't be empty.
+	default:"60"           used when the setting is missing
+	min:"1" max:"100"      inclusive bounds for int, number and duration settings
+	oneof:"a,b"            allowed values for string settings
+	unit:"ms"              for durations, the unit of plain numbers. Defaults to seconds. Strings like "5m" are always accepted.
+*/
+
+// strategyParams holds the setting every rule has, embed it in a rule's params struct
+type strategyParams struct {
+	Strategy string `param:"strategy,required" oneof:"override,average"`
+}
+
+// eventsParams holds the optional list of events for rules that can run on any event
+type eventsParams struct {
+	Events []string `param:"events"`
+}
+
+// ParamError is a problem with a rule's settings, located by rule, key and rules.yaml line
+type ParamError struct {
+	Rule string
+	Key  string
+	Line int
+	Msg  string
+}
+
+func (e *ParamError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	b.WriteString(e.Rule)
+	if e.Key != "" {
+		b.WriteString(": " + e.Key)
+	}
+	b.WriteString(": " + e.Msg)
+	return b.String()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// paramType names a field's type as it appears in rule schemas and error messages
+func paramType(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "duration"
+	case t.Kind() == reflect.Int:
+		return "int"
+	case t.Kind() == reflect.Float64:
+		return "number"
+	case t.Kind() == reflect.String:
+		return "string"
+	case t.Kind() == reflect.Bool:
+		return "bool"
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		return "list"
+	default:
+		panic(fmt.Sprintf("rules: unsupported param type %s", t))
+	}
+}
+
+// durationUnit returns the unit plain numbers are read in for a duration field
+func durationUnit(field reflect.StructField) time.Duration {
+	switch field.Tag.Get("unit") {
+	case "ms":
+		return time.Millisecond
+	case "m":
+		return time.Minute
+	case "h":
+		return time.Hour
+	default:
+		return time.Second
+	}
+}
+
+// convertParam converts a decoded yaml value into the field's type
+func convertParam(value interface{}, field reflect.StructField) (reflect.Value, error) {
+	t := field.Type
+	wrongType := fmt.Errorf("must be a %s, got %v", paramType(t), value)
+
+	switch {
+	case t == durationType:
+		switch v := value.(type) {
+		case int:
+			return reflect.ValueOf(time.Duration(v) * durationUnit(field)), nil
+		case float64:
+			return reflect.ValueOf(time.Duration(v * float64(durationUnit(field)))), nil
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("invalid duration %q, use a number or a value like 30s or 5m", v)
+			}
+			return reflect.ValueOf(d), nil
+		}
+	case t.Kind() == reflect.Int:
+		switch v := value.(type) {
+		case int:
+			return reflect.ValueOf(v), nil
+		case float64:
+			if v == math.Trunc(v) {
+				return reflect.ValueOf(int(v)), nil
+			}
+			return reflect.Value{}, fmt.Errorf("must be a whole number, got %v", v)
+		}
+	case t.Kind() == reflect.Float64:
+		switch v := value.(type) {
+		case int:
+			return reflect.ValueOf(float64(v)), nil
+		case float64:
+			return reflect.ValueOf(v), nil
+		}
+	case t.Kind() == reflect.String:
+		if v, ok := value.(string); ok {
+			return reflect.ValueOf(v), nil
+		}
+	case t.Kind() == reflect.Bool:
+		if v, ok := value.(bool); ok {
+			return reflect.ValueOf(v), nil
+		}
+	case t.Kind() == reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return reflect.Value{}, wrongType
+		}
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("must be a list of strings, got %v", item)
+			}
+			out = append(out, s)
+		}
+		return reflect.ValueOf(out), nil
+	}
+	return reflect.Value{}, wrongType
+}
+
+// parseTagValue reads a default, min or max from a struct tag the same way a rules.yaml value would be read
+func parseTagValue(tag string, field reflect.StructField) (reflect.Value, error) {
+	if field.Type.Kind() == reflect.Slice {
+		var list []interface{}
+		for _, item := range strings.Split(tag, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+		return convertParam(list, field)
+	}
+
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(tag), &value); err != nil {
+		return reflect.Value{}, err
+	}
+	return convertParam(value, field)
+}
+
+// paramMagnitude returns a comparable value for int, number and duration fields
+func paramMagnitude(v reflect.Value) float64 {
+	if v.Kind() == reflect.Float64 {
+		return v.Float()
+	}
+	return float64(v.Int())
+}
+
+// checkBounds applies the min, max and oneof tags to a converted value
+func checkBounds(value reflect.Value, field reflect.StructField) error {
+	for _, bound := range []string{"min", "max"} {
+		tag, ok := field.Tag.Lookup(bound)
+		if !ok {
+			continue
+		}
+		limit, err := parseTagValue(tag, field)
+		if err != nil {
+			panic(fmt.Sprintf("rules: invalid %s tag on %s: %v", bound, field.Name, err))
+		}
+		if bound == "min" && paramMagnitude(value) < paramMagnitude(limit) {
+			return fmt.Errorf("must be at least %s, got %v", tag, value.Interface())
+		}
+		if bound == "max" && paramMagnitude(value) > paramMagnitude(limit) {
+			return fmt.Errorf("must be at most %s, got %v", tag, value.Interface())
+		}
+	}
+
+	if tag, ok := field.Tag.Lookup("oneof"); ok {
+		allowed := strings.Split(tag, ",")
+		if !slices.Contains(allowed, value.String()) {
+			return fmt.Errorf("must be one of %s, got %q", strings.Join(allowed, ", "), value.String())
+		}
+	}
+	return nil
+}
+
+// paramName reads the rules.yaml key and whether it is required from a field's param tag
+func paramName(field reflect.StructField) (string, bool) {
+	name, options, _ := strings.Cut(field.Tag.Get("param"), ",")
+	return name, options == "required"
+}
+
+// decodeParams fills out, a pointer to a params struct, from a rule's rules.yaml settings. Missing settings take their
+// default, and settings the struct doesn't declare are rejected.
+func decodeParams(rule string, raw map[string]interface{}, out interface{}) error {
+	known := map[string]bool{}
+	if err := decodeFields(rule, raw, reflect.ValueOf(out).Elem(), known); err != nil {
+		return err
+	}
+
+	var unknown []string
+	for key := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &ParamError{Rule: rule, Key: unknown[0], Msg: "unknown setting"}
+	}
+	return nil
+}
+
+// decodeFields decodes each tagged field of target, including those of embedded structs, recording the keys it knows
+func decodeFields(rule string, raw map[string]interface{}, target reflect.Value, known map[string]bool) error {
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := decodeFields(rule, raw, target.Field(i), known); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name, required := paramName(field)
+		if name == "" {
+			continue
+		}
+		known[name] = true
+
+		value, exists := raw[name]
+		if !exists || value == nil {
+			if required {
+				return &ParamError{Rule: rule, Key: name, Msg: "missing required setting"}
+			}
+			tag, hasDefault := field.Tag.Lookup("default")
+			if !hasDefault {
+				continue
+			}
+			converted, err := parseTagValue(tag, field)
+			if err != nil {
+				panic(fmt.Sprintf("rules: invalid default tag on %s: %v", field.Name, err))
+			}
+			target.Field(i).Set(converted)
+			continue
+		}
+
+		converted, err := convertParam(value, field)
+		if err == nil {
+			err = checkBounds(converted, field)
+		}
+		if err == nil && required && converted.Kind() == reflect.String && converted.String() == "" {
+			err = errors.New("must not be empty")
+		}
+		if err != nil {
+			return &ParamError{Rule: rule, Key: name, Msg: err.Error()}
+		}
+		target.Field(i).Set(converted)
+	}
+	return nil
+}
+
+// paramSchema describes the settings of a params struct for the registry
+func paramSchema(params interface{}) []Param {
+	return fieldSchema(reflect.TypeOf(params))
+}
+
+func fieldSchema(t reflect.Type) []Param {
+	schema := make([]Param, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			schema = append(schema, fieldSchema(field.Type)...)
+			continue
+		}
+		name, required := paramName(field)
+		if name == "" {
+			continue
+		}
+		schema = append(schema, Param{
+			Name:     name,
+			Type:     paramType(field.Type),
+			Required: required,
+			Default:  field.Tag.Get("default"),
+			Min:      field.Tag.Get("min"),
+			Max:      field.Tag.Get("max"),
+			OneOf:    field.Tag.Get("oneof"),
+		})
+	}
+	return schema
+}
+
+// locateParamError adds the rules.yaml line to a rule's error, using the offending key's line when it is known
+func locateParamError(err error, ruleLine int, keyLines map[string]int) error {
+	var paramErr *ParamError
+	if errors.As(err, &paramErr) {
+		located := *paramErr
+		located.Line = ruleLine
+		if line, ok := keyLines[paramErr.Key]; ok {
+			located.Line = line
+		}
+		return &located
+	}
+	if ruleLine > 0 {
+		return fmt.Errorf("line %d: %w", ruleLine, err)
+	}
+	return err
+}
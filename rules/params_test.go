@@ -0,0 +1,118 @@
+package rules
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"rba/util"
+
+	"gopkg.in/yaml.v3"
+)
+
+type testParams struct {
+	Interval time.Duration `param:"intervalSeconds,required" min:"1"`
+	Limit    int           `param:"limit" default:"5" min:"0" max:"100"`
+	Timeout  time.Duration `param:"timeoutMs" unit:"ms" default:"50"`
+	strategyParams
+}
+
+func TestDecodeParams(t *testing.T) {
+	raw := map[string]interface{}{
+		"intervalSeconds": 60.0,
+		"strategy":        util.Strategies.Average,
+	}
+
+	var params testParams
+	if err := decodeParams("test", raw, &params); err != nil {
+		t.Fatalf("unexpected error decoding params: %v", err)
+	}
+	if params.Interval != time.Minute {
+		t.Errorf("expected interval of 60.0 seconds to decode to 1m, got %v", params.Interval)
+	}
+	if params.Limit != 5 || params.Timeout != 50*time.Millisecond {
+		t.Errorf("expected defaults limit 5 and timeout 50ms, got %d and %v", params.Limit, params.Timeout)
+	}
+	if params.Strategy != util.Strategies.Average {
+		t.Errorf("expected embedded strategy to be decoded, got %q", params.Strategy)
+	}
+
+	raw["intervalSeconds"] = "5m"
+	if err := decodeParams("test", raw, &params); err != nil || params.Interval != 5*time.Minute {
+		t.Errorf("expected duration string 5m to be accepted, got %v (err %v)", params.Interval, err)
+	}
+}
+
+func TestDecodeParamsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  map[string]interface{}
+		key  string
+	}{
+		{"missing", map[string]interface{}{"strategy": "average"}, "intervalSeconds"},
+		{"fractional int", map[string]interface{}{"intervalSeconds": 60, "limit": 2.5, "strategy": "average"}, "limit"},
+		{"above max", map[string]interface{}{"intervalSeconds": 60, "limit": 101, "strategy": "average"}, "limit"},
+		{"below min", map[string]interface{}{"intervalSeconds": 0, "strategy": "average"}, "intervalSeconds"},
+		{"bad duration", map[string]interface{}{"intervalSeconds": "soon", "strategy": "average"}, "intervalSeconds"},
+		{"bad strategy", map[string]interface{}{"intervalSeconds": 60, "strategy": "max"}, "strategy"},
+		{"unknown", map[string]interface{}{"intervalSeconds": 60, "strategy": "average", "limt": 5}, "limt"},
+		{"empty required string", map[string]interface{}{"intervalSeconds": 60, "strategy": ""}, "strategy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params testParams
+			err := decodeParams("test", tt.raw, &params)
+			var paramErr *ParamError
+			if !errors.As(err, &paramErr) {
+				t.Fatalf("expected a ParamError, got %v", err)
+			}
+			if paramErr.Key != tt.key {
+				t.Errorf("expected error for %s, got %v", tt.key, err)
+			}
+		})
+	}
+}
+
+func TestStrategyParamsMatchStrategies(t *testing.T) {
+	field, _ := reflect.TypeOf(strategyParams{}).FieldByName("Strategy")
+	allowed := strings.Split(field.Tag.Get("oneof"), ",")
+	for _, strategy := range allowed {
+		if !util.IsValidStrategy(strategy) {
+			t.Errorf("strategy %s is allowed by strategyParams but not a valid strategy", strategy)
+		}
+	}
+	if len(allowed) != reflect.TypeOf(util.Strategies).NumField() {
+		t.Errorf("expected strategyParams to allow every strategy, got %v", allowed)
+	}
+}
+
+func TestBuildRuleErrorLine(t *testing.T) {
+	source := `rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 5
+    strategy: override
+  - name: velocity
+    intervalSeconds: 60
+    limit: -1
+    strategy: override
+`
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(source), &cfg); err != nil {
+		t.Fatalf("unexpected error unmarshalling config: %v", err)
+	}
+
+	_, _, err := buildRule(cfg.Rules[1])
+	if err == nil || !strings.HasPrefix(err.Error(), "line 8: velocity: limit:") {
+		t.Errorf("expected error located at line 8 for limit, got %v", err)
+	}
+
+	cfg.Rules[1].Name = "velocityy"
+	_, _, err = buildRule(cfg.Rules[1])
+	if err == nil || !strings.HasPrefix(err.Error(), "line 6: ") {
+		t.Errorf("expected unknown rule error located at line 6, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package rules
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"rba/services"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// validate checks the redis settings without reading the environment or any files, so a config can be checked offline
+func (c RedisConfig) validate() error {
+	if c.Host == "" && len(c.Addrs) == 0 {
+		return errors.New("provide a valid redis host")
+	}
+	if c.Host != "" && len(c.Addrs) > 0 {
+		return errors.New("redis: set either host or addrs, not both")
+	}
+	if strings.ContainsAny(c.KeyPrefix, " \t\r\n") {
+		return errors.New("redis: keyPrefix can't contain whitespace")
+	}
+	if c.Sentinel.MasterName != "" && c.Cluster {
+		return errors.New("redis: sentinel and cluster can't be used together")
+	}
+	if len(c.Addrs) > 1 && c.Sentinel.MasterName == "" && !c.Cluster {
+		return errors.New("redis: more than one address needs sentinel.masterName or cluster")
+	}
+	if c.Cluster && c.DB != 0 {
+		return errors.New("redis: cluster mode only has db 0")
+	}
+	for key, value := range map[string]int{
+		"db":                 c.DB,
+		"poolSize":           c.PoolSize,
+		"minIdleConns":       c.MinIdleConns,
+		"dialTimeoutMs":      c.DialTimeoutMs,
+		"readTimeoutMs":      c.ReadTimeoutMs,
+		"writeTimeoutMs":     c.WriteTimeoutMs,
+		"breaker.failures":   c.Breaker.Failures,
+		"breaker.cooldownMs": c.Breaker.CooldownMs,
+	} {
+		if value < 0 {
+			return fmt.Errorf("redis: %s must be at least 0", key)
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("redis: tls certFile and keyFile must be set together")
+	}
+	if !c.TLS.Enabled && (c.TLS.CAFile != "" || c.TLS.CertFile != "" || c.TLS.ServerName != "") {
+		return errors.New("redis: tls settings need tls.enabled")
+	}
+	return nil
+}
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 5 * time.Second
+)
+
+// breaker returns the circuit breaker for the rules' redis state, applying the defaults, or nil when it is disabled
+func (c RedisBreakerConfig) breaker() *services.Breaker {
+	if c.Disabled {
+		return nil
+	}
+	failures, cooldown := defaultBreakerFailures, defaultBreakerCooldown
+	if c.Failures > 0 {
+		failures = c.Failures
+	}
+	if c.CooldownMs > 0 {
+		cooldown = time.Duration(c.CooldownMs) * time.Millisecond
+	}
+	return services.NewBreaker(failures, cooldown)
+}
+
+// envOr reads the environment variable name, or fallback when name is unset
+func envOr(name string, fallback string) string {
+	if name == "" {
+		name = fallback
+	}
+	return os.Getenv(name)
+}
+
+// tlsConfig loads the CA bundle and client certificate
+func (c RedisTLSConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: c.ServerName}
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read tls caFile: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in tls caFile %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load tls certFile and keyFile: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Options builds the client options, reading credentials from the environment and TLS files from disk. The client is
+// a sentinel failover client when sentinel.masterName is set, a cluster client when cluster is set and a single node
+// client otherwise.
+func (c RedisConfig) Options() (*redis.UniversalOptions, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	addrs := c.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{c.Host}
+	}
+	options := &redis.UniversalOptions{
+		Addrs:            addrs,
+		DB:               c.DB,
+		Username:         envOr(c.UsernameEnv, "REDIS_USERNAME"),
+		Password:         envOr(c.PasswordEnv, "REDIS_PASSWORD"),
+		MasterName:       c.Sentinel.MasterName,
+		SentinelUsername: envOr(c.Sentinel.UsernameEnv, "REDIS_SENTINEL_USERNAME"),
+		SentinelPassword: envOr(c.Sentinel.PasswordEnv, "REDIS_SENTINEL_PASSWORD"),
+		IsClusterMode:    c.Cluster,
+		PoolSize:         c.PoolSize,
+		MinIdleConns:     c.MinIdleConns,
+		DialTimeout:      time.Duration(c.DialTimeoutMs) * time.Millisecond,
+		ReadTimeout:      time.Duration(c.ReadTimeoutMs) * time.Millisecond,
+		WriteTimeout:     time.Duration(c.WriteTimeoutMs) * time.Millisecond,
+	}
+	if c.TLS.Enabled {
+		config, err := c.TLS.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = config
+	}
+	return options, nil
+}
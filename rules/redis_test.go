@@ -0,0 +1,76 @@
+package rules
+
+import (
+	"rba/services"
+	"strings"
+	"testing"
+)
+
+func TestRedisOptions(t *testing.T) {
+	t.Setenv("REDIS_USERNAME", "rba")
+	t.Setenv("REDIS_PASSWORD", "default-secret")
+	t.Setenv("RBA_REDIS_PASSWORD", "secret")
+
+	options, err := RedisConfig{
+		Addrs:         []string{"sentinel-1:26379", "sentinel-2:26379"},
+		DB:            2,
+		PasswordEnv:   "RBA_REDIS_PASSWORD",
+		Sentinel:      RedisSentinelConfig{MasterName: "rba"},
+		TLS:           RedisTLSConfig{Enabled: true, ServerName: "redis.internal"},
+		PoolSize:      20,
+		ReadTimeoutMs: 500,
+	}.Options()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if options.Username != "rba" || options.Password != "secret" {
+		t.Errorf("expected credentials from REDIS_USERNAME and RBA_REDIS_PASSWORD, got %q and %q", options.Username, options.Password)
+	}
+	if options.MasterName != "rba" || len(options.Addrs) != 2 || options.DB != 2 || options.PoolSize != 20 {
+		t.Errorf("expected sentinel options to be passed through, got %+v", options)
+	}
+	if options.ReadTimeout.Milliseconds() != 500 {
+		t.Errorf("expected a 500ms read timeout, got %v", options.ReadTimeout)
+	}
+	if options.TLSConfig == nil || options.TLSConfig.ServerName != "redis.internal" {
+		t.Errorf("expected tls verifying redis.internal, got %+v", options.TLSConfig)
+	}
+
+	options, err = RedisConfig{Host: "localhost:6379"}.Options()
+	if err != nil || options.TLSConfig != nil || options.MasterName != "" || options.IsClusterMode {
+		t.Errorf("expected a plain single node client, got %+v (err %v)", options, err)
+	}
+}
+
+func TestRedisOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RedisConfig
+		expect string
+	}{
+		{"no address", RedisConfig{}, "provide a valid redis host"},
+		{"several addresses without a mode", RedisConfig{Addrs: []string{"a:6379", "b:6379"}}, "needs sentinel.masterName or cluster"},
+		{"cluster db", RedisConfig{Addrs: []string{"a:6379"}, Cluster: true, DB: 1}, "only has db 0"},
+		{"negative timeout", RedisConfig{Host: "a:6379", DialTimeoutMs: -1}, "dialTimeoutMs must be at least 0"},
+		{"negative breaker failures", RedisConfig{Host: "a:6379", Breaker: RedisBreakerConfig{Failures: -1}}, "breaker.failures must be at least 0"},
+		{"cert without key", RedisConfig{Host: "a:6379", TLS: RedisTLSConfig{Enabled: true, CertFile: "client.pem"}}, "must be set together"},
+		{"missing ca", RedisConfig{Host: "a:6379", TLS: RedisTLSConfig{Enabled: true, CAFile: "missing.pem"}}, "could not read tls caFile"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.config.Options(); err == nil || !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("expected error containing %q, got %v", tt.expect, err)
+			}
+		})
+	}
+}
+
+func TestRedisBreaker(t *testing.T) {
+	if (RedisBreakerConfig{Disabled: true}).breaker() != nil {
+		t.Errorf("expected no breaker when it is disabled")
+	}
+	if breaker := (RedisBreakerConfig{}).breaker(); breaker == nil || breaker.Stats().State != services.BreakerClosed {
+		t.Errorf("expected a closed breaker by default, got %+v", breaker)
+	}
+}
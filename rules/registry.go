@@ -0,0 +1,191 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"rba/types"
+	"rba/util"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Param describes a setting a rule type accepts in rules.yaml. Rule types usually build these with paramSchema.
+type Param struct {
+	Name     string
+	Type     string
+	Required bool
+	Default  string
+	Min      string
+	Max      string
+	OneOf    string
+}
+
+// ParseFunc builds a rule's handler from its rules.yaml settings. It returns the events the rule runs on, or nil to use
+// the rule type's default events.
+type ParseFunc func(raw map[string]interface{}) (util.NamedRiskHandler, []string, error)
+
+// RuleType is a kind of rule that can be configured by name in rules.yaml
+type RuleType struct {
+	Name   string
+	Params []Param
+	Parse  ParseFunc
+	// Events the rule runs on when Parse doesn't return its own
+	Events []string
+	// Set for rules that keep state between events, the config must provide a state store to use them
+	RequiresState bool
+	// Optional, run by LoadConfig once services are connected for rule types used in the config
+	Setup func(ctx context.Context) error
+	// Set for rule types whose settings are kept at package level for the configuration API. They belong to the
+	// primary ruleset, so tenant rulesets can't use them.
+	PrimaryOnly bool
+}
+
+// primaryOnlyError is returned for a PrimaryOnly rule in a tenant or challenger ruleset
+func primaryOnlyError(name string) error {
+	return fmt.Errorf("%s: rule is managed through the configuration API and can only be used in the primary ruleset", name)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]RuleType{}
+)
+
+// Register makes a rule type available to LoadConfig. It is intended to be called from an init function, and panics
+// if the rule type is incomplete or its name is already registered.
+func Register(ruleType RuleType) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if ruleType.Name == "" || ruleType.Parse == nil {
+		panic("rules: Register requires a name and parser")
+	}
+	if _, exists := registry[ruleType.Name]; exists {
+		panic(fmt.Sprintf("rules: Register called twice for rule type %s", ruleType.Name))
+	}
+	for _, event := range ruleType.Events {
+		if !util.IsValidEvent(event) {
+			panic(fmt.Sprintf("rules: rule type %s registered for unknown event %s", ruleType.Name, event))
+		}
+	}
+	registry[ruleType.Name] = ruleType
+}
+
+// RuleTypes returns all registered rule types sorted by name
+func RuleTypes() []RuleType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	ruleTypes := make([]RuleType, 0, len(registry))
+	for _, ruleType := range registry {
+		ruleTypes = append(ruleTypes, ruleType)
+	}
+	sort.Slice(ruleTypes, func(i, j int) bool { return ruleTypes[i].Name < ruleTypes[j].Name })
+	return ruleTypes
+}
+
+func lookupRuleType(name string) (RuleType, error) {
+	registryMu.RLock()
+	ruleType, ok := registry[name]
+	registryMu.RUnlock()
+	if ok {
+		return ruleType, nil
+	}
+
+	var names []string
+	for _, ruleType := range RuleTypes() {
+		names = append(names, ruleType.Name)
+	}
+	return RuleType{}, fmt.Errorf("unknown rule %q, available rule types are: %s", name, strings.Join(names, ", "))
+}
+
+// Settings every rule accepts, handled here rather than by each rule type's parser
+const (
+	modeParam    = "mode"
+	onErrorParam = "onError"
+)
+
+// parseErrorPolicy reads a rule's onError setting: ignore, challenge, or the score between 0 and 1 the rule counts as
+func parseErrorPolicy(rule string, value interface{}) (util.ErrorPolicy, error) {
+	switch v := value.(type) {
+	case string:
+		if v == util.ErrorActions.Ignore || v == util.ErrorActions.Challenge {
+			return util.ErrorPolicy{Action: v}, nil
+		}
+	case int:
+		if v == 0 || v == 1 {
+			return util.ErrorPolicy{Action: util.ErrorActions.Score, Score: float64(v)}, nil
+		}
+	case float64:
+		if v >= 0 && v <= 1 {
+			return util.ErrorPolicy{Action: util.ErrorActions.Score, Score: v}, nil
+		}
+	}
+	return util.ErrorPolicy{}, &ParamError{Rule: rule, Key: onErrorParam, Msg: fmt.Sprintf("must be %s, %s or a score between 0 and 1, got %v", util.ErrorActions.Ignore, util.ErrorActions.Challenge, value)}
+}
+
+// buildRule looks up the rule type for a configured rule and parses it, returning the handler and the events it runs on.
+// Errors are prefixed with the rules.yaml line of the rule, or of the setting at fault when it is known.
+func buildRule(rawRule types.RuleConfig) (util.NamedRiskHandler, []string, error) {
+	ruleType, err := lookupRuleType(rawRule.Name)
+	if err != nil {
+		return util.NamedRiskHandler{}, nil, locateParamError(err, rawRule.Line, nil)
+	}
+
+	raw := make(map[string]interface{}, len(rawRule.Params))
+	for key, value := range rawRule.Params {
+		raw[key] = value
+	}
+	mode := util.Modes.Enforce
+	if modeRaw, exists := raw[modeParam]; exists {
+		delete(raw, modeParam)
+		mode, _ = modeRaw.(string)
+		if mode != util.Modes.Enforce && mode != util.Modes.Shadow {
+			err := &ParamError{Rule: rawRule.Name, Key: modeParam, Msg: fmt.Sprintf("must be one of %s, %s, got %v", util.Modes.Enforce, util.Modes.Shadow, modeRaw)}
+			return util.NamedRiskHandler{}, nil, locateParamError(err, rawRule.Line, rawRule.ParamLines)
+		}
+	}
+	onError := util.ErrorPolicy{Action: util.ErrorActions.Ignore}
+	if onErrorRaw, exists := raw[onErrorParam]; exists {
+		delete(raw, onErrorParam)
+		if onError, err = parseErrorPolicy(rawRule.Name, onErrorRaw); err != nil {
+			return util.NamedRiskHandler{}, nil, locateParamError(err, rawRule.Line, rawRule.ParamLines)
+		}
+	}
+
+	handler, events, err := ruleType.Parse(raw)
+	if err != nil {
+		return util.NamedRiskHandler{}, nil, locateParamError(err, rawRule.Line, rawRule.ParamLines)
+	}
+	handler.Shadow = mode == util.Modes.Shadow
+	handler.OnError = onError
+	if handler.Shadow {
+		shadowHandler(&handler)
+	}
+	if events == nil {
+		events = slices.Clone(ruleType.Events)
+	}
+	return handler, events, nil
+}
+
+// shadowHandler runs a shadow rule's handler and introspection against its own state
+func shadowHandler(handler *util.NamedRiskHandler) {
+	name, handle, introspect := handler.Name, handler.Handler, handler.Introspect
+	handler.Handler = func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+		return handle(shadowContext(ctx, name), args)
+	}
+	if introspect != nil {
+		handler.Introspect = func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			return introspect(shadowContext(ctx, name), entityType, id)
+		}
+	}
+}
+
+// fixedEvents adapts a parser for a rule that always runs on its rule type's default events
+func fixedEvents(parse func(raw map[string]interface{}) (util.NamedRiskHandler, error)) ParseFunc {
+	return func(raw map[string]interface{}) (util.NamedRiskHandler, []string, error) {
+		handler, err := parse(raw)
+		return handler, nil, err
+	}
+}
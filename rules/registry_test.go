@@ -0,0 +1,72 @@
+package rules
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"rba/types"
+	"rba/util"
+)
+
+// unregister removes a rule type a test registered, so it doesn't leak into later tests
+func unregister(t *testing.T, name string) {
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(registry, name)
+	})
+}
+
+func TestRegisterRuleType(t *testing.T) {
+	unregister(t, "registryStub")
+	Register(RuleType{
+		Name:   "registryStub",
+		Events: []string{util.Events.Registration},
+		Parse: fixedEvents(func(raw map[string]interface{}) (util.NamedRiskHandler, error) {
+			return util.NamedRiskHandler{
+				Name: "registryStub",
+				Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+					return util.RiskResult{Name: "registryStub"}
+				},
+			}, nil
+		}),
+	})
+
+	handler, events, err := buildRule(types.RuleConfig{Name: "registryStub", Params: map[string]interface{}{}})
+	if err != nil {
+		t.Fatalf("unexpected error building registered rule: %v", err)
+	}
+	if handler.Name != "registryStub" {
+		t.Errorf("expected handler registryStub, got %s", handler.Name)
+	}
+	if len(events) != 1 || events[0] != util.Events.Registration {
+		t.Errorf("expected default events of the rule type, got %v", events)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering a duplicate rule type to panic")
+		}
+	}()
+	Register(RuleType{Name: "registryStub", Parse: fixedEvents(parseVelocityRule)})
+}
+
+func TestBuildUnknownRule(t *testing.T) {
+	_, _, err := buildRule(types.RuleConfig{Name: "velocityy"})
+	if err == nil {
+		t.Fatalf("expected an unknown rule to fail")
+	}
+	for _, name := range []string{util.Rules.Velocity, util.Rules.Denylist, util.Rules.HorizontalBruteForce} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error to list available rule type %s, got %v", name, err)
+		}
+	}
+}
+
+func TestRegisterRuleTypeCleanup(t *testing.T) {
+	t.Run("register", TestRegisterRuleType)
+	if _, err := lookupRuleType("registryStub"); err == nil {
+		t.Errorf("expected the stub rule type to be removed once its test finished")
+	}
+}
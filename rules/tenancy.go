@@ -0,0 +1,214 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"rba/types"
+	"rba/util"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TenancyConfig keeps the state and assessments of each client application apart. A tenant is a named group of API
+// key IDs, keys that aren't in a group are a tenant of their own named by the key ID.
+type TenancyConfig struct {
+	Isolate bool           `yaml:"isolate"`
+	Tenants []TenantConfig `yaml:"tenants"`
+	// Keys that belong to no tenant, used by operators for the audit log and challenger report which every tenant
+	// shares. They assess events with the primary ruleset and see the assessments stored without a tenant.
+	AdminKeyIDs []string `yaml:"adminKeyIds"`
+}
+
+type TenantConfig struct {
+	Name   string   `yaml:"name"`
+	KeyIDs []string `yaml:"keyIds"`
+	// The tenant's own ruleset, from a rules file or listed here. Tenants without one use the primary ruleset.
+	RulesFile string             `yaml:"rulesFile"`
+	Rules     []types.RuleConfig `yaml:"rules"`
+	// Overrides the threshold and subject in services.nats for the tenant's events
+	Nats TenantNatsConfig `yaml:"nats"`
+	// Splits the risks up to the threshold into pass and challenge
+	Bands TenantBandsConfig `yaml:"bands"`
+}
+
+type TenantNatsConfig struct {
+	Threshold *float64 `yaml:"threshold"`
+	Subject   string   `yaml:"subject"`
+}
+
+type TenantBandsConfig struct {
+	// Risks above it, up to the threshold, are challenged rather than passed
+	Challenge *float64 `yaml:"challenge"`
+}
+
+// hasRuleset reports whether the tenant assesses its events differently from the primary ruleset
+func (t TenantConfig) hasRuleset() bool {
+	return t.RulesFile != "" || t.Rules != nil || t.Nats.Threshold != nil || t.Nats.Subject != "" ||
+		t.Bands.Challenge != nil
+}
+
+// Ruleset is the rules a tenant's events are assessed with, the threshold and subject its alerts use, and the risk
+// above which its events are challenged when it has a challenge band
+type Ruleset struct {
+	Handlers  map[string][]util.NamedRiskHandler
+	Threshold float64
+	Subject   string
+	Challenge *float64
+}
+
+// Decide returns the decision for an assessment in the ruleset's bands: alert above the threshold, challenge above the
+// challenge band, and pass below it unless a failed rule asks for a challenge
+func (r Ruleset) Decide(a Assessment) string {
+	decision := a.Decide(r.Threshold)
+	if decision == util.Decisions.Pass && r.Challenge != nil && a.Risk > *r.Challenge {
+		return util.Decisions.Challenge
+	}
+	return decision
+}
+
+// Read-only, set when the config is read
+var (
+	tenancy        = TenancyConfig{}
+	tenantRulesets = map[string]Ruleset{}
+)
+
+// TenantOf returns the tenant an API key belongs to, or an empty string for admin keys and when tenants aren't
+// isolated
+func TenantOf(keyID string) string {
+	if !tenancy.Isolate || slices.Contains(tenancy.AdminKeyIDs, keyID) {
+		return ""
+	}
+	for _, tenant := range tenancy.Tenants {
+		if slices.Contains(tenant.KeyIDs, keyID) {
+			return tenant.Name
+		}
+	}
+	return keyID
+}
+
+// TenantRulesets returns the rulesets of the tenants that have their own, by tenant name
+func TenantRulesets() map[string]Ruleset {
+	return tenantRulesets
+}
+
+// validate checks tenant names are set and unique, that each key ID belongs to at most one tenant and isn't an admin
+// key, and that tenants only have their own rulesets when their state is isolated
+func (t TenancyConfig) validate() error {
+	names := map[string]bool{}
+	keyIDs := map[string]string{}
+	for _, tenant := range t.Tenants {
+		if tenant.Name == "" {
+			return errors.New("tenancy: every tenant needs a name")
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenancy: tenant %q is listed more than once", tenant.Name)
+		}
+		names[tenant.Name] = true
+		for _, keyID := range tenant.KeyIDs {
+			if slices.Contains(t.AdminKeyIDs, keyID) {
+				return fmt.Errorf("tenancy: key ID %q is an admin key and can't belong to %q", keyID, tenant.Name)
+			}
+			if other, ok := keyIDs[keyID]; ok {
+				return fmt.Errorf("tenancy: key ID %q belongs to both %q and %q", keyID, other, tenant.Name)
+			}
+			keyIDs[keyID] = tenant.Name
+		}
+
+		// Rules with the same name share keys, so tenants with different settings for them can't share state
+		if tenant.hasRuleset() && !t.Isolate {
+			return fmt.Errorf("tenancy: tenant %q has its own ruleset, which needs isolate", tenant.Name)
+		}
+		if tenant.RulesFile != "" && tenant.Rules != nil {
+			return fmt.Errorf("tenancy: tenant %q: set either rulesFile or rules, not both", tenant.Name)
+		}
+		if threshold := tenant.Nats.Threshold; threshold != nil && (*threshold < 0 || *threshold > 1) {
+			return fmt.Errorf("tenancy: tenant %q: threshold for publishing must be between 0 and 1", tenant.Name)
+		}
+		if challenge := tenant.Bands.Challenge; challenge != nil && (*challenge < 0 || *challenge > 1) {
+			return fmt.Errorf("tenancy: tenant %q: challenge band must be between 0 and 1", tenant.Name)
+		}
+	}
+	return nil
+}
+
+// readRulesFile reads a tenant's rules file. It only holds rules, anything else is an error rather than ignored since
+// services and tenancy are set in the main file.
+func readRulesFile(path string) ([]types.RuleConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Rules []types.RuleConfig `yaml:"rules"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	return file.Rules, nil
+}
+
+// buildRulesets builds the ruleset of each tenant that has its own, and returns the rule types the tenants use so they
+// are set up along with the primary ruleset's. Tenants that only override the threshold, subject or bands keep the
+// primary handlers. The package level config belongs to the primary ruleset, so it is put back after the tenants'
+// rules are parsed, and rule types that keep config there are rejected.
+func buildRulesets(t TenancyConfig, servicesConfig ServicesConfig, primary map[string][]util.NamedRiskHandler) (map[string]Ruleset, []RuleType, error) {
+	defer saveModuleConfig().restore()
+
+	rulesets := map[string]Ruleset{}
+	var used []RuleType
+	for _, tenant := range t.Tenants {
+		if !tenant.hasRuleset() {
+			continue
+		}
+
+		ruleset := Ruleset{
+			Handlers:  primary,
+			Threshold: servicesConfig.Nats.Threshold,
+			Subject:   servicesConfig.Nats.AlertSubject(),
+		}
+
+		rawRules := tenant.Rules
+		if tenant.RulesFile != "" {
+			var err error
+			if rawRules, err = readRulesFile(tenant.RulesFile); err != nil {
+				return nil, nil, fmt.Errorf("tenant %s: %s: %w", tenant.Name, tenant.RulesFile, err)
+			}
+		}
+		for _, rawRule := range rawRules {
+			if ruleType, err := lookupRuleType(rawRule.Name); err == nil && ruleType.PrimaryOnly {
+				return nil, nil, fmt.Errorf("tenant %s: %w", tenant.Name, locateParamError(primaryOnlyError(rawRule.Name), rawRule.Line, nil))
+			}
+		}
+		if rawRules != nil {
+			handlers, tenantUsed, err := buildRules(rawRules, servicesConfig)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tenant %s: %w", tenant.Name, err)
+			}
+			ruleset.Handlers = handlers
+			for _, ruleType := range tenantUsed {
+				used = addRuleType(used, ruleType)
+			}
+		}
+
+		if tenant.Nats.Threshold != nil {
+			ruleset.Threshold = *tenant.Nats.Threshold
+		}
+		if tenant.Nats.Subject != "" {
+			ruleset.Subject = tenant.Nats.Subject
+		}
+		if challenge := tenant.Bands.Challenge; challenge != nil {
+			if *challenge > ruleset.Threshold {
+				return nil, nil, fmt.Errorf("tenant %s: challenge band %v is above the threshold %v", tenant.Name, *challenge, ruleset.Threshold)
+			}
+			ruleset.Challenge = challenge
+		}
+		rulesets[tenant.Name] = ruleset
+	}
+	return rulesets, used, nil
+}
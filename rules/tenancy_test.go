@@ -0,0 +1,243 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rba/util"
+)
+
+func TestTenantOf(t *testing.T) {
+	defer saveModuleConfig().restore()
+
+	tenancy = TenancyConfig{Tenants: []TenantConfig{{Name: "portal", KeyIDs: []string{"portal-web", "portal-mobile"}}}}
+	if tenant := TenantOf("portal-web"); tenant != "" {
+		t.Errorf("expected no tenant when tenants aren't isolated, got %q", tenant)
+	}
+
+	tenancy.Isolate = true
+	if tenant := TenantOf("portal-mobile"); tenant != "portal" {
+		t.Errorf("expected portal-mobile to belong to portal, got %q", tenant)
+	}
+	if tenant := TenantOf("batch"); tenant != "batch" {
+		t.Errorf("expected a key outside any group to be its own tenant, got %q", tenant)
+	}
+	tenancy.AdminKeyIDs = []string{"ops"}
+	if tenant := TenantOf("ops"); tenant != "" {
+		t.Errorf("expected an admin key to belong to no tenant, got %q", tenant)
+	}
+
+	duplicate := TenancyConfig{Tenants: []TenantConfig{
+		{Name: "portal", KeyIDs: []string{"shared"}},
+		{Name: "mobile", KeyIDs: []string{"shared"}},
+	}}
+	if err := duplicate.validate(); err == nil {
+		t.Errorf("expected a key ID in two tenants to be rejected")
+	}
+
+	admin := TenancyConfig{AdminKeyIDs: []string{"ops"}, Tenants: []TenantConfig{{Name: "portal", KeyIDs: []string{"ops"}}}}
+	if err := admin.validate(); err == nil {
+		t.Errorf("expected an admin key in a tenant to be rejected")
+	}
+}
+
+func TestTenantRulesets(t *testing.T) {
+	defer saveModuleConfig().restore()
+
+	dir := t.TempDir()
+	mobileRules := filepath.Join(dir, "mobile.yaml")
+	if err := os.WriteFile(mobileRules, []byte(`rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 3
+    strategy: override
+`), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+
+	path := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(path, []byte(`rules:
+  - name: velocity
+    intervalSeconds: 60
+    limit: 10
+    strategy: average
+services:
+  state:
+    backend: memory
+  nats:
+    threshold: 0.5
+tenancy:
+  isolate: true
+  tenants:
+    - name: portal
+      keyIds: [portal-web]
+      rules:
+        - name: expression
+          id: portalOnly
+          expression: "true"
+          events: [login]
+          strategy: override
+    - name: mobile
+      keyIds: [mobile-app]
+      rulesFile: `+mobileRules+`
+      nats:
+        subject: alerts.mobile
+    - name: batch
+      keyIds: [batch-job]
+      nats:
+        threshold: 0.9
+      bands:
+        challenge: 0.6
+    - name: kiosk
+      keyIds: [kiosk]
+`), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+
+	primary, _, err := ValidateConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rulesets := TenantRulesets()
+
+	if _, ok := rulesets["kiosk"]; ok {
+		t.Errorf("expected a tenant without overrides to use the primary ruleset")
+	}
+	if portal := rulesets["portal"]; len(portal.Handlers[util.Events.Login]) != 1 || portal.Handlers[util.Events.Login][0].Name != "portalOnly" {
+		t.Errorf("expected portal to run only its own rule on login, got %v", portal.Handlers[util.Events.Login])
+	}
+	if mobile := rulesets["mobile"]; mobile.Subject != "alerts.mobile" || mobile.Threshold != 0.5 || len(mobile.Handlers[util.Events.Login]) != 1 {
+		t.Errorf("expected mobile's rules file and subject with the primary threshold, got %+v", mobile)
+	}
+	batch := rulesets["batch"]
+	if batch.Threshold != 0.9 || batch.Subject != defaultAlertSubject || len(batch.Handlers[util.Events.Login]) != len(primary[util.Events.Login]) {
+		t.Errorf("expected batch to keep the primary rules with its own threshold, got %+v", batch)
+	}
+	for _, band := range []struct {
+		risk     float64
+		decision string
+	}{{0.6, util.Decisions.Pass}, {0.7, util.Decisions.Challenge}, {0.95, util.Decisions.Alert}} {
+		if got := batch.Decide(Assessment{Risk: band.risk}); got != band.decision {
+			t.Errorf("expected batch to decide %s on a risk of %v, got %s", band.decision, band.risk, got)
+		}
+	}
+	if mobile := rulesets["mobile"]; mobile.Decide(Assessment{Risk: 0.4}) != util.Decisions.Pass {
+		t.Errorf("expected a ruleset without a challenge band to pass up to the threshold")
+	}
+}
+
+func TestTenantRuleTypesSetUp(t *testing.T) {
+	defer saveModuleConfig().restore()
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(`rules: []
+services:
+  state:
+    backend: memory
+tenancy:
+  isolate: true
+  tenants:
+    - name: portal
+      rules:
+        - name: velocity
+          intervalSeconds: 60
+          limit: 3
+          strategy: average
+`), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+
+	// Rule types only a tenant uses are set up along with the primary ruleset's
+	_, _, used, err := readConfig(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(used) != 1 || used[0].Name != util.Rules.Velocity {
+		t.Errorf("expected the tenant's velocity rule type to be set up, got %v", used)
+	}
+}
+
+func TestTenantRulesetErrors(t *testing.T) {
+	defer saveModuleConfig().restore()
+
+	dir := t.TempDir()
+	withServices := filepath.Join(dir, "tenant.yaml")
+	if err := os.WriteFile(withServices, []byte("rules: []\nservices:\n  redis:\n    enabled: true\n"), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		tenancy string
+		expect  string
+	}{
+		{
+			name: "shared state",
+			tenancy: `  tenants:
+    - name: portal
+      nats:
+        threshold: 0.7
+`,
+			expect: "needs isolate",
+		},
+		{
+			name: "services in a tenant file",
+			tenancy: `  isolate: true
+  tenants:
+    - name: portal
+      rulesFile: ` + withServices + `
+`,
+			expect: "field services not found",
+		},
+		{
+			name: "invalid tenant rule",
+			tenancy: `  isolate: true
+  tenants:
+    - name: portal
+      rules:
+        - name: velocity
+          limit: 3
+          strategy: average
+`,
+			expect: "tenant portal: line 9: velocity: intervalSeconds",
+		},
+		{
+			name: "rule managed through the configuration API",
+			tenancy: `  isolate: true
+  tenants:
+    - name: portal
+      rules:
+        - name: denylist
+          sourceList: redis
+          strategy: override
+`,
+			expect: "tenant portal: line 9: denylist: rule is managed through the configuration API",
+		},
+		{
+			name: "challenge band above the threshold",
+			tenancy: `  isolate: true
+  tenants:
+    - name: portal
+      nats:
+        threshold: 0.5
+      bands:
+        challenge: 0.8
+`,
+			expect: "tenant portal: challenge band 0.8 is above the threshold 0.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "rules.yaml")
+			if err := os.WriteFile(path, []byte("services:\n  state:\n    backend: memory\ntenancy:\n"+tt.tenancy), 0o600); err != nil {
+				t.Fatalf("failed to write rules: %v", err)
+			}
+			if _, _, err := ValidateConfig(path); err == nil || !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("expected error containing %q, got %v", tt.expect, err)
+			}
+		})
+	}
+}
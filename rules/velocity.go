@@ -2,77 +2,191 @@ package rules
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"math/rand"
+	"math"
 	"rba/services"
 	"rba/util"
+	"strconv"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
-func EvaluateVelocityRisk(ctx context.Context, ip string, interval time.Duration, limit int) (float64, error) {
-	now := time.Now().UnixMilli()
-	windowStart := float64(now - interval.Milliseconds())
-	key := fmt.Sprintf("velocity:%s", ip)
+func init() {
+	Register(RuleType{
+		Name:          util.Rules.Velocity,
+		Params:        paramSchema(velocityParams{}),
+		RequiresState: true,
+		Events:        []string{util.Events.Login},
+		Parse:         fixedEvents(parseVelocityRule),
+	})
+}
 
-	// Remove old entries
-	if err := services.RedisClient.ZRemRangeByScore(ctx, key, "0", fmt.Sprintf("%f", windowStart)).Err(); err != nil {
-		return 0, err
-	}
+type velocityParams struct {
+	Interval  time.Duration `param:"intervalSeconds,required" min:"1"`
+	Limit     int           `param:"limit,required" min:"0"`
+	Algorithm string        `param:"algorithm" oneof:"slidingLog,slidingWindow,tokenBucket,gcra"`
+	strategyParams
+}
 
-	// Add login event
-	member := fmt.Sprintf("%d-%d", now, rand.Intn(1000000))
-	if err := services.RedisClient.ZAdd(ctx, key, redis.Z{
-		Score:  float64(now),
-		Member: member,
-	}).Err(); err != nil {
-		return 0, err
-	}
+// Algorithms the velocity rule can count logins with, see the README for their trade-offs
+var velocityAlgorithms = struct {
+	SlidingLog    string
+	SlidingWindow string
+	TokenBucket   string
+	GCRA          string
+}{
+	SlidingLog:    "slidingLog",
+	SlidingWindow: "slidingWindow",
+	TokenBucket:   "tokenBucket",
+	GCRA:          "gcra",
+}
+
+// velocityKey returns the key an IP's logins are counted under. The algorithm, interval and limit are part of it, so
+// velocity rules with different settings never share or reshape each other's state.
+func velocityKey(ctx context.Context, ip string, algorithm string, interval time.Duration, limit int) string {
+	return stateKey(ctx, "velocity:%s:%d:%d:%s", algorithm, interval.Milliseconds(), limit, ip)
+}
 
-	// Count current entries
-	count, err := services.RedisClient.ZCount(ctx, key, fmt.Sprintf("%f", windowStart), "+inf").Result()
+// slidingWindowCounts returns the count in the fixed window holding at and in the one before it, incrementing the
+// current one if record is set, along with the share of the previous window still inside the interval
+func slidingWindowCounts(ctx context.Context, key string, at int64, interval time.Duration, record bool) (int64, int64, float64, error) {
+	size := interval.Milliseconds()
+	window := at / size
+	currentKey := fmt.Sprintf("%s:%d", key, window)
+
+	var current int64
+	var err error
+	if record {
+		// Kept until the next window, late events included, has used it as its previous one
+		current, err = services.State.Increment(ctx, currentKey, 2*interval+allowedLateness)
+	} else {
+		current, err = services.State.Counter(ctx, currentKey)
+	}
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, err
 	}
+	previous, err := services.State.Counter(ctx, fmt.Sprintf("%s:%d", key, window-1))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	overlap := float64(size-(at-window*size)) / float64(size)
+	return current, previous, overlap, nil
+}
 
-	services.RedisClient.Expire(ctx, key, interval)
+// EvaluateVelocityRisk records a login from the IP at the event's time with the algorithm and fails it if the IP is
+// over the limit for the interval
+func EvaluateVelocityRisk(ctx context.Context, ip string, algorithm string, interval time.Duration, limit int) (float64, error) {
+	at := util.EventTimeFromContext(ctx).UnixMilli()
+	key := velocityKey(ctx, ip, algorithm, interval, limit)
+
+	var over bool
+	switch algorithm {
+	case velocityAlgorithms.SlidingWindow:
+		current, previous, overlap, err := slidingWindowCounts(ctx, key, at, interval, true)
+		if err != nil {
+			return 0, err
+		}
+		over = float64(previous)*overlap+float64(current) > float64(limit)
+	case velocityAlgorithms.TokenBucket:
+		taken, err := services.State.TakeToken(ctx, key, at, limit, interval)
+		if err != nil {
+			return 0, err
+		}
+		over = !taken
+	case velocityAlgorithms.GCRA:
+		allowed, err := services.State.AllowGCRA(ctx, key, at, limit, interval)
+		if err != nil {
+			return 0, err
+		}
+		over = !allowed
+	default:
+		count, err := services.State.RecordInWindow(ctx, key, at, interval, allowedLateness)
+		if err != nil {
+			return 0, err
+		}
+		over = count > int64(limit)
+	}
 
-	if count > int64(limit) {
+	if over {
 		return 1.0, nil
 	}
 
 	return 0.0, nil
 }
 
-func parseVelocityRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
-	interval, ok := raw["intervalSeconds"].(int)
-
-	if redisErr := services.PingRedis(); redisErr != nil {
-		return util.NamedRiskHandler{}, errors.New("velocity: a valid redis connection is required for this rule. Check redis configuration")
+// inspectVelocity reports how much of the limit an IP has used at the event's time, without recording a login
+func inspectVelocity(ctx context.Context, ip string, algorithm string, interval time.Duration, limit int) (map[string]interface{}, error) {
+	at := util.EventTimeFromContext(ctx).UnixMilli()
+	key := velocityKey(ctx, ip, algorithm, interval, limit)
+	report := map[string]interface{}{
+		"algorithm": algorithm,
+		"limit":     limit,
 	}
 
-	if !ok {
-		return util.NamedRiskHandler{}, errors.New("velocity: missing or invalid intervalSeconds")
+	switch algorithm {
+	case velocityAlgorithms.SlidingWindow:
+		current, previous, overlap, err := slidingWindowCounts(ctx, key, at, interval, false)
+		if err != nil {
+			return nil, err
+		}
+		report["requests"] = math.Round((float64(previous)*overlap+float64(current))*100) / 100
+	case velocityAlgorithms.TokenBucket:
+		bucket, err := services.State.GetFields(ctx, key, "tokens", "at")
+		if err != nil {
+			return nil, err
+		}
+		tokens, tokensErr := strconv.ParseFloat(bucket["tokens"], 64)
+		last, atErr := strconv.ParseFloat(bucket["at"], 64)
+		if tokensErr != nil || atErr != nil {
+			// Not used within the interval, so full
+			tokens, last = float64(limit), float64(at)
+		}
+		if float64(at) > last {
+			tokens = math.Min(float64(limit), tokens+(float64(at)-last)*float64(limit)/float64(interval.Milliseconds()))
+		}
+		report["tokens"] = math.Floor(tokens)
+	case velocityAlgorithms.GCRA:
+		fields, err := services.State.GetFields(ctx, key, "tat")
+		if err != nil {
+			return nil, err
+		}
+		remaining := limit
+		if tat, err := strconv.ParseFloat(fields["tat"], 64); err == nil && tat > float64(at) && limit > 0 {
+			emission := float64(interval.Milliseconds()) / float64(limit)
+			remaining = int(math.Floor((float64(interval.Milliseconds()) - (tat - float64(at))) / emission))
+		}
+		report["remaining"] = remaining
+	default:
+		count, err := services.State.CountInWindow(ctx, key, at, interval)
+		if err != nil {
+			return nil, err
+		}
+		report["requests"] = count
 	}
+	return report, nil
+}
 
-	limit, ok := raw["limit"].(int)
-	if !ok {
-		return util.NamedRiskHandler{}, errors.New("velocity: missing or invalid limit")
+func parseVelocityRule(raw map[string]interface{}) (util.NamedRiskHandler, error) {
+	var params velocityParams
+	if err := decodeParams(util.Rules.Velocity, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, err
 	}
 
-	strategy, ok := raw["strategy"].(string)
-	if !ok || !util.IsValidStrategy(strategy) {
-		return util.NamedRiskHandler{}, errors.New("velocity: missing or invalid strategy")
+	interval, limit, strategy := params.Interval, params.Limit, params.Strategy
+	algorithm := params.Algorithm
+	if algorithm == "" {
+		algorithm = velocityAlgorithms.SlidingLog
 	}
 
 	return util.NamedRiskHandler{
 		Name:     util.Rules.Velocity,
 		Strategy: strategy,
+		Introspect: func(ctx context.Context, entityType string, id string) (map[string]interface{}, error) {
+			if entityType != util.Entities.IP {
+				return nil, nil
+			}
+			return inspectVelocity(ctx, id, algorithm, interval, limit)
+		},
 		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
-			now := time.Now().UnixMilli()
-			println(now)
 			base := util.RiskResult{
 				Name:     util.Rules.Velocity,
 				Strategy: strategy,
@@ -88,7 +202,7 @@ func parseVelocityRule(raw map[string]interface{}) (util.NamedRiskHandler, error
 				return result
 			}
 
-			score, redisErr := EvaluateVelocityRisk(ctx, ip, time.Duration(interval)*time.Second, limit)
+			score, redisErr := EvaluateVelocityRisk(ctx, ip, algorithm, interval, limit)
 			result := base
 			result.Score = score
 			if redisErr != nil {
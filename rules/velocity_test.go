@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rba/services"
+	"rba/util"
+)
+
+func TestEvaluateVelocityRiskEventTime(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+		login := func(at time.Time) float64 {
+			score, err := EvaluateVelocityRisk(util.WithEventTime(ctx, at), "10.0.0.1", velocityAlgorithms.SlidingLog, time.Minute, 2)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return score
+		}
+
+		// Logins an hour apart by event time fall in separate windows, however quickly they are assessed
+		for i := 0; i < 3; i++ {
+			if score := login(start.Add(time.Duration(i) * time.Hour)); score != 0.0 {
+				t.Errorf("expected score 0.0 for login %d an hour after the last, got %v", i+1, score)
+			}
+		}
+
+		// Three logins within a minute of event time exceed the limit
+		end := start.Add(3 * time.Hour)
+		login(end)
+		login(end.Add(10 * time.Second))
+		if score := login(end.Add(20 * time.Second)); score != 1.0 {
+			t.Errorf("expected score 1.0 for the third login in a minute, got %v", score)
+		}
+
+		// A late login is only counted against the logins before it
+		if score := login(end.Add(-30 * time.Second)); score != 0.0 {
+			t.Errorf("expected score 0.0 for a late login with nothing before it, got %v", score)
+		}
+	})
+}
+
+func TestVelocityAlgorithms(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+		for _, algorithm := range []string{
+			velocityAlgorithms.SlidingLog,
+			velocityAlgorithms.SlidingWindow,
+			velocityAlgorithms.TokenBucket,
+			velocityAlgorithms.GCRA,
+		} {
+			t.Run(algorithm, func(t *testing.T) {
+				if err := services.State.Flush(ctx); err != nil {
+					t.Fatalf("failed to flush state: %v", err)
+				}
+				login := func(at time.Time) float64 {
+					score, err := EvaluateVelocityRisk(util.WithEventTime(ctx, at), "10.0.0.1", algorithm, time.Minute, 3)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return score
+				}
+
+				// Every algorithm allows the limit within the interval and fails the next login
+				for i := 0; i < 3; i++ {
+					if score := login(start.Add(time.Duration(i) * time.Second)); score != 0.0 {
+						t.Errorf("expected score 0.0 for login %d of 3, got %v", i+1, score)
+					}
+				}
+				if score := login(start.Add(3 * time.Second)); score != 1.0 {
+					t.Errorf("expected score 1.0 for the 4th login in a minute, got %v", score)
+				}
+
+				// and allows logins again once the IP has been quiet for twice the interval
+				if score := login(start.Add(3 * time.Minute)); score != 0.0 {
+					t.Errorf("expected score 0.0 after a quiet period, got %v", score)
+				}
+
+				report, err := inspectVelocity(util.WithEventTime(ctx, start.Add(3*time.Minute)), "10.0.0.1", algorithm, time.Minute, 3)
+				if err != nil || report["algorithm"] != algorithm || report["limit"] != 3 {
+					t.Errorf("expected a report for %s, got %v (err %v)", algorithm, report, err)
+				}
+			})
+		}
+	})
+}
+
+func TestVelocityRulesKeepSeparateState(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		ctx := util.WithEventTime(context.Background(), time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+		if err := services.State.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+
+		// A strict and a lenient rule on the same IP each count the logins once, rather than both counting them twice
+		for i := 0; i < 2; i++ {
+			if score, _ := EvaluateVelocityRisk(ctx, "10.0.0.2", velocityAlgorithms.SlidingLog, time.Minute, 2); score != 0.0 {
+				t.Errorf("expected login %d to be within the strict limit, got %v", i+1, score)
+			}
+			if score, _ := EvaluateVelocityRisk(ctx, "10.0.0.2", velocityAlgorithms.SlidingLog, time.Hour, 10); score != 0.0 {
+				t.Errorf("expected login %d to be within the lenient limit, got %v", i+1, score)
+			}
+		}
+
+		// Different algorithms never read each other's state
+		if score, err := EvaluateVelocityRisk(ctx, "10.0.0.2", velocityAlgorithms.TokenBucket, time.Minute, 2); err != nil || score != 0.0 {
+			t.Errorf("expected the token bucket to start full, got %v (err %v)", score, err)
+		}
+	})
+}
+
+func TestVelocityAlgorithmParam(t *testing.T) {
+	_, err := parseVelocityRule(map[string]interface{}{
+		"intervalSeconds": 60,
+		"limit":           3,
+		"algorithm":       "leakyBucket",
+		"strategy":        "override",
+	})
+	if err == nil {
+		t.Errorf("expected an unknown algorithm to be rejected")
+	}
+}
@@ -0,0 +1,191 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"rba/util"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func init() {
+	Register(RuleType{
+		Name:   util.Rules.Wasm,
+		Params: paramSchema(wasmParams{}),
+		Events: util.AllEvents,
+		Parse:  parseWasmRule,
+	})
+}
+
+const wasmPageSize = 64 * 1024
+
+type wasmParams struct {
+	ID          string        `param:"id,required"`
+	Path        string        `param:"path,required"`
+	MaxMemoryMb int           `param:"maxMemoryMb" default:"16" min:"1" max:"4096"`
+	Timeout     time.Duration `param:"timeoutMs" unit:"ms" default:"50" min:"1"`
+	eventsParams
+	strategyParams
+}
+
+// wasmInput is the JSON document written into the module's memory for each event
+type wasmInput struct {
+	Event string                 `json:"event"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// wasmPlugin holds a compiled module. A fresh instance is created for every event so no state carries over between calls.
+type wasmPlugin struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+}
+
+// loadWasmPlugin compiles a module from disk into a runtime limited to maxMemoryMb that aborts calls when their context ends.
+// Modules must export memory, alloc(size i32) i32 and evaluate(ptr i32, len i32) i64.
+func loadWasmPlugin(ctx context.Context, path string, maxMemoryMb int, timeout time.Duration) (*wasmPlugin, error) {
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(maxMemoryMb * 1024 * 1024 / wasmPageSize)).
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	// WASI is provided for modules built with toolchains that expect it. No filesystem, network or env is exposed.
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{"alloc", "evaluate"} {
+		if _, ok := exports[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("module does not export %s", name)
+		}
+	}
+
+	return &wasmPlugin{runtime: runtime, compiled: compiled, timeout: timeout}, nil
+}
+
+// Evaluate passes the event to the module as JSON and decodes the util.RiskResult it returns.
+// evaluate returns the output location packed as ptr<<32 | len.
+func (p *wasmPlugin) Evaluate(ctx context.Context, input wasmInput) (util.RiskResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return util.RiskResult{}, err
+	}
+
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return util.RiskResult{}, err
+	}
+	defer module.Close(context.Background())
+
+	memory := module.Memory()
+	if memory == nil {
+		return util.RiskResult{}, errors.New("module does not export memory")
+	}
+
+	allocated, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(payload)))
+	if err != nil {
+		return util.RiskResult{}, wasmCallError(ctx, "alloc", err)
+	}
+	inputPtr := uint32(allocated[0])
+	if !memory.Write(inputPtr, payload) {
+		return util.RiskResult{}, errors.New("alloc returned memory out of range")
+	}
+
+	packed, err := module.ExportedFunction("evaluate").Call(ctx, uint64(inputPtr), uint64(len(payload)))
+	if err != nil {
+		return util.RiskResult{}, wasmCallError(ctx, "evaluate", err)
+	}
+	outputPtr, outputLen := uint32(packed[0]>>32), uint32(packed[0])
+	output, ok := memory.Read(outputPtr, outputLen)
+	if !ok {
+		return util.RiskResult{}, errors.New("evaluate returned memory out of range")
+	}
+
+	var result util.RiskResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return util.RiskResult{}, fmt.Errorf("evaluate returned invalid JSON: %w", err)
+	}
+	return result, nil
+}
+
+// wasmCallError reports a call aborted by the context as a timeout rather than the runtime's exit error
+func wasmCallError(ctx context.Context, function string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", function, ctx.Err())
+	}
+	return fmt.Errorf("%s: %w", function, err)
+}
+
+// parseWasmRule loads the module once at load time and returns the handler along with the events it runs on
+func parseWasmRule(raw map[string]interface{}) (util.NamedRiskHandler, []string, error) {
+	var params wasmParams
+	if err := decodeParams(util.Rules.Wasm, raw, &params); err != nil {
+		return util.NamedRiskHandler{}, nil, err
+	}
+
+	events, err := resolveEvents(util.Rules.Wasm, params.Events)
+	if err != nil {
+		return util.NamedRiskHandler{}, nil, err
+	}
+
+	plugin, err := loadWasmPlugin(context.Background(), params.Path, params.MaxMemoryMb, params.Timeout)
+	if err != nil {
+		return util.NamedRiskHandler{}, nil, &ParamError{Rule: util.Rules.Wasm, Key: "path", Msg: fmt.Sprintf("%s could not load module: %v", params.ID, err)}
+	}
+
+	id, strategy := params.ID, params.Strategy
+
+	return util.NamedRiskHandler{
+		Name:     id,
+		Strategy: strategy,
+		Handler: func(ctx context.Context, args map[string]interface{}) util.RiskResult {
+			base := util.RiskResult{
+				Name:     id,
+				Strategy: strategy,
+				Score:    0,
+				Err:      nil,
+			}
+
+			output, err := plugin.Evaluate(ctx, wasmInput{Event: util.EventFromContext(ctx), Data: args})
+			if err != nil {
+				errText := err.Error()
+				result := base
+				result.Err = &errText
+				return result
+			}
+
+			// Name and strategy come from the config, only the score and error are taken from the module
+			result := base
+			result.Score = output.Score
+			result.Err = output.Err
+			if result.Score < 0 || result.Score > 1 {
+				errText := fmt.Sprintf("module returned score %v outside 0 to 1", result.Score)
+				result.Score = 0
+				result.Err = &errText
+			}
+			return result
+		},
+	}, events, nil
+}
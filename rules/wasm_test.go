@@ -0,0 +1,147 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rba/util"
+)
+
+func uleb128(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+func sleb128(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func wasmSection(id byte, content []byte) []byte {
+	return append(append([]byte{id}, uleb128(uint64(len(content)))...), content...)
+}
+
+// buildWasmModule assembles a module exporting memory with minPages, alloc returning a fixed buffer at 2048,
+// and evaluate running evaluateCode. output is placed in memory at 1024.
+func buildWasmModule(minPages uint64, evaluateCode []byte, output string) []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// (i32) -> i32 and (i32, i32) -> i64
+	module = append(module, wasmSection(0x01, []byte{0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e})...)
+	module = append(module, wasmSection(0x03, []byte{0x02, 0x00, 0x01})...)
+	module = append(module, wasmSection(0x05, append([]byte{0x01, 0x00}, uleb128(minPages)...))...)
+
+	exports := []byte{0x03}
+	for i, name := range []string{"memory", "alloc", "evaluate"} {
+		kind, index := byte(0x00), byte(i-1)
+		if name == "memory" {
+			kind, index = 0x02, 0x00
+		}
+		exports = append(exports, byte(len(name)))
+		exports = append(exports, name...)
+		exports = append(exports, kind, index)
+	}
+	module = append(module, wasmSection(0x07, exports)...)
+
+	alloc := []byte{0x00, 0x41, 0x80, 0x10, 0x0b}
+	evaluate := append(append([]byte{0x00}, evaluateCode...), 0x0b)
+	code := []byte{0x02}
+	code = append(append(code, uleb128(uint64(len(alloc)))...), alloc...)
+	code = append(append(code, uleb128(uint64(len(evaluate)))...), evaluate...)
+	module = append(module, wasmSection(0x0a, code)...)
+
+	data := []byte{0x01, 0x00, 0x41, 0x80, 0x08, 0x0b}
+	data = append(append(data, uleb128(uint64(len(output)))...), output...)
+	return append(module, wasmSection(0x0b, data)...)
+}
+
+// returnOutput is an evaluate body returning the packed location of the output written at 1024
+func returnOutput(output string) []byte {
+	return append([]byte{0x42}, sleb128(int64(1024)<<32|int64(len(output)))...)
+}
+
+func writeWasmModule(t *testing.T, module []byte) string {
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(path, module, 0o600); err != nil {
+		t.Fatalf("failed to write module: %v", err)
+	}
+	return path
+}
+
+func TestParseWasmRule(t *testing.T) {
+	output := `{"Score":0.5}`
+	raw := map[string]interface{}{
+		"id":       "plugin",
+		"path":     writeWasmModule(t, buildWasmModule(1, returnOutput(output), output)),
+		"events":   []interface{}{util.Events.Login},
+		"strategy": util.Strategies.Average,
+	}
+
+	handler, events, err := parseWasmRule(raw)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+	if len(events) != 1 || events[0] != util.Events.Login {
+		t.Errorf("expected rule to run on login only, got %v", events)
+	}
+
+	result := handler.Handler(context.Background(), map[string]interface{}{"ip": "1.2.3.4"})
+	if result.Err != nil {
+		t.Fatalf("unexpected error running module: %s", *result.Err)
+	}
+	if result.Name != "plugin" || result.Strategy != util.Strategies.Average || result.Score != 0.5 {
+		t.Errorf("expected plugin average 0.5, got %s %s %v", result.Name, result.Strategy, result.Score)
+	}
+}
+
+func TestParseWasmRuleTimeout(t *testing.T) {
+	// loop br 0 end unreachable
+	spin := []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00}
+	raw := map[string]interface{}{
+		"id":        "spin",
+		"path":      writeWasmModule(t, buildWasmModule(1, spin, "")),
+		"timeoutMs": 10,
+		"strategy":  util.Strategies.Average,
+	}
+
+	handler, _, err := parseWasmRule(raw)
+	if err != nil {
+		t.Fatalf("unexpected error parsing rule: %v", err)
+	}
+
+	result := handler.Handler(context.Background(), map[string]interface{}{})
+	if result.Err == nil || !strings.Contains(*result.Err, "deadline exceeded") {
+		t.Errorf("expected a deadline exceeded error for a module that never returns, got %v", result.Err)
+	}
+}
+
+func TestParseWasmRuleMemoryLimit(t *testing.T) {
+	// 300 pages is just over 18MB, above the 16MB default
+	raw := map[string]interface{}{
+		"id":       "greedy",
+		"path":     writeWasmModule(t, buildWasmModule(300, returnOutput(""), "")),
+		"strategy": util.Strategies.Average,
+	}
+
+	if _, _, err := parseWasmRule(raw); err == nil {
+		t.Errorf("expected a module needing more than the memory limit to fail to load")
+	}
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"rba/state"
+)
+
+// States of a circuit breaker. Closed lets every call through, open rejects them and half open lets one call through
+// to probe whether the service has recovered.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned instead of calling a service while its breaker is open
+var ErrCircuitOpen = errors.New("redis circuit breaker is open")
+
+// RedisBreaker guards the rule state kept in redis. It is set by rules.LoadConfig and nil when the breaker is disabled
+// or state isn't kept in redis.
+var RedisBreaker *Breaker
+
+// Breaker is a circuit breaker. It opens after a number of consecutive failures, rejects calls until a cooldown has
+// passed, then lets a single call through as a probe that closes it on success or opens it again on failure.
+type Breaker struct {
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+	stats       BreakerStats
+}
+
+// BreakerStats are the breaker's state and the counts reported on /metrics
+type BreakerStats struct {
+	State               string
+	ConsecutiveFailures int
+	// Totals since the server started
+	Trips    int64
+	Rejected int64
+	Failures int64
+}
+
+func NewBreaker(failures int, cooldown time.Duration) *Breaker {
+	return &Breaker{failures: failures, cooldown: cooldown, now: time.Now, state: BreakerClosed}
+}
+
+// allow reports whether a call can go ahead and whether it is the probe, moving an open breaker to half open once the
+// cooldown has passed
+func (b *Breaker) allow() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch b.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true, true
+		}
+	}
+	b.stats.Rejected++
+	return false, false
+}
+
+// done records the outcome of a call allow let through. Errors redis answered with, such as a key holding the wrong
+// type, show it is up. A call cancelled by its caller says nothing about redis, so it only ends a probe. Only the
+// probe closes the breaker, calls that started before it opened don't.
+func (b *Breaker) done(err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case err == nil, errors.Is(err, state.ErrWrongType):
+		b.consecutive = 0
+		if probe {
+			b.state = BreakerClosed
+		}
+	case errors.Is(err, context.Canceled):
+	default:
+		b.stats.Failures++
+		b.consecutive++
+		if probe || (b.state == BreakerClosed && b.consecutive >= b.failures) {
+			if b.state != BreakerOpen {
+				b.stats.Trips++
+			}
+			b.state = BreakerOpen
+			b.openedAt = b.now()
+		}
+	}
+}
+
+// Stats returns the breaker's current state and counts
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.State = b.state
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		// The next call will probe
+		stats.State = BreakerHalfOpen
+	}
+	stats.ConsecutiveFailures = b.consecutive
+	return stats
+}
+
+// breakerStore guards a state store with a breaker, so rules fail fast with ErrCircuitOpen while it is open
+type breakerStore struct {
+	store   state.Store
+	breaker *Breaker
+}
+
+// NewBreakerStore wraps a state store so its calls go through the breaker
+func NewBreakerStore(store state.Store, breaker *Breaker) state.Store {
+	return &breakerStore{store: store, breaker: breaker}
+}
+
+// guard runs call if the breaker allows it and records the outcome
+func guard[T any](b *Breaker, call func() (T, error)) (T, error) {
+	allowed, probe := b.allow()
+	if !allowed {
+		var zero T
+		return zero, ErrCircuitOpen
+	}
+	value, err := call()
+	b.done(err, probe)
+	return value, err
+}
+
+// guardErr is guard for calls that only return an error
+func guardErr(b *Breaker, call func() error) error {
+	_, err := guard(b, func() (struct{}, error) {
+		return struct{}{}, call()
+	})
+	return err
+}
+
+func (s *breakerStore) RecordInWindow(ctx context.Context, key string, at int64, interval time.Duration, lateness time.Duration) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.RecordInWindow(ctx, key, at, interval, lateness)
+	})
+}
+
+func (s *breakerStore) CountInWindow(ctx context.Context, key string, at int64, interval time.Duration) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.CountInWindow(ctx, key, at, interval)
+	})
+}
+
+func (s *breakerStore) TakeToken(ctx context.Context, key string, at int64, capacity int, interval time.Duration) (bool, error) {
+	return guard(s.breaker, func() (bool, error) {
+		return s.store.TakeToken(ctx, key, at, capacity, interval)
+	})
+}
+
+func (s *breakerStore) AllowGCRA(ctx context.Context, key string, at int64, limit int, interval time.Duration) (bool, error) {
+	return guard(s.breaker, func() (bool, error) {
+		return s.store.AllowGCRA(ctx, key, at, limit, interval)
+	})
+}
+
+func (s *breakerStore) RecordDistinct(ctx context.Context, key string, at int64, member string, interval time.Duration, lateness time.Duration) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.RecordDistinct(ctx, key, at, member, interval, lateness)
+	})
+}
+
+func (s *breakerStore) DistinctMembers(ctx context.Context, key string, at int64, interval time.Duration) ([]string, error) {
+	return guard(s.breaker, func() ([]string, error) {
+		return s.store.DistinctMembers(ctx, key, at, interval)
+	})
+}
+
+func (s *breakerStore) AddToSet(ctx context.Context, key string, ttl time.Duration, members ...string) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.AddToSet(ctx, key, ttl, members...)
+	})
+}
+
+func (s *breakerStore) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	return guardErr(s.breaker, func() error {
+		return s.store.RemoveFromSet(ctx, key, members...)
+	})
+}
+
+func (s *breakerStore) SetMembers(ctx context.Context, key string) ([]string, error) {
+	return guard(s.breaker, func() ([]string, error) {
+		return s.store.SetMembers(ctx, key)
+	})
+}
+
+func (s *breakerStore) IsMember(ctx context.Context, key string, member string) (bool, error) {
+	return guard(s.breaker, func() (bool, error) {
+		return s.store.IsMember(ctx, key, member)
+	})
+}
+
+func (s *breakerStore) SetSize(ctx context.Context, key string) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.SetSize(ctx, key)
+	})
+}
+
+func (s *breakerStore) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.Increment(ctx, key, ttl)
+	})
+}
+
+func (s *breakerStore) Counter(ctx context.Context, key string) (int64, error) {
+	return guard(s.breaker, func() (int64, error) {
+		return s.store.Counter(ctx, key)
+	})
+}
+
+func (s *breakerStore) IncrementFields(ctx context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error) {
+	return guard(s.breaker, func() (map[string]int64, error) {
+		return s.store.IncrementFields(ctx, key, increments, ttl)
+	})
+}
+
+func (s *breakerStore) AddDecaying(ctx context.Context, key string, at int64, amount float64, halfLife time.Duration, ttl time.Duration) (float64, error) {
+	return guard(s.breaker, func() (float64, error) {
+		return s.store.AddDecaying(ctx, key, at, amount, halfLife, ttl)
+	})
+}
+
+func (s *breakerStore) GetFields(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+	return guard(s.breaker, func() (map[string]string, error) {
+		return s.store.GetFields(ctx, key, fields...)
+	})
+}
+
+func (s *breakerStore) SetFields(ctx context.Context, key string, values map[string]string, ttl time.Duration) error {
+	return guardErr(s.breaker, func() error {
+		return s.store.SetFields(ctx, key, values, ttl)
+	})
+}
+
+func (s *breakerStore) Delete(ctx context.Context, key string) error {
+	return guardErr(s.breaker, func() error {
+		return s.store.Delete(ctx, key)
+	})
+}
+
+func (s *breakerStore) Flush(ctx context.Context) error {
+	return guardErr(s.breaker, func() error {
+		return s.store.Flush(ctx)
+	})
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"rba/state"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	breaker := NewBreaker(3, 5*time.Second)
+	breaker.now = func() time.Time { return now }
+
+	calls := 0
+	call := func(err error) error {
+		return guardErr(breaker, func() error {
+			calls++
+			return err
+		})
+	}
+	down := errors.New("dial tcp: connection refused")
+
+	// Errors redis answered with don't count towards opening the breaker
+	call(down)
+	call(down)
+	call(fmt.Errorf("%w: WRONGTYPE", state.ErrWrongType))
+	call(down)
+	call(down)
+	if stats := breaker.Stats(); stats.State != BreakerClosed || stats.ConsecutiveFailures != 2 {
+		t.Fatalf("expected the breaker to stay closed after a reply, got %+v", stats)
+	}
+
+	call(down)
+	if err := call(nil); !errors.Is(err, ErrCircuitOpen) || calls != 6 {
+		t.Fatalf("expected calls to be short-circuited once open, got %v after %d calls", err, calls)
+	}
+
+	// A failed probe opens the breaker again for another cooldown
+	now = now.Add(5 * time.Second)
+	if stats := breaker.Stats(); stats.State != BreakerHalfOpen {
+		t.Errorf("expected the breaker to be half open after the cooldown, got %s", stats.State)
+	}
+	if err := call(down); err != down {
+		t.Fatalf("expected the probe to reach redis, got %v", err)
+	}
+	if err := call(nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a failed probe to open the breaker, got %v", err)
+	}
+
+	// A successful probe closes it
+	now = now.Add(5 * time.Second)
+	if err := call(nil); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	stats := breaker.Stats()
+	if stats.State != BreakerClosed || stats.Trips != 2 || stats.Rejected != 2 || stats.Failures != 6 {
+		t.Errorf("unexpected stats after recovering: %+v", stats)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	breaker := NewBreaker(1, time.Second)
+	breaker.now = func() time.Time { return now }
+
+	breaker.done(errors.New("timeout"), false)
+	now = now.Add(time.Second)
+
+	if allowed, probe := breaker.allow(); !allowed || !probe {
+		t.Fatalf("expected the first call after the cooldown to probe")
+	}
+	if allowed, _ := breaker.allow(); allowed {
+		t.Errorf("expected other calls to be rejected while the probe runs")
+	}
+
+	// A call cancelled by its caller ends the probe without deciding it
+	breaker.done(context.Canceled, true)
+	if allowed, probe := breaker.allow(); !allowed || !probe {
+		t.Errorf("expected another probe after a cancelled one")
+	}
+}
+
+func TestBreakerStore(t *testing.T) {
+	ctx := context.Background()
+	breaker := NewBreaker(1, time.Minute)
+	store := NewBreakerStore(state.NewMemory(), breaker)
+
+	if count, err := store.Increment(ctx, "counter", time.Minute); err != nil || count != 1 {
+		t.Fatalf("expected calls to reach the store, got %d (err %v)", count, err)
+	}
+
+	breaker.done(errors.New("timeout"), false)
+	if _, err := store.Counter(ctx, "counter"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen while the breaker is open, got %v", err)
+	}
+}
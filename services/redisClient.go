@@ -4,35 +4,44 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/redis/go-redis/v9"
 )
 
 var (
-	RedisClient *redis.Client
+	// A single server, a sentinel managed failover client or a cluster client, depending on the options
+	RedisClient redis.UniversalClient
 	oneRedis    sync.Once
+	// Set from services.redis.keyPrefix, empty for none
+	RedisKeyPrefix string
 )
 
-// GetRedisClient returns a singleton Redis client
-func ConnectRedis(host string) (*redis.Client, error) {
+// ConnectRedis returns a singleton Redis client
+func ConnectRedis(options *redis.UniversalOptions) (redis.UniversalClient, error) {
 	var err error
 
 	oneRedis.Do(func() {
-		RedisClient = redis.NewClient(&redis.Options{
-			Addr: host,
-			DB:   0, // default DB
-		})
+		RedisClient = redis.NewUniversalClient(options)
 
 		ctx := context.Background()
 		if pingErr := RedisClient.Ping(ctx).Err(); pingErr != nil {
-			err = fmt.Errorf("failed to connect to Redis at %s: %w", host, pingErr)
+			err = fmt.Errorf("failed to connect to Redis at %s: %w", strings.Join(options.Addrs, ","), pingErr)
 		}
 	})
 
 	return RedisClient, err
 }
 
+// RedisKey prepends the configured key prefix to a key
+func RedisKey(key string) string {
+	if RedisKeyPrefix == "" {
+		return key
+	}
+	return RedisKeyPrefix + ":" + key
+}
+
 func PingRedis() error {
 	ctx := context.Background()
 	if RedisClient == nil {
@@ -0,0 +1,7 @@
+package services
+
+import "rba/state"
+
+// State holds what rules keep between events, in redis or in memory as configured under services.state. It is set by
+// rules.LoadConfig and nil when no rule needs it.
+var State state.Store
@@ -0,0 +1,455 @@
+package state
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often expired keys are swept from memory. Expired keys are also ignored as soon as they expire.
+const sweepInterval = time.Minute
+
+type kind int
+
+const (
+	windowKind kind = iota
+	distinctKind
+	setKind
+	counterKind
+	hashKind
+)
+
+type memoryEntry struct {
+	kind     kind
+	expires  time.Time
+	window   []int64
+	distinct map[string]int64
+	set      map[string]struct{}
+	counter  int64
+	hash     map[string]string
+}
+
+// Memory keeps state in the process for single node deployments, tests and replays. It is lost on restart and isn't
+// shared between servers.
+type Memory struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: map[string]*memoryEntry{}, now: time.Now}
+}
+
+// lookup returns a live entry of the kind, nil if there is none, or ErrWrongType. The lock must be held.
+func (m *Memory) lookup(key string, k kind) (*memoryEntry, error) {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if !entry.expires.IsZero() && !m.now().Before(entry.expires) {
+		delete(m.entries, key)
+		return nil, nil
+	}
+	if entry.kind != k {
+		return nil, ErrWrongType
+	}
+	return entry, nil
+}
+
+// create returns the live entry of the kind, adding an empty one if there is none. The lock must be held.
+func (m *Memory) create(key string, k kind) (*memoryEntry, error) {
+	m.sweep()
+	entry, err := m.lookup(key, k)
+	if err != nil || entry != nil {
+		return entry, err
+	}
+
+	entry = &memoryEntry{kind: k}
+	switch k {
+	case distinctKind:
+		entry.distinct = map[string]int64{}
+	case setKind:
+		entry.set = map[string]struct{}{}
+	case hashKind:
+		entry.hash = map[string]string{}
+	}
+	m.entries[key] = entry
+	return entry, nil
+}
+
+// expire sets when an entry expires, a ttl of 0 keeps it until it is removed
+func (m *Memory) expire(entry *memoryEntry, ttl time.Duration) {
+	if ttl > 0 {
+		entry.expires = m.now().Add(ttl)
+	}
+}
+
+// sweep removes expired keys at most once per sweepInterval so memory doesn't grow with keys that are never read again.
+// The lock must be held.
+func (m *Memory) sweep() {
+	now := m.now()
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, entry := range m.entries {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func countWindow(window []int64, at int64, interval time.Duration) int64 {
+	windowStart := at - interval.Milliseconds()
+	var count int64
+	for _, entry := range window {
+		if entry >= windowStart && entry <= at {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *Memory) RecordInWindow(ctx context.Context, key string, at int64, interval time.Duration, lateness time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, windowKind)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drop entries no late event can count any more, as the redis store does
+	trimBefore := at - interval.Milliseconds() - lateness.Milliseconds()
+	kept := entry.window[:0]
+	for _, existing := range entry.window {
+		if existing >= trimBefore {
+			kept = append(kept, existing)
+		}
+	}
+	entry.window = append(kept, at)
+	m.expire(entry, interval+lateness)
+	return countWindow(entry.window, at, interval), nil
+}
+
+func (m *Memory) CountInWindow(ctx context.Context, key string, at int64, interval time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, windowKind)
+	if entry == nil {
+		return 0, err
+	}
+	return countWindow(entry.window, at, interval), nil
+}
+
+func (m *Memory) RecordDistinct(ctx context.Context, key string, at int64, member string, interval time.Duration, lateness time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, distinctKind)
+	if err != nil {
+		return 0, err
+	}
+
+	trimBefore := at - interval.Milliseconds() - lateness.Milliseconds()
+	for existing, seen := range entry.distinct {
+		if seen < trimBefore {
+			delete(entry.distinct, existing)
+		}
+	}
+	if seen, ok := entry.distinct[member]; !ok || seen < at {
+		entry.distinct[member] = at
+	}
+	m.expire(entry, interval+lateness)
+	return int64(len(distinctSince(entry.distinct, at-interval.Milliseconds()))), nil
+}
+
+func (m *Memory) DistinctMembers(ctx context.Context, key string, at int64, interval time.Duration) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, distinctKind)
+	if entry == nil {
+		return []string{}, err
+	}
+	return distinctSince(entry.distinct, at-interval.Milliseconds()), nil
+}
+
+// distinctSince returns the members of a distinct window last seen at or after windowStart
+func distinctSince(distinct map[string]int64, windowStart int64) []string {
+	members := []string{}
+	for member, seen := range distinct {
+		if seen >= windowStart {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// hashFloat reads a number from a hash field, ok is false when it is missing or not a number
+func hashFloat(hash map[string]string, field string) (float64, bool) {
+	value, err := strconv.ParseFloat(hash[field], 64)
+	return value, err == nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (m *Memory) TakeToken(ctx context.Context, key string, at int64, capacity int, interval time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, hashKind)
+	if err != nil {
+		return false, err
+	}
+
+	now := float64(at)
+	tokens, ok := hashFloat(entry.hash, "tokens")
+	if !ok {
+		tokens = float64(capacity)
+	}
+	last, ok := hashFloat(entry.hash, "at")
+	if !ok {
+		last = now
+	}
+	if now > last {
+		tokens = math.Min(float64(capacity), tokens+(now-last)*float64(capacity)/float64(interval.Milliseconds()))
+		last = now
+	}
+	taken := tokens >= 1
+	if taken {
+		tokens--
+	}
+
+	entry.hash["tokens"] = formatFloat(tokens)
+	entry.hash["at"] = formatFloat(last)
+	m.expire(entry, interval)
+	return taken, nil
+}
+
+func (m *Memory) AllowGCRA(ctx context.Context, key string, at int64, limit int, interval time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if limit == 0 {
+		return false, nil
+	}
+	entry, err := m.create(key, hashKind)
+	if err != nil {
+		return false, err
+	}
+
+	now := float64(at)
+	tat, ok := hashFloat(entry.hash, "tat")
+	if !ok || tat < now {
+		tat = now
+	}
+	tat += float64(interval.Milliseconds()) / float64(limit)
+	if tat-now > float64(interval.Milliseconds()) {
+		return false, nil
+	}
+
+	entry.hash["tat"] = formatFloat(tat)
+	m.expire(entry, time.Duration(math.Ceil(tat-now))*time.Millisecond)
+	return true, nil
+}
+
+func (m *Memory) AddToSet(ctx context.Context, key string, ttl time.Duration, members ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, setKind)
+	if err != nil {
+		return 0, err
+	}
+	for _, member := range members {
+		entry.set[member] = struct{}{}
+	}
+	m.expire(entry, ttl)
+	return int64(len(entry.set)), nil
+}
+
+func (m *Memory) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, setKind)
+	if entry == nil {
+		return err
+	}
+	for _, member := range members {
+		delete(entry.set, member)
+	}
+	if len(entry.set) == 0 {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *Memory) SetMembers(ctx context.Context, key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, setKind)
+	if entry == nil {
+		return []string{}, err
+	}
+	members := make([]string, 0, len(entry.set))
+	for member := range entry.set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (m *Memory) IsMember(ctx context.Context, key string, member string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, setKind)
+	if entry == nil {
+		return false, err
+	}
+	_, ok := entry.set[member]
+	return ok, nil
+}
+
+func (m *Memory) SetSize(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, setKind)
+	if entry == nil {
+		return 0, err
+	}
+	return int64(len(entry.set)), nil
+}
+
+func (m *Memory) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, counterKind)
+	if err != nil {
+		return 0, err
+	}
+	entry.counter++
+	if entry.counter == 1 {
+		m.expire(entry, ttl)
+	}
+	return entry.counter, nil
+}
+
+func (m *Memory) Counter(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.lookup(key, counterKind)
+	if entry == nil {
+		return 0, err
+	}
+	return entry.counter, nil
+}
+
+func (m *Memory) IncrementFields(ctx context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, hashKind)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.hash) == 0 {
+		m.expire(entry, ttl)
+	}
+	counts := make(map[string]int64, len(increments))
+	for field, increment := range increments {
+		count, _ := strconv.ParseInt(entry.hash[field], 10, 64)
+		count += increment
+		entry.hash[field] = strconv.FormatInt(count, 10)
+		counts[field] = count
+	}
+	return counts, nil
+}
+
+func (m *Memory) AddDecaying(ctx context.Context, key string, at int64, amount float64, halfLife time.Duration, ttl time.Duration) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, hashKind)
+	if err != nil {
+		return 0, err
+	}
+
+	score, _ := hashFloat(entry.hash, "score")
+	updated, err := strconv.ParseInt(entry.hash["updatedAt"], 10, 64)
+	if err != nil {
+		updated = at
+	}
+	halfLifeMs := float64(halfLife.Milliseconds())
+	if at >= updated {
+		score = score*math.Exp2(-float64(at-updated)/halfLifeMs) + amount
+		updated = at
+	} else {
+		score += amount * math.Exp2(-float64(updated-at)/halfLifeMs)
+	}
+
+	entry.hash["score"] = formatFloat(score)
+	entry.hash["updatedAt"] = strconv.FormatInt(updated, 10)
+	m.expire(entry, ttl)
+	return score, nil
+}
+
+func (m *Memory) GetFields(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set := map[string]string{}
+	entry, err := m.lookup(key, hashKind)
+	if entry == nil {
+		return set, err
+	}
+	for _, field := range fields {
+		if value, ok := entry.hash[field]; ok {
+			set[field] = value
+		}
+	}
+	return set, nil
+}
+
+func (m *Memory) SetFields(ctx context.Context, key string, values map[string]string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, err := m.create(key, hashKind)
+	if err != nil {
+		return err
+	}
+	for field, value := range values {
+		entry.hash[field] = value
+	}
+	m.expire(entry, ttl)
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *Memory) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = map[string]*memoryEntry{}
+	return nil
+}
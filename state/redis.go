@@ -0,0 +1,354 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keeps state in redis so it is shared by every server. Windows, of entries or of distinct members, are sorted
+// sets scored by time, sets are sets,
+// counters are strings and hashes are hashes. Operations that read and write the same key run as a single Lua
+// script, so concurrent events can't interleave between the steps and each costs one round trip.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedis keeps state in redis, with every key under prefix when it is set
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) key(key string) string {
+	if r.prefix == "" {
+		return key
+	}
+	return r.prefix + ":" + key
+}
+
+// recordInWindowScript trims entries no late event can count any more, adds the new entry, counts the window up to it
+// and resets the expiry. KEYS[1] window, ARGV at, window start, trim before, member, ttl in ms.
+var recordInWindowScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+local count = redis.call('ZCOUNT', KEYS[1], ARGV[2], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return count
+`)
+
+// recordDistinctScript trims members no late event can count any more, records the member at the later of at and when
+// it was last seen, counts the members seen since the window start and resets the expiry. KEYS[1] window, ARGV at,
+// window start, trim before, member, ttl in ms.
+var recordDistinctScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+local seen = tonumber(redis.call('ZSCORE', KEYS[1], ARGV[4]))
+if not seen or seen < tonumber(ARGV[1]) then
+  redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+end
+local count = redis.call('ZCOUNT', KEYS[1], ARGV[2], '+inf')
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return count
+`)
+
+// addToSetScript adds members, resets the expiry when ttl is above 0 and returns the size.
+// KEYS[1] set, ARGV ttl in ms followed by the members.
+var addToSetScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], unpack(ARGV, 2))
+if tonumber(ARGV[1]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return redis.call('SCARD', KEYS[1])
+`)
+
+// incrementScript increments a counter and sets its expiry on the first increment. KEYS[1] counter, ARGV ttl in ms.
+var incrementScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 and tonumber(ARGV[1]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// incrementFieldsScript adds to fields of a hash and sets its expiry when it is created. KEYS[1] hash, ARGV ttl in ms
+// followed by field and increment pairs.
+var incrementFieldsScript = redis.NewScript(`
+local created = redis.call('EXISTS', KEYS[1]) == 0
+local values = {}
+for i = 2, #ARGV, 2 do
+  values[#values + 1] = redis.call('HINCRBY', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+if created and tonumber(ARGV[1]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return values
+`)
+
+// addDecayingScript decays a score to the later of the event and its last update, then adds the event's decayed
+// amount. KEYS[1] hash, ARGV at, amount, half life and ttl in ms.
+var addDecayingScript = redis.NewScript(`
+local at = tonumber(ARGV[1])
+local amount = tonumber(ARGV[2])
+local halfLife = tonumber(ARGV[3])
+local values = redis.call('HMGET', KEYS[1], 'score', 'updatedAt')
+local score = tonumber(values[1]) or 0
+local updated = tonumber(values[2]) or at
+if at >= updated then
+  score = score * math.pow(2, -(at - updated) / halfLife) + amount
+  updated = at
+else
+  score = score + amount * math.pow(2, -(updated - at) / halfLife)
+end
+local formatted = string.format('%.17g', score)
+redis.call('HSET', KEYS[1], 'score', formatted, 'updatedAt', string.format('%d', updated))
+if tonumber(ARGV[4]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return formatted
+`)
+
+// takeTokenScript refills a token bucket for the time since it was last used and takes a token if there is one.
+// KEYS[1] bucket, ARGV at, capacity, interval in ms.
+var takeTokenScript = redis.NewScript(`
+local at = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(bucket[1]) or capacity
+local last = tonumber(bucket[2]) or at
+if at > last then
+  tokens = math.min(capacity, tokens + (at - last) * capacity / interval)
+  last = at
+end
+local taken = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  taken = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(last))
+redis.call('PEXPIRE', KEYS[1], interval)
+return taken
+`)
+
+// gcraScript allows an event when the theoretical arrival time is no more than the interval ahead of it, then moves
+// the arrival time on by one emission interval. KEYS[1] hash, ARGV at, limit, interval in ms.
+var gcraScript = redis.NewScript(`
+local at = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+if limit == 0 then
+  return 0
+end
+local tat = tonumber(redis.call('HGET', KEYS[1], 'tat')) or at
+if tat < at then
+  tat = at
+end
+tat = tat + interval / limit
+if tat - at > interval then
+  return 0
+end
+redis.call('HSET', KEYS[1], 'tat', tostring(tat))
+redis.call('PEXPIRE', KEYS[1], math.ceil(tat - at))
+return 1
+`)
+
+// Preload loads the scripts into redis so the first events don't have to send them. Scripts are sent again if redis
+// has forgotten them, for example after a restart.
+func (r *Redis) Preload(ctx context.Context) error {
+	for _, script := range []*redis.Script{recordInWindowScript, recordDistinctScript, addToSetScript, incrementScript, incrementFieldsScript, addDecayingScript, takeTokenScript, gcraScript} {
+		if err := script.Load(ctx, r.client).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redisError maps redis errors to the store's. Errors raised inside a script carry the original error in their message.
+func redisError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "WRONGTYPE") {
+		return fmt.Errorf("%w: %v", ErrWrongType, err)
+	}
+	return err
+}
+
+func (r *Redis) RecordInWindow(ctx context.Context, key string, at int64, interval time.Duration, lateness time.Duration) (int64, error) {
+	windowStart := at - interval.Milliseconds()
+	trimBefore := windowStart - lateness.Milliseconds()
+	member := fmt.Sprintf("%d-%d", at, rand.Intn(1000000))
+	count, err := recordInWindowScript.Run(ctx, r.client, []string{r.key(key)}, at, windowStart, trimBefore, member, (interval + lateness).Milliseconds()).Int64()
+	return count, redisError(err)
+}
+
+func (r *Redis) CountInWindow(ctx context.Context, key string, at int64, interval time.Duration) (int64, error) {
+	windowStart := at - interval.Milliseconds()
+	count, err := r.client.ZCount(ctx, r.key(key), strconv.FormatInt(windowStart, 10), strconv.FormatInt(at, 10)).Result()
+	return count, redisError(err)
+}
+
+func (r *Redis) RecordDistinct(ctx context.Context, key string, at int64, member string, interval time.Duration, lateness time.Duration) (int64, error) {
+	windowStart := at - interval.Milliseconds()
+	trimBefore := windowStart - lateness.Milliseconds()
+	count, err := recordDistinctScript.Run(ctx, r.client, []string{r.key(key)}, at, windowStart, trimBefore, member, (interval + lateness).Milliseconds()).Int64()
+	return count, redisError(err)
+}
+
+func (r *Redis) DistinctMembers(ctx context.Context, key string, at int64, interval time.Duration) ([]string, error) {
+	windowStart := at - interval.Milliseconds()
+	members, err := r.client.ZRangeByScore(ctx, r.key(key), &redis.ZRangeBy{Min: strconv.FormatInt(windowStart, 10), Max: "+inf"}).Result()
+	return members, redisError(err)
+}
+
+func (r *Redis) TakeToken(ctx context.Context, key string, at int64, capacity int, interval time.Duration) (bool, error) {
+	taken, err := takeTokenScript.Run(ctx, r.client, []string{r.key(key)}, at, capacity, interval.Milliseconds()).Int64()
+	return taken == 1, redisError(err)
+}
+
+func (r *Redis) AllowGCRA(ctx context.Context, key string, at int64, limit int, interval time.Duration) (bool, error) {
+	allowed, err := gcraScript.Run(ctx, r.client, []string{r.key(key)}, at, limit, interval.Milliseconds()).Int64()
+	return allowed == 1, redisError(err)
+}
+
+func (r *Redis) AddToSet(ctx context.Context, key string, ttl time.Duration, members ...string) (int64, error) {
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, ttl.Milliseconds())
+	for _, member := range members {
+		args = append(args, member)
+	}
+	size, err := addToSetScript.Run(ctx, r.client, []string{r.key(key)}, args...).Int64()
+	return size, redisError(err)
+}
+
+func (r *Redis) IncrementFields(ctx context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error) {
+	fields := slices.Sorted(maps.Keys(increments))
+	args := make([]interface{}, 0, 2*len(fields)+1)
+	args = append(args, ttl.Milliseconds())
+	for _, field := range fields {
+		args = append(args, field, increments[field])
+	}
+	values, err := incrementFieldsScript.Run(ctx, r.client, []string{r.key(key)}, args...).Int64Slice()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	counts := make(map[string]int64, len(fields))
+	for i, field := range fields {
+		counts[field] = values[i]
+	}
+	return counts, nil
+}
+
+func (r *Redis) AddDecaying(ctx context.Context, key string, at int64, amount float64, halfLife time.Duration, ttl time.Duration) (float64, error) {
+	score, err := addDecayingScript.Run(ctx, r.client, []string{r.key(key)}, at, amount, halfLife.Milliseconds(), ttl.Milliseconds()).Text()
+	if err != nil {
+		return 0, redisError(err)
+	}
+	return strconv.ParseFloat(score, 64)
+}
+
+func (r *Redis) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return redisError(r.client.SRem(ctx, r.key(key), values...).Err())
+}
+
+func (r *Redis) SetMembers(ctx context.Context, key string) ([]string, error) {
+	members, err := r.client.SMembers(ctx, r.key(key)).Result()
+	return members, redisError(err)
+}
+
+func (r *Redis) IsMember(ctx context.Context, key string, member string) (bool, error) {
+	isMember, err := r.client.SIsMember(ctx, r.key(key), member).Result()
+	return isMember, redisError(err)
+}
+
+func (r *Redis) SetSize(ctx context.Context, key string) (int64, error) {
+	size, err := r.client.SCard(ctx, r.key(key)).Result()
+	return size, redisError(err)
+}
+
+func (r *Redis) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	count, err := incrementScript.Run(ctx, r.client, []string{r.key(key)}, ttl.Milliseconds()).Int64()
+	return count, redisError(err)
+}
+
+func (r *Redis) Counter(ctx context.Context, key string) (int64, error) {
+	count, err := r.client.Get(ctx, r.key(key)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return count, redisError(err)
+}
+
+func (r *Redis) GetFields(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+	values, err := r.client.HMGet(ctx, r.key(key), fields...).Result()
+	if err != nil {
+		return nil, redisError(err)
+	}
+
+	set := make(map[string]string, len(fields))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			set[fields[i]] = s
+		}
+	}
+	return set, nil
+}
+
+func (r *Redis) SetFields(ctx context.Context, key string, values map[string]string, ttl time.Duration) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.key(key), values)
+		if ttl > 0 {
+			pipe.Expire(ctx, r.key(key), ttl)
+		}
+		return nil
+	})
+	return redisError(err)
+}
+
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	return redisError(r.client.Del(ctx, r.key(key)).Err())
+}
+
+// Flush deletes the database, or only the keys under the prefix when there is one so other environments sharing the
+// database are left alone
+func (r *Redis) Flush(ctx context.Context) error {
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return r.flushNode(ctx, client)
+		})
+	}
+	return r.flushNode(ctx, r.client)
+}
+
+func (r *Redis) flushNode(ctx context.Context, client redis.Cmdable) error {
+	if r.prefix == "" {
+		return client.FlushDB(ctx).Err()
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, r.prefix+":*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		// One key at a time, keys from a scan can be in different cluster slots
+		for _, key := range keys {
+			if err := client.Del(ctx, key).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
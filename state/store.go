@@ -0,0 +1,70 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrWrongType is returned when a key holds a different kind of value than the operation works on
+var ErrWrongType = errors.New("key holds a different kind of value")
+
+// Store holds the state rules keep between events: sliding windows, sets, counters and small hashes, each of which can
+// expire. A ttl of 0 means the key doesn't expire.
+type Store interface {
+	// RecordInWindow adds an entry at the unix millisecond at to a sliding window and returns the number of entries in
+	// the interval up to at. Entries are kept for the interval plus lateness after the newest, so an event arriving up to
+	// lateness late is still counted against the entries before it. The window expires that long after its last entry.
+	RecordInWindow(ctx context.Context, key string, at int64, interval time.Duration, lateness time.Duration) (int64, error)
+	// CountInWindow returns the number of entries in the interval up to at without adding one
+	CountInWindow(ctx context.Context, key string, at int64, interval time.Duration) (int64, error)
+
+	// TakeToken takes a token at the unix millisecond at from a bucket holding up to capacity tokens, refilled at
+	// capacity tokens per interval, and reports whether there was one. Nothing is taken when the bucket is empty. The
+	// bucket is a hash of tokens and at, and expires once it would be full again.
+	TakeToken(ctx context.Context, key string, at int64, capacity int, interval time.Duration) (bool, error)
+	// AllowGCRA reports whether an event at the unix millisecond at conforms to a rate of limit events per interval,
+	// using the generic cell rate algorithm, and records it if so. The theoretical arrival time of the next event is
+	// kept in the hash field tat, which expires once any event would conform again.
+	AllowGCRA(ctx context.Context, key string, at int64, limit int, interval time.Duration) (bool, error)
+
+	// RecordDistinct records member as seen at the unix millisecond at in a sliding window of distinct members, keeping
+	// the latest time each was seen, and returns the number seen in the interval up to at. Members seen since at, by
+	// events that arrived before a late one, are counted too. Members are kept for the interval plus lateness after
+	// they were last seen, and the window expires that long after its last entry.
+	RecordDistinct(ctx context.Context, key string, at int64, member string, interval time.Duration, lateness time.Duration) (int64, error)
+	// DistinctMembers returns the members of a sliding window seen in the interval up to at, or since
+	DistinctMembers(ctx context.Context, key string, at int64, interval time.Duration) ([]string, error)
+
+	// AddToSet adds members to a set, resets its expiry to ttl and returns the number of members
+	AddToSet(ctx context.Context, key string, ttl time.Duration, members ...string) (int64, error)
+	RemoveFromSet(ctx context.Context, key string, members ...string) error
+	SetMembers(ctx context.Context, key string) ([]string, error)
+	IsMember(ctx context.Context, key string, member string) (bool, error)
+	SetSize(ctx context.Context, key string) (int64, error)
+
+	// Increment adds one to a counter and returns the new count. The counter expires ttl after its first increment.
+	Increment(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Counter returns a counter's value, 0 if it doesn't exist
+	Counter(ctx context.Context, key string) (int64, error)
+
+	// IncrementFields adds to integer fields of a hash and returns their new values. The hash expires ttl after it is
+	// created, so its fields are counted over the same span and reset together.
+	IncrementFields(ctx context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error)
+
+	// AddDecaying adds amount at the unix millisecond at to a score that halves every halfLife, kept in the hash fields
+	// score and updatedAt, and returns the new score. The score is decayed to the later of at and updatedAt before the
+	// amount, decayed the same way, is added, so updatedAt never moves back. The hash expires ttl after the update.
+	AddDecaying(ctx context.Context, key string, at int64, amount float64, halfLife time.Duration, ttl time.Duration) (float64, error)
+
+	// GetFields returns the fields of a hash that are set
+	GetFields(ctx context.Context, key string, fields ...string) (map[string]string, error)
+	// SetFields sets fields of a hash and resets its expiry to ttl
+	SetFields(ctx context.Context, key string, values map[string]string, ttl time.Duration) error
+
+	// Delete removes a key of any kind, doing nothing if it doesn't exist
+	Delete(ctx context.Context, key string) error
+
+	// Flush deletes everything in the store. Only for tests and scratch stores used by replays.
+	Flush(ctx context.Context) error
+}
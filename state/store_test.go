@@ -0,0 +1,537 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var redisClient *redis.Client
+
+// TestMain connects to redis on database 3, apart from the other packages' tests which may run at the same time
+func TestMain(m *testing.M) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	redisClient = redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   3,
+	})
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		panic(fmt.Sprintf("failed to connect to redis at %s: %v", addr, err))
+	}
+
+	code := m.Run()
+	redisClient.Close()
+	os.Exit(code)
+}
+
+// eachStore runs a test against an empty redis store and an empty memory store, which should behave the same
+func eachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("redis", func(t *testing.T) {
+		store := NewRedis(redisClient, "")
+		if err := store.Flush(context.Background()); err != nil {
+			t.Fatalf("failed to flush redis: %v", err)
+		}
+		test(t, store)
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory())
+	})
+}
+
+func TestWindow(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now().UnixMilli()
+		interval := time.Minute
+
+		for _, at := range []int64{now - 90_000, now - 30_000, now - 10_000} {
+			if _, err := store.RecordInWindow(ctx, "window", at, interval, 0); err != nil {
+				t.Fatalf("unexpected error recording: %v", err)
+			}
+		}
+
+		// A late entry is only counted against what came before it
+		count, err := store.RecordInWindow(ctx, "window", now-20_000, interval, 0)
+		if err != nil || count != 2 {
+			t.Errorf("expected 2 entries up to the late entry, got %d (err %v)", count, err)
+		}
+		count, err = store.CountInWindow(ctx, "window", now, interval)
+		if err != nil || count != 3 {
+			t.Errorf("expected 3 entries in the last minute, got %d (err %v)", count, err)
+		}
+		if count, _ := store.CountInWindow(ctx, "missing", now, interval); count != 0 {
+			t.Errorf("expected 0 entries in a missing window, got %d", count)
+		}
+	})
+}
+
+func TestWindowLateness(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now().UnixMilli()
+		interval, lateness := time.Minute, 30*time.Second
+
+		store.RecordInWindow(ctx, "window", now-65_000, interval, lateness)
+		store.RecordInWindow(ctx, "window", now, interval, lateness)
+
+		// The newer entry doesn't trim the one a late event within the lateness still counts
+		count, err := store.RecordInWindow(ctx, "window", now-20_000, interval, lateness)
+		if err != nil || count != 2 {
+			t.Errorf("expected the late entry to count the entry before it, got %d (err %v)", count, err)
+		}
+		if count, _ := store.CountInWindow(ctx, "window", now, interval); count != 2 {
+			t.Errorf("expected 2 entries in the last minute, got %d", count)
+		}
+	})
+}
+
+func TestTakeToken(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now().UnixMilli()
+		take := func(at int64) bool {
+			taken, err := store.TakeToken(ctx, "bucket", at, 2, time.Minute)
+			if err != nil {
+				t.Fatalf("unexpected error taking a token: %v", err)
+			}
+			return taken
+		}
+
+		if !take(now) || !take(now) {
+			t.Errorf("expected a full bucket to hold 2 tokens")
+		}
+		if take(now + 1000) {
+			t.Errorf("expected the bucket to be empty a second later")
+		}
+		// One token refills every 30 seconds
+		if !take(now + 30_000) {
+			t.Errorf("expected a token to have refilled after 30 seconds")
+		}
+		if take(now + 31_000) {
+			t.Errorf("expected the refilled token to be taken")
+		}
+
+		fields, err := store.GetFields(ctx, "bucket", "tokens", "at")
+		if err != nil || len(fields) != 2 {
+			t.Errorf("expected the bucket's tokens and time to be readable, got %v (err %v)", fields, err)
+		}
+	})
+}
+
+func TestAllowGCRA(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now().UnixMilli()
+		allow := func(key string, at int64, limit int) bool {
+			allowed, err := store.AllowGCRA(ctx, key, at, limit, time.Minute)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return allowed
+		}
+
+		// A burst up to the limit conforms, the next event doesn't until an emission interval has passed
+		for i := 0; i < 3; i++ {
+			if !allow("gcra", now, 3) {
+				t.Fatalf("expected event %d of a burst of 3 to conform", i+1)
+			}
+		}
+		if allow("gcra", now, 3) {
+			t.Errorf("expected the 4th event in a burst of 3 not to conform")
+		}
+		if allow("gcra", now+19_000, 3) {
+			t.Errorf("expected an event before the emission interval of 20 seconds not to conform")
+		}
+		if !allow("gcra", now+20_000, 3) {
+			t.Errorf("expected an event after the emission interval to conform")
+		}
+
+		if allow("none", now, 0) {
+			t.Errorf("expected nothing to conform to a limit of 0")
+		}
+	})
+}
+
+func TestDistinctWindow(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now().UnixMilli()
+		interval, lateness := time.Minute, 30*time.Second
+
+		store.RecordDistinct(ctx, "distinct", now-100_000, "a", interval, lateness)
+		store.RecordDistinct(ctx, "distinct", now-50_000, "b", interval, lateness)
+		store.RecordDistinct(ctx, "distinct", now-40_000, "b", interval, lateness)
+
+		// a is out of the interval, b counts once however often it is seen
+		count, err := store.RecordDistinct(ctx, "distinct", now, "c", interval, lateness)
+		if err != nil || count != 2 {
+			t.Errorf("expected b and c in the last minute, got %d (err %v)", count, err)
+		}
+		// Seeing a again brings it back into the window
+		if count, _ := store.RecordDistinct(ctx, "distinct", now, "a", interval, lateness); count != 3 {
+			t.Errorf("expected a, b and c once a is seen again, got %d", count)
+		}
+		// A member seen earlier than its latest sighting keeps the latest
+		if count, _ := store.RecordDistinct(ctx, "distinct", now+30_000, "d", interval, lateness); count != 3 {
+			t.Errorf("expected a, c and d, b having left the interval, got %d", count)
+		}
+		store.RecordDistinct(ctx, "distinct", now-10_000, "d", interval, lateness)
+
+		members, err := store.DistinctMembers(ctx, "distinct", now+30_000, interval)
+		slices.Sort(members)
+		if err != nil || !slices.Equal(members, []string{"a", "c", "d"}) {
+			t.Errorf("expected a, c and d in the window, got %v (err %v)", members, err)
+		}
+		if members, err := store.DistinctMembers(ctx, "missing", now, interval); err != nil || len(members) != 0 {
+			t.Errorf("expected no members for a missing window, got %v (err %v)", members, err)
+		}
+	})
+}
+
+func TestSets(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		size, err := store.AddToSet(ctx, "set", time.Minute, "a", "b", "a")
+		if err != nil || size != 2 {
+			t.Fatalf("expected 2 distinct members, got %d (err %v)", size, err)
+		}
+		if err := store.RemoveFromSet(ctx, "set", "a"); err != nil {
+			t.Fatalf("unexpected error removing: %v", err)
+		}
+
+		members, _ := store.SetMembers(ctx, "set")
+		if !slices.Equal(members, []string{"b"}) {
+			t.Errorf("expected only b to remain, got %v", members)
+		}
+		if isMember, _ := store.IsMember(ctx, "set", "a"); isMember {
+			t.Errorf("expected a to be removed")
+		}
+		if size, _ := store.SetSize(ctx, "set"); size != 1 {
+			t.Errorf("expected 1 member, got %d", size)
+		}
+		if members, err := store.SetMembers(ctx, "missing"); err != nil || len(members) != 0 {
+			t.Errorf("expected no members for a missing set, got %v (err %v)", members, err)
+		}
+	})
+}
+
+func TestCountersAndFields(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		store.Increment(ctx, "counter", time.Minute)
+		if count, err := store.Increment(ctx, "counter", time.Minute); err != nil || count != 2 {
+			t.Errorf("expected the counter to reach 2, got %d (err %v)", count, err)
+		}
+		if count, err := store.Counter(ctx, "missing"); err != nil || count != 0 {
+			t.Errorf("expected a missing counter to be 0, got %d (err %v)", count, err)
+		}
+
+		if err := store.SetFields(ctx, "hash", map[string]string{"score": "0.5"}, time.Minute); err != nil {
+			t.Fatalf("unexpected error setting fields: %v", err)
+		}
+		fields, err := store.GetFields(ctx, "hash", "score", "updatedAt")
+		if err != nil || len(fields) != 1 || fields["score"] != "0.5" {
+			t.Errorf("expected only score to be set, got %v (err %v)", fields, err)
+		}
+
+		if _, err := store.AddToSet(ctx, "counter", 0, "a"); !errors.Is(err, ErrWrongType) {
+			t.Errorf("expected ErrWrongType adding to a counter, got %v", err)
+		}
+
+		counts, err := store.IncrementFields(ctx, "outcomes", map[string]int64{"attempts": 1, "unknown": 1}, time.Minute)
+		if err != nil || counts["attempts"] != 1 || counts["unknown"] != 1 {
+			t.Errorf("expected both fields to be 1, got %v (err %v)", counts, err)
+		}
+		counts, err = store.IncrementFields(ctx, "outcomes", map[string]int64{"attempts": 1, "unknown": 0}, time.Minute)
+		if err != nil || counts["attempts"] != 2 || counts["unknown"] != 1 {
+			t.Errorf("expected 2 attempts and 1 unknown, got %v (err %v)", counts, err)
+		}
+
+		if err := store.Delete(ctx, "counter"); err != nil {
+			t.Fatalf("unexpected error deleting: %v", err)
+		}
+		if count, err := store.Counter(ctx, "counter"); err != nil || count != 0 {
+			t.Errorf("expected a deleted counter to be 0, got %d (err %v)", count, err)
+		}
+		if err := store.Delete(ctx, "missing"); err != nil {
+			t.Errorf("expected deleting a missing key to succeed, got %v", err)
+		}
+	})
+}
+
+func TestAddDecaying(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).UnixMilli()
+		hour := time.Hour.Milliseconds()
+
+		store.AddDecaying(ctx, "risk", at, 1, time.Hour, 10*time.Hour)
+		score, err := store.AddDecaying(ctx, "risk", at+hour, 1, time.Hour, 10*time.Hour)
+		if err != nil || math.Abs(score-1.5) > 1e-9 {
+			t.Errorf("expected the first score to halve before adding, got %v (err %v)", score, err)
+		}
+
+		// A late event is decayed to the latest update, which doesn't move back
+		score, err = store.AddDecaying(ctx, "risk", at, 1, time.Hour, 10*time.Hour)
+		if err != nil || math.Abs(score-2) > 1e-9 {
+			t.Errorf("expected the late amount to be halved, got %v (err %v)", score, err)
+		}
+		fields, _ := store.GetFields(ctx, "risk", "updatedAt")
+		if fields["updatedAt"] != strconv.FormatInt(at+hour, 10) {
+			t.Errorf("expected updatedAt to stay at the latest event, got %v", fields)
+		}
+	})
+}
+
+func TestConcurrentAddDecaying(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		at := time.Now().UnixMilli()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.AddDecaying(ctx, "risk", at, 0.1, time.Hour, time.Hour); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		fields, _ := store.GetFields(ctx, "risk", "score")
+		if score, _ := strconv.ParseFloat(fields["score"], 64); math.Abs(score-5) > 1e-9 {
+			t.Errorf("expected no update to be lost, got %v", score)
+		}
+	})
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	store.AddToSet(ctx, "set", time.Minute, "a")
+	store.Increment(ctx, "counter", time.Minute)
+	store.AddToSet(ctx, "kept", 0, "a")
+	store.AddToSet(ctx, "unread", time.Minute, "a")
+	store.IncrementFields(ctx, "outcomes", map[string]int64{"attempts": 1}, time.Minute)
+
+	// Later increments don't move the hash's expiry, so all its fields reset together
+	now = now.Add(30 * time.Second)
+	store.IncrementFields(ctx, "outcomes", map[string]int64{"unknown": 1}, time.Minute)
+
+	now = now.Add(30 * time.Second)
+	if fields, _ := store.GetFields(ctx, "outcomes", "attempts", "unknown"); len(fields) != 0 {
+		t.Errorf("expected the hash to expire a minute after it was created, got %v", fields)
+	}
+	if size, _ := store.SetSize(ctx, "set"); size != 0 {
+		t.Errorf("expected the set to expire, got %d members", size)
+	}
+	if count, _ := store.Counter(ctx, "counter"); count != 0 {
+		t.Errorf("expected the counter to expire, got %d", count)
+	}
+	if size, _ := store.SetSize(ctx, "kept"); size != 1 {
+		t.Errorf("expected a set without a ttl to be kept, got %d members", size)
+	}
+
+	// A write after the sweep interval drops expired keys that are never read again
+	store.Increment(ctx, "other", 0)
+	store.mu.Lock()
+	_, held := store.entries["unread"]
+	store.mu.Unlock()
+	if held {
+		t.Errorf("expected the expired, unread set to be swept")
+	}
+}
+
+func TestConcurrentRecordInWindow(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		at := time.Now().UnixMilli()
+		const events = 50
+
+		counts := make(chan int64, events)
+		errs := make(chan error, events)
+		var wg sync.WaitGroup
+		for i := 0; i < events; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				count, err := store.RecordInWindow(ctx, "window", at, time.Minute, 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				counts <- count
+			}()
+		}
+		wg.Wait()
+		close(counts)
+		close(errs)
+
+		for err := range errs {
+			t.Fatalf("unexpected error recording: %v", err)
+		}
+		// Each event must see the window including itself and every event recorded before it, never a count another
+		// event also saw
+		var seen []int64
+		for count := range counts {
+			seen = append(seen, count)
+		}
+		slices.Sort(seen)
+		for i, count := range seen {
+			if count != int64(i+1) {
+				t.Fatalf("expected each event to see a distinct count from 1 to %d, got %v", events, seen)
+			}
+		}
+	})
+}
+
+func TestRedisReloadsFlushedScripts(t *testing.T) {
+	ctx := context.Background()
+	store := NewRedis(redisClient, "")
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+	if err := store.Preload(ctx); err != nil {
+		t.Fatalf("unexpected error preloading scripts: %v", err)
+	}
+	if err := redisClient.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush scripts: %v", err)
+	}
+
+	if count, err := store.Increment(ctx, "counter", time.Minute); err != nil || count != 1 {
+		t.Errorf("expected the script to be sent again after redis forgot it, got %d (err %v)", count, err)
+	}
+}
+
+// eachStoreB runs a benchmark against an empty redis store and an empty memory store. The redis numbers are mostly
+// round trips to the server, so run them against a server as far away as production's.
+func eachStoreB(b *testing.B, bench func(b *testing.B, store Store)) {
+	b.Run("redis", func(b *testing.B) {
+		store := NewRedis(redisClient, "")
+		if err := store.Flush(context.Background()); err != nil {
+			b.Fatalf("failed to flush redis: %v", err)
+		}
+		if err := store.Preload(context.Background()); err != nil {
+			b.Fatalf("failed to preload scripts: %v", err)
+		}
+		b.ResetTimer()
+		bench(b, store)
+	})
+	b.Run("memory", func(b *testing.B) {
+		bench(b, NewMemory())
+	})
+}
+
+func BenchmarkRecordInWindow(b *testing.B) {
+	eachStoreB(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			key := fmt.Sprintf("window:%d", i%100)
+			if _, err := store.RecordInWindow(ctx, key, time.Now().UnixMilli(), time.Minute, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRecordInWindowParallel(b *testing.B) {
+	eachStoreB(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := store.RecordInWindow(ctx, "window", time.Now().UnixMilli(), time.Minute, 0); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkAddToSet(b *testing.B) {
+	eachStoreB(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.AddToSet(ctx, fmt.Sprintf("set:%d", i%100), time.Minute, fmt.Sprintf("member:%d", i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkIncrement(b *testing.B) {
+	eachStoreB(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Increment(ctx, fmt.Sprintf("counter:%d", i%100), time.Minute); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkTakeToken(b *testing.B) {
+	eachStoreB(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.TakeToken(ctx, fmt.Sprintf("bucket:%d", i%100), time.Now().UnixMilli(), 10, time.Minute); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkAllowGCRA(b *testing.B) {
+	eachStoreB(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.AllowGCRA(ctx, fmt.Sprintf("gcra:%d", i%100), time.Now().UnixMilli(), 10, time.Minute); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	ctx := context.Background()
+	if err := NewRedis(redisClient, "").Flush(ctx); err != nil {
+		t.Fatalf("failed to flush redis: %v", err)
+	}
+	dev, prod := NewRedis(redisClient, "dev"), NewRedis(redisClient, "prod")
+
+	dev.Increment(ctx, "counter", time.Minute)
+	if count, _ := prod.Counter(ctx, "counter"); count != 0 {
+		t.Errorf("expected prod not to see dev's counter, got %d", count)
+	}
+	if exists, _ := redisClient.Exists(ctx, "dev:counter").Result(); exists != 1 {
+		t.Errorf("expected the counter to be kept under the dev prefix")
+	}
+
+	prod.Increment(ctx, "counter", time.Minute)
+	if err := dev.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	if count, _ := prod.Counter(ctx, "counter"); count != 1 {
+		t.Errorf("expected flushing dev to leave prod's keys, got %d", count)
+	}
+}
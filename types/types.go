@@ -1,6 +1,27 @@
 package types
 
+import "gopkg.in/yaml.v3"
+
 type RuleConfig struct {
 	Name   string                 `yaml:"name"`
 	Params map[string]interface{} `yaml:",inline"`
+	// Line of the rule in the config file, and of each of its settings, used to locate errors
+	Line       int            `yaml:"-"`
+	ParamLines map[string]int `yaml:"-"`
+}
+
+func (r *RuleConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain RuleConfig
+	var decoded plain
+	if err := node.Decode(&decoded); err != nil {
+		return err
+	}
+
+	*r = RuleConfig(decoded)
+	r.Line = node.Line
+	r.ParamLines = map[string]int{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		r.ParamLines[node.Content[i].Value] = node.Content[i].Line
+	}
+	return nil
 }
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"errors"
+	"time"
+)
+
+// Clock tells the time events are received at. The server uses SystemClock, replays and tests substitute their own so
+// results don't depend on when they run.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reads the wall clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ErrLateEvent is returned for events stamped further in the past than the allowed lateness
+var ErrLateEvent = errors.New("event timestamp is older than the allowed lateness")
+
+// ResolveEventTime returns the time an event is assessed at. Events without a timestamp, or stamped ahead of when they
+// were received, are assessed at received. Events stamped more than allowedLateness before received are rejected.
+func ResolveEventTime(timestamp *time.Time, received time.Time, allowedLateness time.Duration) (time.Time, error) {
+	if timestamp == nil || timestamp.After(received) {
+		return received, nil
+	}
+	if received.Sub(*timestamp) > allowedLateness {
+		return time.Time{}, ErrLateEvent
+	}
+	return *timestamp, nil
+}
@@ -1,25 +1,81 @@
 package util
 
 type serviceConstants struct {
-	Redis string
-	Nats  string
+	Redis  string
+	Nats   string
+	Memory string
 }
 
 var Services = serviceConstants{
-	Redis: "redis",
-	Nats:  "nats",
+	Redis:  "redis",
+	Nats:   "nats",
+	Memory: "memory",
 }
 
 type rules struct {
 	Denylist             string
 	Velocity             string
 	HorizontalBruteForce string
+	MfaFatigue           string
+	AccountEnumeration   string
+	IdentifierReputation string
+	EntityRisk           string
+	Expression           string
+	Wasm                 string
 }
 
 var Rules = rules{
 	Denylist:             "denylist",
 	Velocity:             "velocity",
 	HorizontalBruteForce: "horizontalBruteForce",
+	MfaFatigue:           "mfaFatigue",
+	AccountEnumeration:   "accountEnumeration",
+	IdentifierReputation: "identifierReputation",
+	EntityRisk:           "entityRisk",
+	Expression:           "expression",
+	Wasm:                 "wasm",
+}
+
+type events struct {
+	Login                string
+	LoginFailure         string
+	MfaChallenge         string
+	MfaFailure           string
+	MfaDenied            string
+	PasswordResetRequest string
+	Registration         string
+}
+
+var Events = events{
+	Login:                "login",
+	LoginFailure:         "login_failure",
+	MfaChallenge:         "mfa_challenge",
+	MfaFailure:           "mfa_failure",
+	MfaDenied:            "mfa_denied",
+	PasswordResetRequest: "password_reset_request",
+	Registration:         "registration",
+}
+
+var AllEvents = []string{
+	Events.Login,
+	Events.LoginFailure,
+	Events.MfaChallenge,
+	Events.MfaFailure,
+	Events.MfaDenied,
+	Events.PasswordResetRequest,
+	Events.Registration,
+}
+
+type entities struct {
+	IP      string
+	Account string
+	Device  string
+}
+
+var Entities = entities{
+	IP:      "ip",
+	Account: "account",
+	Device:  "device",
 }
 
 type strategies struct {
@@ -31,3 +87,57 @@ var Strategies = strategies{
 	Override: "override",
 	Average:  "average",
 }
+
+type decisions struct {
+	Alert     string
+	Pass      string
+	Late      string
+	Challenge string
+}
+
+// Decisions reported for an assessed event. Alert matches when the server publishes to NATS, late events are rejected
+// for being older than the allowed lateness and not assessed. Challenge asks the caller to step up authentication
+// because a rule with onError: challenge could not assess the event.
+var Decisions = decisions{
+	Alert:     "alert",
+	Pass:      "pass",
+	Late:      "late",
+	Challenge: "challenge",
+}
+
+type labels struct {
+	ConfirmedFraud string
+	FalsePositive  string
+	Legitimate     string
+}
+
+// Labels an analyst can give an assessed event. Confirmed fraud is the positive class in feedback reports.
+var Labels = labels{
+	ConfirmedFraud: "confirmed_fraud",
+	FalsePositive:  "false_positive",
+	Legitimate:     "legitimate",
+}
+
+type modes struct {
+	Enforce string
+	Shadow  string
+}
+
+// Modes a rule can run in, set with the mode key on any rule
+var Modes = modes{
+	Enforce: "enforce",
+	Shadow:  "shadow",
+}
+
+type errorActions struct {
+	Ignore    string
+	Score     string
+	Challenge string
+}
+
+// ErrorActions a rule can take when it errors or runs out of time, set with the onError key on any rule
+var ErrorActions = errorActions{
+	Ignore:    "ignore",
+	Score:     "score",
+	Challenge: "challenge",
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey string
+
+const (
+	eventContextKey     contextKey = "event"
+	eventTimeContextKey contextKey = "eventTime"
+	namespaceContextKey contextKey = "namespace"
+	keyIDContextKey     contextKey = "keyID"
+	tenantContextKey    contextKey = "tenant"
+)
+
+// WithEvent stores the name of the event being assessed so handlers shared across events can branch on it
+func WithEvent(ctx context.Context, event string) context.Context {
+	return context.WithValue(ctx, eventContextKey, event)
+}
+
+// EventFromContext returns the event name set by WithEvent, or an empty string if none was set
+func EventFromContext(ctx context.Context) string {
+	event, _ := ctx.Value(eventContextKey).(string)
+	return event
+}
+
+// WithEventTime stores when the event being assessed happened, windowed rules count it at this time
+func WithEventTime(ctx context.Context, eventTime time.Time) context.Context {
+	return context.WithValue(ctx, eventTimeContextKey, eventTime)
+}
+
+// EventTimeFromContext returns the time set by WithEventTime, or the current time if none was set
+func EventTimeFromContext(ctx context.Context) time.Time {
+	if eventTime, ok := ctx.Value(eventTimeContextKey).(time.Time); ok {
+		return eventTime
+	}
+	return time.Now()
+}
+
+// WithNamespace sets the prefix for the redis keys rules keep their state under
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceContextKey, namespace)
+}
+
+// NamespaceFromContext returns the namespace set by WithNamespace, or an empty string for the default namespace
+func NamespaceFromContext(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceContextKey).(string)
+	return namespace
+}
+
+// WithKeyID stores the ID of the API key a request was authenticated with
+func WithKeyID(ctx context.Context, keyID string) context.Context {
+	return context.WithValue(ctx, keyIDContextKey, keyID)
+}
+
+// KeyIDFromContext returns the API key ID set by WithKeyID, or an empty string if the request wasn't authenticated
+func KeyIDFromContext(ctx context.Context) string {
+	keyID, _ := ctx.Value(keyIDContextKey).(string)
+	return keyID
+}
+
+// WithTenant stores the tenant a request belongs to, rules keep each tenant's state apart
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey, tenant)
+}
+
+// TenantFromContext returns the tenant set by WithTenant, or an empty string when tenants aren't isolated
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey).(string)
+	return tenant
+}
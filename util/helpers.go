@@ -7,6 +7,7 @@ import (
 	"log"
 	"rba/services"
 	"rba/types"
+	"slices"
 )
 
 func GetStringField(m map[string]interface{}, key string) (string, error) {
@@ -23,13 +24,21 @@ func GetStringField(m map[string]interface{}, key string) (string, error) {
 
 func CalculateRisk(resultsChan <-chan RiskResult) (float64, []RiskResult) {
 	var results []RiskResult
+	for result := range resultsChan {
+		results = append(results, result)
+	}
+	return AggregateRisk(results), results
+}
+
+// AggregateRisk combines rule results into a single score using each result's strategy. Errored results are left out
+// unless their error policy gave them a score.
+func AggregateRisk(results []RiskResult) float64 {
 	var sum float64
 	var count int
 	var override bool
 
-	for result := range resultsChan {
-		results = append(results, result)
-		if result.Err == nil {
+	for _, result := range results {
+		if result.Err == nil || result.OnError == ErrorActions.Score {
 			switch result.Strategy {
 			case "average":
 				sum += result.Score
@@ -51,17 +60,25 @@ func CalculateRisk(resultsChan <-chan RiskResult) (float64, []RiskResult) {
 	} else {
 		riskResult = 0.0
 	}
-	return riskResult, results
+	return riskResult
 }
 
-func PublishMessage(results []RiskResult) {
+// Decide returns the decision for an event's risk, an alert when it is above the threshold
+func Decide(risk float64, threshold float64) string {
+	if risk > threshold {
+		return Decisions.Alert
+	}
+	return Decisions.Pass
+}
+
+func PublishMessage(subject string, results []RiskResult) {
 	data, jsonErr := json.Marshal(results)
 	if jsonErr != nil {
 		log.Printf("Error getting NATS connection")
 		return
 	}
 
-	err := services.NatsConn.Publish("alerts", data)
+	err := services.NatsConn.Publish(subject, data)
 	if err != nil {
 		log.Printf("NATS publish error: %v", err)
 	}
@@ -76,6 +93,34 @@ func IsValidStrategy(val string) bool {
 	}
 }
 
+func IsValidEvent(val string) bool {
+	return slices.Contains(AllEvents, val)
+}
+
+func IsValidLabel(val string) bool {
+	switch val {
+	case Labels.ConfirmedFraud, Labels.FalsePositive, Labels.Legitimate:
+		return true
+	default:
+		return false
+	}
+}
+
+func IsValidEntity(val string) bool {
+	switch val {
+	case Entities.IP, Entities.Account, Entities.Device:
+		return true
+	default:
+		return false
+	}
+}
+
+// ShadowName is the name a shadow rule's results and state are reported under, apart from an enforced copy of the
+// same rule
+func ShadowName(name string) string {
+	return Modes.Shadow + ":" + name
+}
+
 func GetRuleConfig(rules []types.RuleConfig, name string) (types.RuleConfig, error) {
 	for _, rule := range rules {
 		if rule.Name == name {
@@ -7,11 +7,34 @@ type RiskResult struct {
 	Score    float64
 	Strategy string
 	Err      *string `json:"Err,omitempty"`
+	// The error policy applied, set alongside Err when it isn't ignore
+	OnError string `json:"OnError,omitempty"`
 }
 
 type NamedRiskHandler struct {
 	Name     string
 	Handler  RiskHandlerFunc
 	Strategy string
+	// Optional, reports the state the rule holds about an entity without changing it
+	Introspect IntrospectFunc
+	// Optional, called after each event is assessed with the risk from the other rules' results
+	Record RecordFunc
+	// Shadow rules are evaluated and reported but left out of the risk score and alerting
+	Shadow bool
+	// What happens to the risk when the handler errors or runs out of time, ignored when unset
+	OnError ErrorPolicy
+}
+
+// ErrorPolicy replaces the result of a rule that could not assess an event
+type ErrorPolicy struct {
+	Action string
+	// The score the rule counts as, used with the score action
+	Score float64
 }
 type RiskHandlerFunc func(ctx context.Context, args map[string]interface{}) RiskResult
+
+// IntrospectFunc returns what a rule holds about an entity, or nil if the rule doesn't track that entity type
+type IntrospectFunc func(ctx context.Context, entityType string, id string) (map[string]interface{}, error)
+
+// RecordFunc lets a rule keep state based on the outcome of an event, such as accumulating its risk
+type RecordFunc func(ctx context.Context, args map[string]interface{}, risk float64) error